@@ -870,7 +870,7 @@ where
 			"{}/assets/images/{}/{}.{}",
 			util::host(),
 			root,
-			hex::encode(&img.sha1),
+			img.file_id(),
 			typ.extension(),
 		);
 
@@ -916,8 +916,8 @@ where
 		let src = source_path(img);
 		let thumb: Html;
 		let is_audio = match img.file_type {
-			MP3 | FLAC => true,
-			WEBM | MP4 | OGG => !img.video,
+			MP3 | FLAC | OPUS | M4A | WAV => true,
+			WEBM | MP4 | OGG | MKV => !img.video,
 			_ => false,
 		};
 
@@ -928,7 +928,8 @@ where
 					150,
 					150,
 					match img.file_type {
-						WEBM | MP4 | MP3 | OGG | FLAC => "/assets/audio.png",
+						WEBM | MP4 | MKV | MP3 | OGG | FLAC | OPUS | M4A
+						| WAV => "/assets/audio.png",
 						_ => "/assets/file.png",
 					}
 					.to_string(),
@@ -938,13 +939,23 @@ where
 			{
 				// Spoilered and spoilers enabled
 				(150, 150, "/assets/spoil/default.jpg".into())
-			} else if img.file_type == GIF
-				&& c.app_state().options.expand_gif_thumbnails
-			{
-				// Animated GIF thumbnails
-				(img.thumb_width, img.thumb_height, src.clone())
 			} else {
-				(img.thumb_width, img.thumb_height, thumb_path(img))
+				// Thumbnails are shared between OPs and replies and scaled
+				// down to the dimensions of the post
+				let p = c.post();
+				let (w, h) = c.app_state().configs.uploads.thumbnails.fit(
+					p.id == p.thread,
+					img.thumb_width,
+					img.thumb_height,
+				);
+				if img.file_type == GIF
+					&& c.app_state().options.expand_gif_thumbnails
+				{
+					// Animated GIF thumbnails
+					(w, h, src.clone())
+				} else {
+					(w, h, thumb_path(img))
+				}
 			}
 		} else {
 			(img.width, img.height, src.clone())
@@ -981,8 +992,24 @@ where
 			});
 
 			thumb = match img.file_type {
-				OGG | MP4 | WEBM => {
+				OGG | MP4 | WEBM | MKV => {
 					c.link().send_message(Message::SetVolume);
+					let tracks = img
+						.subtitles
+						.iter()
+						.flatten()
+						.enumerate()
+						.map(|(i, lang)| {
+							html! {
+								<track
+									kind="subtitles"
+									src=subtitle_path(img, i)
+									srclang=lang.clone()
+									label=lang.clone()
+								/>
+							}
+						})
+						.collect::<Html>();
 					html! {
 						<video
 							ref=self.media_el.clone()
@@ -992,7 +1019,9 @@ where
 							controls=true
 							loop=true
 							onclick=contract
-						/>
+						>
+							{tracks}
+						</video>
 					}
 				}
 				_ => {
@@ -1065,7 +1094,7 @@ where
 fn thumb_path(img: &Image) -> String {
 	format!(
 		"/assets/images/thumb/{}.{}",
-		hex::encode(&img.sha1),
+		img.file_id(),
 		img.thumb_type.extension()
 	)
 }
@@ -1075,19 +1104,25 @@ fn thumb_path(img: &Image) -> String {
 fn source_path(img: &Image) -> String {
 	format!(
 		"/assets/images/thumb/{}.{}",
-		hex::encode(&img.sha1),
+		img.file_id(),
 		img.file_type.extension()
 	)
 }
 
+/// Resolve the path to a WebVTT subtitle track extracted from an upload
+#[inline]
+fn subtitle_path(img: &Image, track: usize) -> String {
+	format!("/assets/images/src/{}.{}.vtt", img.file_id(), track)
+}
+
 #[inline]
 fn is_expandable(t: FileType) -> bool {
 	use FileType::*;
 
 	match t {
 		// Nothing to preview for these
-		PDF | MP3 | FLAC | ZIP | SevenZip | TXZ | TGZ | TXT | RAR | CBR
-		| CBZ => false,
+		PDF | MP3 | FLAC | OPUS | M4A | WAV | ZIP | SevenZip | TXZ | TGZ
+		| TXT | RAR | CBR | CBZ => false,
 		_ => true,
 	}
 }
@@ -154,8 +154,6 @@ impl KeyPair {
 		use wasm_bindgen_futures::JsFuture;
 
 		let crypto = Self::crypto()?;
-		let mut arr: [u8; 512] =
-			unsafe { std::mem::MaybeUninit::uninit().assume_init() };
 		let js_arr = Uint8Array::new(
 			&JsFuture::from(crypto.sign_with_str_and_u8_array(
 				"RSASSA-PKCS1-v1_5",
@@ -183,10 +181,9 @@ impl KeyPair {
 			.await?
 			.into(),
 		);
-		if js_arr.length() != 512 {
+		if js_arr.length() as usize > common::payloads::MAX_SIGNATURE_LEN {
 			Err(format!("unexpected signature length: {}", js_arr.length()))?;
 		}
-		js_arr.copy_to(&mut arr);
-		Ok(common::payloads::Signature(arr))
+		Ok(common::payloads::Signature(js_arr.to_vec()))
 	}
 }
@@ -25,14 +25,204 @@ impl Default for UploadMaximums {
 	}
 }
 
-/// Upload configurations
+/// File categories, that can have separate upload constraints
+#[derive(Serialize, Deserialize, Hash, Eq, PartialEq, Debug, Clone, Copy)]
+#[serde(rename_all = "lowercase")]
+pub enum FileCategory {
+	Image,
+	Video,
+	Audio,
+	Archive,
+	Text,
+}
+
+/// Upload size constraints for a specific file category.
+/// Zero values mean the value of the default constraints is used.
+#[derive(Serialize, Deserialize, Default, Debug, Clone)]
+#[serde(default)]
+pub struct CategoryMaximums {
+	/// Max size in MB
+	pub size: f64,
+
+	/// Max width in pixels
+	pub width: u64,
+
+	/// Max height in pixels
+	pub height: u64,
+}
+
+/// Constraints on audio and video uploads.
+/// Zero values mean no constraint is applied.
 #[derive(Serialize, Deserialize, Default, Debug, Clone)]
+#[serde(default)]
+pub struct MediaConstraints {
+	/// Max duration in seconds
+	pub max_duration: u32,
+
+	/// Max video frame rate in frames per second
+	pub max_frame_rate: f64,
+
+	/// Max average bitrate in kbit/s
+	pub max_bitrate: u64,
+
+	/// Allowed video codecs per container file type. Containers without an
+	/// entry accept any codec.
+	pub video_codecs: HashMap<String, Vec<String>>,
+
+	/// Allowed audio codecs per container file type. Containers without an
+	/// entry accept any codec.
+	pub audio_codecs: HashMap<String, Vec<String>>,
+
+	/// Thread tags (boards), on which videos with audio are rejected
+	pub forbid_video_audio: Vec<String>,
+}
+
+/// Bounding dimensions of generated thumbnails
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(default)]
+pub struct ThumbnailDims {
+	pub width: u16,
+	pub height: u16,
+}
+
+impl Default for ThumbnailDims {
+	#[inline]
+	fn default() -> Self {
+		Self {
+			width: 150,
+			height: 150,
+		}
+	}
+}
+
+/// Thumbnail generation settings.
+///
+/// Thumbnails are shared by all posts a file is attached to, so a single
+/// thumbnail is generated to fit the larger of the OP and reply dimensions.
+/// Clients scale it down to the dimensions of the post it is displayed in.
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(default)]
+pub struct Thumbnails {
+	/// Display bounding dimensions of thumbnails of files attached to thread
+	/// OPs
+	pub op: ThumbnailDims,
+
+	/// Display bounding dimensions of thumbnails of files attached to replies
+	pub reply: ThumbnailDims,
+
+	/// JPEG thumbnail quality from 1 to 100
+	pub jpeg_quality: u8,
+
+	/// WEBP thumbnail quality from 1 to 100
+	pub webp_quality: u8,
+
+	/// Encode WEBP thumbnails losslessly, if the source file is an image no
+	/// larger than these dimensions. Zero dimensions disable lossless
+	/// encoding.
+	pub lossless_max: ThumbnailDims,
+}
+
+impl Default for Thumbnails {
+	#[inline]
+	fn default() -> Self {
+		Self {
+			op: Default::default(),
+			reply: Default::default(),
+			jpeg_quality: 90,
+			webp_quality: 90,
+			lossless_max: ThumbnailDims {
+				width: 0,
+				height: 0,
+			},
+		}
+	}
+}
+
+impl Thumbnails {
+	/// Scale the dimensions of a generated thumbnail down to fit the display
+	/// bounding dimensions of an OP or reply
+	pub fn fit(&self, op: bool, width: u16, height: u16) -> (u16, u16) {
+		let bounds = if op { &self.op } else { &self.reply };
+		let bound = |d: u16| if d == 0 { 150 } else { d as u32 };
+		let (bw, bh) = (bound(bounds.width), bound(bounds.height));
+		let (w, h) = (width as u32, height as u32);
+		if w <= bw && h <= bh {
+			return (width, height);
+		}
+
+		// Compare aspect ratios without floating point division
+		if w * bh > h * bw {
+			(bw as u16, (h * bw / w).max(1) as u16)
+		} else {
+			((w * bh / h).max(1) as u16, bh as u16)
+		}
+	}
+}
+
+/// Upload configurations
+#[derive(Serialize, Deserialize, Debug, Clone)]
 pub struct Uploads {
 	/// Use JPEG thumbnails instead of WEBP
 	pub jpeg_thumbnails: bool,
 
-	/// Upload size constraints
+	/// Maximum number of files attached to a single post.
+	/// 0 means only a single file is allowed.
+	#[serde(default = "default_max_attachments")]
+	pub max_attachments: u32,
+
+	/// Thumbnail generation settings
+	#[serde(default)]
+	pub thumbnails: Thumbnails,
+
+	/// Default upload size constraints
 	pub max: UploadMaximums,
+
+	/// Upload size constraints for specific file categories. Any unset
+	/// constraints default to the values in max.
+	#[serde(default)]
+	pub category_max: HashMap<FileCategory, CategoryMaximums>,
+
+	/// Constraints on audio and video uploads
+	#[serde(default)]
+	pub media: MediaConstraints,
+}
+
+#[inline]
+fn default_max_attachments() -> u32 {
+	4
+}
+
+impl Default for Uploads {
+	#[inline]
+	fn default() -> Self {
+		Self {
+			jpeg_thumbnails: false,
+			max_attachments: default_max_attachments(),
+			thumbnails: Default::default(),
+			max: Default::default(),
+			category_max: Default::default(),
+			media: Default::default(),
+		}
+	}
+}
+
+impl Uploads {
+	/// Return the effective upload size constraints for a file category
+	pub fn limits(&self, cat: FileCategory) -> UploadMaximums {
+		let mut m = self.max.clone();
+		if let Some(c) = self.category_max.get(&cat) {
+			if c.size != 0.0 {
+				m.size = c.size;
+			}
+			if c.width != 0 {
+				m.width = c.width;
+			}
+			if c.height != 0 {
+				m.height = c.height;
+			}
+		}
+		m
+	}
 }
 
 /// Available user interface languages
@@ -130,6 +320,48 @@ impl std::fmt::Display for Theme {
 	}
 }
 
+/// Hashcash proof-of-work challenges for uploads.
+/// Difficulty is the number of leading zero bits of a solution hash.
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(default)]
+pub struct ProofOfWork {
+	/// Require a solved challenge for each upload instead of a recently solved
+	/// captcha
+	pub enabled: bool,
+
+	/// Difficulty of challenges for keys without recent uploads on an idle
+	/// server
+	pub base_difficulty: u8,
+
+	/// Upper bound of challenge difficulty. 0 means no bound.
+	pub max_difficulty: u8,
+
+	/// Seconds uploads of a key count towards its challenge difficulty
+	pub upload_window: u32,
+
+	/// Increase difficulty by 1 per this many uploads of the key within
+	/// upload_window. 0 disables scaling by upload volume.
+	pub uploads_per_bit: u32,
+
+	/// Increase difficulty by 1 per this many files queued for processing on
+	/// the server. 0 disables scaling by server load.
+	pub queued_per_bit: u32,
+}
+
+impl Default for ProofOfWork {
+	#[inline]
+	fn default() -> Self {
+		Self {
+			enabled: false,
+			base_difficulty: 16,
+			max_difficulty: 24,
+			upload_window: 600,
+			uploads_per_bit: 5,
+			queued_per_bit: 10,
+		}
+	}
+}
+
 /// Global server configurations exposed to the client
 #[derive(Serialize, Deserialize, Default, Debug, Clone)]
 pub struct Public {
@@ -169,4 +401,8 @@ pub struct Public {
 
 	/// Upload configurations
 	pub uploads: Uploads,
+
+	/// Proof-of-work challenges for uploads
+	#[serde(default)]
+	pub proof_of_work: ProofOfWork,
 }
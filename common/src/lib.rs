@@ -9,8 +9,6 @@ pub use message_types::MessageType;
 
 #[macro_use]
 extern crate num_derive;
-#[macro_use]
-extern crate serde_big_array;
 
 /// Version of common. Increment this on change.
-pub const VERSION: u16 = 1;
+pub const VERSION: u16 = 2;
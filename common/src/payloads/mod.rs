@@ -1,16 +1,19 @@
 pub mod post_body;
 
+use crate::config::FileCategory;
 use hex_buffer_serde::{Hex, HexForm};
 use post_body::Node;
 use serde::{Deserialize, Serialize};
 use std::{collections::HashMap, sync::Arc};
 
-// Helper for big array serialization
-big_array! { BigArray; }
+/// Maximum length of a signature. Set by 4096 bit RSA keys.
+pub const MAX_SIGNATURE_LEN: usize = 512;
 
-/// Wrapper to enable logging and serialization
+/// Wrapper to enable logging and serialization.
+///
+/// Signature length depends on the key type.
 #[derive(Serialize, Deserialize, Clone)]
-pub struct Signature(#[serde(with = "BigArray")] pub [u8; 512]);
+pub struct Signature(pub Vec<u8>);
 
 impl std::fmt::Debug for Signature {
 	fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
@@ -33,7 +36,7 @@ pub enum Authorization {
 		/// Nonce to hash along with id
 		nonce: [u8; 32],
 
-		/// SHA3-256 signature of id + nonce
+		/// Signature of id + nonce by the key's algorithm
 		signature: Signature,
 	},
 }
@@ -138,7 +141,12 @@ pub struct Post {
 	/// server and client
 	pub body: Arc<Node>,
 
+	/// First attachment of the post. Kept for compatibility.
 	pub image: Option<Image>,
+
+	/// All files attached to the post in display order
+	#[serde(default)]
+	pub attachments: Vec<Image>,
 }
 
 impl Post {
@@ -159,6 +167,7 @@ impl Post {
 			open: true,
 			body: Default::default(),
 			image: None,
+			attachments: Vec::new(),
 			sage: opts.sage,
 			name: opts.post_opts.name,
 			trip: opts.post_opts.trip,
@@ -276,6 +285,12 @@ pub enum FileType {
 	RAR,
 	CBZ,
 	CBR,
+	AVIF,
+	JXL,
+	OPUS,
+	M4A,
+	WAV,
+	MKV,
 }
 
 impl FileType {
@@ -304,9 +319,32 @@ impl FileType {
 			CBZ => "cbz",
 			CBR => "cbr",
 			SVG => "svg",
+			AVIF => "avif",
+			JXL => "jxl",
+			OPUS => "opus",
+			M4A => "m4a",
+			WAV => "wav",
+			MKV => "mkv",
 			NoFile => "",
 		}
 	}
+
+	/// Return the category of the file type used for applying upload
+	/// constraints
+	pub fn category(&self) -> Option<FileCategory> {
+		use FileType::*;
+
+		Some(match self {
+			JPEG | PNG | GIF | WEBP | SVG | AVIF | JXL => FileCategory::Image,
+			WEBM | MKV | MP4 | OGG => FileCategory::Video,
+			MP3 | FLAC | OPUS | M4A | WAV => FileCategory::Audio,
+			ZIP | SevenZip | TGZ | TXZ | RAR | CBZ | CBR => {
+				FileCategory::Archive
+			}
+			TXT | PDF => FileCategory::Text,
+			NoFile => return None,
+		})
+	}
 }
 
 /// Image data inserted into a open post
@@ -314,6 +352,15 @@ impl FileType {
 pub struct Image {
 	#[serde(with = "HexForm::<[u8; 20]>")]
 	pub sha1: [u8; 20],
+
+	/// Primary content identifier. Source files and thumbnails are stored
+	/// under this hash.
+	///
+	/// None for images stored before the migration to SHA-256, that have not
+	/// been backfilled yet. Their files are stored under the SHA1 hash.
+	#[serde(with = "opt_sha256", default)]
+	pub sha256: Option<[u8; 32]>,
+
 	#[serde(with = "HexForm::<[u8; 16]>")]
 	pub md5: [u8; 16],
 
@@ -334,10 +381,48 @@ pub struct Image {
 	pub artist: Option<String>,
 	pub title: Option<String>,
 
+	/// Languages of WebVTT subtitle tracks extracted from the file, in track
+	/// order
+	#[serde(default)]
+	pub subtitles: Option<Vec<String>>,
+
 	pub name: String,
 	pub spoilered: bool,
 }
 
+impl Image {
+	/// Return the hex-encoded hash the files of the image are stored under
+	pub fn file_id(&self) -> String {
+		match &self.sha256 {
+			Some(h) => hex::encode(h),
+			None => hex::encode(&self.sha1),
+		}
+	}
+}
+
+/// (De)serialization of optional hex-encoded SHA-256 hashes
+mod opt_sha256 {
+	use hex_buffer_serde::{Hex, HexForm};
+	use serde::{Deserialize, Deserializer, Serialize, Serializer};
+
+	#[derive(Serialize, Deserialize)]
+	struct Wrapper(#[serde(with = "HexForm::<[u8; 32]>")] [u8; 32]);
+
+	pub fn serialize<S>(v: &Option<[u8; 32]>, s: S) -> Result<S::Ok, S::Error>
+	where
+		S: Serializer,
+	{
+		v.map(Wrapper).serialize(s)
+	}
+
+	pub fn deserialize<'de, D>(d: D) -> Result<Option<[u8; 32]>, D::Error>
+	where
+		D: Deserializer<'de>,
+	{
+		Ok(Option::<Wrapper>::deserialize(d)?.map(|w| w.0))
+	}
+}
+
 /// Request to insert image into an open post
 #[derive(Serialize, Deserialize, Debug, Clone)]
 pub struct InsertImage {
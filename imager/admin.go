@@ -0,0 +1,102 @@
+package imager
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Only allow requests authenticated with the admin token in the Authorization
+// header. Responds with 404, if the admin API is disabled.
+func adminOnly(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := config.Server.AdminToken
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "invalid admin token", 403)
+			return
+		}
+		inner(w, r)
+	}
+}
+
+// Encode v as a JSON response
+func serveJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// ScrubProgress serves the progress of the integrity scrubber
+func ScrubProgress(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() error {
+		return serveJSON(w, getScrubProgress())
+	})
+}
+
+// ScrubResults serves the most recently detected problems with stored files.
+// The number of results is set with the limit query parameter.
+func ScrubResults(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		limit := 100
+		if s := r.URL.Query().Get("limit"); s != "" {
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit <= 0 || limit > 1000 {
+				return common.StatusError{
+					Err:  errors.New("limit must be between 1 and 1000"),
+					Code: 400,
+				}
+			}
+		}
+
+		results, err := db.GetScrubResults(r.Context(), limit)
+		if err != nil {
+			return
+		}
+		if results == nil {
+			results = []db.ScrubResult{}
+		}
+		return serveJSON(w, results)
+	})
+}
+
+// RevokePubKey revokes the public key with the public ID in the id form field.
+// Cached copies of the key are evicted on all server instances.
+func RevokePubKey(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		pubID, err := uuid.FromString(r.FormValue("id"))
+		if err != nil {
+			return common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+
+		err = db.RevokePubKey(r.Context(), pubID)
+		switch err {
+		case nil:
+		case pgx.ErrNoRows:
+			return common.StatusError{
+				Err:  errors.New("unknown public key ID"),
+				Code: 404,
+			}
+		default:
+			return
+		}
+		pubKeyCache.Delete(pubID)
+		w.WriteHeader(204)
+		return
+	})
+}
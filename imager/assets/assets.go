@@ -2,6 +2,7 @@
 package assets
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"io"
@@ -14,17 +15,31 @@ import (
 
 // GetFilePaths generates file paths of the source file and its thumbnail
 func GetFilePaths(
+	id common.SHA256Hash,
+	fileType, thumbType common.FileType,
+) [2]string {
+	return filePaths(id.String(), fileType, thumbType)
+}
+
+// GetLegacyFilePaths generates file paths of the source file and its thumbnail
+// for files stored before the migration to SHA-256 file names
+func GetLegacyFilePaths(
 	SHA1 common.SHA1Hash,
 	fileType, thumbType common.FileType,
+) [2]string {
+	return filePaths(SHA1.String(), fileType, thumbType)
+}
+
+func filePaths(id string, fileType, thumbType common.FileType,
 ) (paths [2]string) {
 	paths[0] = fmt.Sprintf(
 		"/images/src/%s.%s",
-		SHA1,
+		id,
 		common.Extensions[fileType],
 	)
 	paths[1] = fmt.Sprintf(
 		"/images/thumb/%s.%s",
-		SHA1,
+		id,
 		common.Extensions[thumbType],
 	)
 	for i := range paths {
@@ -34,6 +49,86 @@ func GetFilePaths(
 	return
 }
 
+// GetSubtitlePath generates the file path of a WebVTT subtitle track stored
+// next to the source file
+func GetSubtitlePath(id common.SHA256Hash, track int) string {
+	return subtitlePath(id.String(), track)
+}
+
+func subtitlePath(id string, track int) string {
+	return filepath.FromSlash(fmt.Sprintf("images/src/%s.%d.vtt", id, track))
+}
+
+// MigrateLegacyFiles renames the files of an upload stored under its SHA1 hash
+// to be stored under its SHA-256 hash. Files already renamed are moved back, if
+// any rename fails.
+func MigrateLegacyFiles(
+	SHA1 common.SHA1Hash,
+	id common.SHA256Hash,
+	fileType, thumbType common.FileType,
+	subtitles int,
+) error {
+	from, to := legacyMigrationPaths(SHA1, id, fileType, thumbType, subtitles)
+	return renameAll(from, to)
+}
+
+// RevertLegacyFiles moves the files of an upload renamed by
+// MigrateLegacyFiles back to be stored under its SHA1 hash
+func RevertLegacyFiles(
+	SHA1 common.SHA1Hash,
+	id common.SHA256Hash,
+	fileType, thumbType common.FileType,
+	subtitles int,
+) error {
+	from, to := legacyMigrationPaths(SHA1, id, fileType, thumbType, subtitles)
+	return renameAll(to, from)
+}
+
+// Return the paths of the files of an upload stored under its SHA1 hash and
+// the paths to store them under its SHA-256 hash
+func legacyMigrationPaths(
+	SHA1 common.SHA1Hash,
+	id common.SHA256Hash,
+	fileType, thumbType common.FileType,
+	subtitles int,
+) (from, to []string) {
+	legacy := GetLegacyFilePaths(SHA1, fileType, thumbType)
+	paths := GetFilePaths(id, fileType, thumbType)
+	from = append(from, legacy[0])
+	to = append(to, paths[0])
+	if thumbType != common.NoFile {
+		from = append(from, legacy[1])
+		to = append(to, paths[1])
+	}
+	for i := 0; i < subtitles; i++ {
+		from = append(from, subtitlePath(SHA1.String(), i))
+		to = append(to, GetSubtitlePath(id, i))
+	}
+	return
+}
+
+// Rename files from paths in from to paths in to. Missing files are skipped.
+// Completed renames are reverted on error.
+func renameAll(from, to []string) (err error) {
+	var done []int
+	for i := range from {
+		err = os.Rename(from[i], to[i])
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Already renamed or somehow absent
+				err = nil
+				continue
+			}
+			for _, j := range done {
+				os.Rename(to[j], from[j])
+			}
+			return
+		}
+		done = append(done, i)
+	}
+	return
+}
+
 // Return free space on image storage device.
 // Image source file and thumbnail directories must be on the same drive.
 func freeSpace() (n uint64, err error) {
@@ -48,7 +143,7 @@ func freeSpace() (n uint64, err error) {
 
 // Write writes file assets to disk
 func Write(
-	SHA1 common.SHA1Hash,
+	id common.SHA256Hash,
 	fileType, thumbType common.FileType,
 	src, thumb io.ReadSeeker,
 ) (
@@ -66,7 +161,7 @@ func Write(
 		}
 	}
 
-	paths := GetFilePaths(SHA1, fileType, thumbType)
+	paths := GetFilePaths(id, fileType, thumbType)
 
 	var ch chan error
 	if thumb != nil { // Archives, audio, etc. can be missing thumbnails
@@ -85,6 +180,45 @@ func Write(
 	return
 }
 
+// WriteSubtitles writes extracted WebVTT subtitle tracks to disk in track order
+func WriteSubtitles(id common.SHA256Hash, tracks [][]byte) (err error) {
+	for i, t := range tracks {
+		err = writeFile(GetSubtitlePath(id, i), bytes.NewReader(t))
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// WriteThumbnail atomically writes or replaces the thumbnail of an upload
+func WriteThumbnail(
+	id common.SHA256Hash,
+	thumbType common.FileType,
+	thumb io.ReadSeeker,
+) (err error) {
+	path := GetFilePaths(id, common.NoFile, thumbType)[1]
+	tmp := path + ".tmp"
+	err = writeFile(tmp, thumb)
+	if err != nil {
+		os.Remove(tmp)
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+// DeleteThumbnail deletes the thumbnail of an upload, if any
+func DeleteThumbnail(id common.SHA256Hash, thumbType common.FileType) error {
+	if thumbType == common.NoFile {
+		return nil
+	}
+	err := os.Remove(GetFilePaths(id, common.NoFile, thumbType)[1])
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
 // Write a single file to disk with the appropriate permissions and flags
 func writeFile(path string, src io.ReadSeeker) (err error) {
 	file, err := os.Create(path)
@@ -102,8 +236,26 @@ func writeFile(path string, src io.ReadSeeker) (err error) {
 }
 
 // Delete deletes file assets belonging to a single upload
-func Delete(SHA1 common.SHA1Hash, fileType, thumbType common.FileType) error {
-	for _, path := range GetFilePaths(SHA1, fileType, thumbType) {
+func Delete(id common.SHA256Hash, fileType, thumbType common.FileType) error {
+	return deleteFiles(id.String(), fileType, thumbType)
+}
+
+// DeleteLegacyFiles deletes file assets of an upload stored under its SHA1
+// hash before the migration to SHA-256 file names
+func DeleteLegacyFiles(
+	SHA1 common.SHA1Hash,
+	fileType, thumbType common.FileType,
+) error {
+	return deleteFiles(SHA1.String(), fileType, thumbType)
+}
+
+func deleteFiles(id string, fileType, thumbType common.FileType) error {
+	subs, err := filepath.Glob(filepath.Join("images", "src", id+".*.vtt"))
+	if err != nil {
+		return err
+	}
+	paths := filePaths(id, fileType, thumbType)
+	for _, path := range append(paths[:], subs...) {
 		// Ignore somehow absent images
 		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 			return err
@@ -112,6 +264,19 @@ func Delete(SHA1 common.SHA1Hash, fileType, thumbType common.FileType) error {
 	return nil
 }
 
+// Quarantine moves a damaged asset file out of the served directories into
+// images/quarantine, keeping its file name. Returns the new path.
+func Quarantine(path string) (dst string, err error) {
+	dir := filepath.Join("images", "quarantine")
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return
+	}
+	dst = filepath.Join(dir, filepath.Base(path))
+	err = os.Rename(path, dst)
+	return
+}
+
 // CreateDirs creates directories for processed image storage
 func CreateDirs() error {
 	for _, dir := range [...]string{"src", "thumb"} {
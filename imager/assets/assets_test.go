@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/bakape/shamichan/imager/common"
@@ -34,8 +35,8 @@ func resetDirs(t *testing.T) {
 	}
 }
 
-func genID() (id [20]byte, idHex string) {
-	copy(id[:], test.GenBuf(20))
+func genID() (id [32]byte, idHex string) {
+	copy(id[:], test.GenBuf(32))
 	idHex = hex.EncodeToString(id[:])
 	return
 }
@@ -190,3 +191,206 @@ func TestWriteAssetsNotThumb(t *testing.T) {
 
 	test.AssertFileEquals(t, GetFilePaths(id, fileType, thumbType)[0], std)
 }
+
+func TestSubtitles(t *testing.T) {
+	resetDirs(t)
+
+	id, idHex := genID()
+	std := [...][]byte{
+		[]byte("WEBVTT\n\n00:00.000 --> 00:01.000\nfoo\n"),
+		[]byte("WEBVTT\n\n00:00.000 --> 00:01.000\nbar\n"),
+	}
+
+	err := WriteSubtitles(id, std[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range std {
+		path := GetSubtitlePath(id, i)
+		test.AssertEquals(
+			t,
+			path,
+			fmt.Sprintf("images/src/%s.%d.vtt", idHex, i),
+		)
+		test.AssertFileEquals(t, path, std[i])
+	}
+
+	err = Delete(id, common.MKV, common.NoFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range std {
+		_, err := os.Stat(GetSubtitlePath(id, i))
+		if !os.IsNotExist(err) {
+			test.UnexpectedError(t, err)
+		}
+	}
+}
+
+func TestMigrateLegacyFiles(t *testing.T) {
+	resetDirs(t)
+
+	const (
+		fileType  = common.MKV
+		thumbType = common.WEBP
+	)
+	var SHA1 common.SHA1Hash
+	copy(SHA1[:], test.GenBuf(20))
+	id, _ := genID()
+	std := [...][]byte{{1}, {2}, {3}}
+
+	legacy := GetLegacyFilePaths(SHA1, fileType, thumbType)
+	for i, path := range [...]string{
+		legacy[0],
+		legacy[1],
+		fmt.Sprintf("images/src/%s.0.vtt", SHA1),
+	} {
+		err := writeFile(path, bytes.NewReader(std[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := MigrateLegacyFiles(SHA1, id, fileType, thumbType, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := GetFilePaths(id, fileType, thumbType)
+	for i, path := range [...]string{
+		paths[0],
+		paths[1],
+		GetSubtitlePath(id, 0),
+	} {
+		test.AssertFileEquals(t, path, std[i])
+	}
+	for _, path := range legacy {
+		_, err := os.Stat(path)
+		if !os.IsNotExist(err) {
+			test.UnexpectedError(t, err)
+		}
+	}
+
+	// Repeated migrations are a NOP
+	err = MigrateLegacyFiles(SHA1, id, fileType, thumbType, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RevertLegacyFiles(SHA1, id, fileType, thumbType, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, path := range [...]string{
+		legacy[0],
+		legacy[1],
+		fmt.Sprintf("images/src/%s.0.vtt", SHA1),
+	} {
+		test.AssertFileEquals(t, path, std[i])
+	}
+}
+
+func TestMigrateLegacyFilesRollback(t *testing.T) {
+	resetDirs(t)
+
+	const (
+		fileType  = common.MKV
+		thumbType = common.WEBP
+	)
+	var SHA1 common.SHA1Hash
+	copy(SHA1[:], test.GenBuf(20))
+	id, _ := genID()
+	std := [...][]byte{{1}, {2}, {3}}
+
+	legacy := GetLegacyFilePaths(SHA1, fileType, thumbType)
+	for i, path := range [...]string{
+		legacy[0],
+		legacy[1],
+		fmt.Sprintf("images/src/%s.0.vtt", SHA1),
+	} {
+		err := writeFile(path, bytes.NewReader(std[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory in place of the subtitle file fails the last rename
+	err := os.MkdirAll(filepath.Join(GetSubtitlePath(id, 0), "dir"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = MigrateLegacyFiles(SHA1, id, fileType, thumbType, 1)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for i, path := range legacy {
+		test.AssertFileEquals(t, path, std[i])
+	}
+	for _, path := range GetFilePaths(id, fileType, thumbType) {
+		_, err := os.Stat(path)
+		if !os.IsNotExist(err) {
+			test.UnexpectedError(t, err)
+		}
+	}
+}
+
+func TestReplaceThumbnail(t *testing.T) {
+	resetDirs(t)
+
+	id, _ := genID()
+	std := [...][]byte{{1, 2, 3}, {4, 5, 6}}
+
+	err := WriteThumbnail(id, common.JPEG, bytes.NewReader(std[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = WriteThumbnail(id, common.WEBP, bytes.NewReader(std[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertFileEquals(
+		t,
+		GetFilePaths(id, common.PNG, common.WEBP)[1],
+		std[1],
+	)
+
+	err = DeleteThumbnail(id, common.JPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(GetFilePaths(id, common.PNG, common.JPEG)[1])
+	if !os.IsNotExist(err) {
+		test.UnexpectedError(t, err)
+	}
+
+	// Missing thumbnails are ignored
+	for _, typ := range [...]common.FileType{common.JPEG, common.NoFile} {
+		err = DeleteThumbnail(id, typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	resetDirs(t)
+
+	id, idHex := genID()
+	std := []byte{1, 2, 3}
+	err := Write(id, common.PNG, common.NoFile, bytes.NewReader(std), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := GetFilePaths(id, common.PNG, common.NoFile)[0]
+	dst, err := Quarantine(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, dst, fmt.Sprintf("images/quarantine/%s.png", idHex))
+	test.AssertFileEquals(t, dst, std)
+	_, err = os.Stat(src)
+	if !os.IsNotExist(err) {
+		test.UnexpectedError(t, err)
+	}
+}
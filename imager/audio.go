@@ -0,0 +1,97 @@
+package imager
+
+import (
+	"io"
+
+	"github.com/bakape/thumbnailer/v2"
+)
+
+const (
+	mimeOpus = "audio/opus"
+	mimeM4A  = "audio/mp4"
+
+	// The thumbnailer reports WAV files under this legacy MIME type
+	mimeWAV = "audio/wave"
+)
+
+// Codecs FFmpeg reports for attached pictures. A video stream with one of
+// these is cover art and not actual video.
+var coverArtCodecs = map[string]bool{
+	"mjpeg": true,
+	"png":   true,
+	"bmp":   true,
+	"gif":   true,
+	"webp":  true,
+}
+
+// Refine the MIME type of audio files, that the thumbnailer detects as generic
+// multimedia containers
+func refineAudioMime(rs io.ReadSeeker, src *thumbnailer.Source) (err error) {
+	switch src.Mime {
+	case "application/ogg":
+		if !src.HasAudio {
+			return
+		}
+		var isOpus bool
+		isOpus, err = isOpusOnly(rs)
+		if err != nil {
+			return
+		}
+		if isOpus {
+			src.Mime = mimeOpus
+			src.Extension = "opus"
+		}
+	case "video/mp4":
+		var brand [4]byte
+		_, err = rs.Seek(8, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(rs, brand[:])
+		if err != nil {
+			return
+		}
+		switch string(brand[:]) {
+		case "M4A ", "M4B ", "M4P ":
+			src.Mime = mimeM4A
+			src.Extension = "m4a"
+		}
+	}
+	return
+}
+
+// Returns, if an Ogg file contains an Opus audio stream and no video streams
+// other than cover art
+func isOpusOnly(rs io.ReadSeeker) (is bool, err error) {
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	c, err := thumbnailer.NewFFContext(rs)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	codec, err := c.CodecName(thumbnailer.FFAudio)
+	if err != nil {
+		return
+	}
+	if codec != "opus" && codec != "libopus" {
+		return
+	}
+
+	hasVideo, err := c.HasStream(thumbnailer.FFVideo)
+	if err != nil {
+		return
+	}
+	if !hasVideo {
+		return true, nil
+	}
+	codec, err = c.CodecName(thumbnailer.FFVideo)
+	if err != nil {
+		return
+	}
+	is = coverArtCodecs[codec]
+	return
+}
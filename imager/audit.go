@@ -0,0 +1,237 @@
+package imager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/go-playground/log"
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	defaultUploadAuditLimit = 100
+	maxUploadAuditLimit     = 1000
+)
+
+// Data about an upload attempt only known during processing. Shared with the
+// thumbnailing queue, which can outlive the request handler.
+type uploadAudit struct {
+	mu        sync.Mutex
+	sha1      *common.SHA1Hash
+	sha256    *common.SHA256Hash
+	abandoned bool
+}
+
+// Record the SHA1 hash of the uploaded file. Safe to call on a nil
+// *uploadAudit.
+func (a *uploadAudit) setSHA1(h common.SHA1Hash) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sha1 = &h
+}
+
+func (a *uploadAudit) getSHA1() *common.SHA1Hash {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sha1
+}
+
+// Record the SHA-256 hash of the uploaded file. Safe to call on a nil
+// *uploadAudit.
+func (a *uploadAudit) setSHA256(h common.SHA256Hash) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sha256 = &h
+}
+
+func (a *uploadAudit) getSHA256() *common.SHA256Hash {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.sha256
+}
+
+// Record the client disconnected before the file was processed. Safe to call
+// on a nil *uploadAudit.
+func (a *uploadAudit) abandon() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.abandoned = true
+}
+
+func (a *uploadAudit) isAbandoned() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.abandoned
+}
+
+// Record the outcome of an upload attempt in the upload audit log.
+// Unauthenticated attempts are not recorded.
+func auditUpload(r *http.Request, req insertionRequest, err error) {
+	if req.pubKey == 0 {
+		return
+	}
+
+	a := db.UploadAttempt{
+		PublicKey: req.pubKey,
+		IP:        clientIP(r),
+		SHA1:      req.audit.getSHA1(),
+		SHA256:    req.audit.getSHA256(),
+		Name:      auditName(req.name),
+		Post:      req.post,
+		Outcome:   uploadOutcome(err),
+	}
+	if err != nil {
+		a.Error = err.Error()
+	}
+	if req.audit.isAbandoned() {
+		a.Outcome = db.UploadAbandoned
+	}
+
+	// The request context might already be canceled
+	retention := time.Duration(config.Get().UploadAuditRetention) *
+		24 * time.Hour
+	err = db.InsertUploadAudit(context.Background(), a, retention)
+	if err != nil {
+		log.Errorf("upload audit: %s", err)
+	}
+}
+
+// Truncate a file name to fit the upload audit log and replace invalid UTF-8.
+// Names of rejected uploads are recorded as sent by the client.
+func auditName(name string) string {
+	if len(name) > 200 {
+		name = name[:200]
+	}
+	return strings.ToValidUTF8(name, "?")
+}
+
+// Classify the result of an upload attempt. Client errors are rejections and
+// any other errors are failures.
+func uploadOutcome(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return db.UploadInserted
+	case common.StatusError:
+		if err.Code >= 400 && err.Code < 500 {
+			return db.UploadRejected
+		}
+	}
+	return db.UploadFailed
+}
+
+// UploadAudit responds with upload audit log entries matching the SHA-256 or
+// SHA1 hash in the hash form field, the public key with the public ID in the
+// key form field and the IP or CIDR range in the ip form field. At least one
+// filter must be set. The limit form field sets the maximum number of entries
+// returned.
+func UploadAudit(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		_, err = authenticateStaff(w, r, common.Moderator)
+		if err != nil {
+			return
+		}
+
+		var (
+			f     db.UploadAuditFilter
+			pubID uuid.UUID
+			limit uint64 = defaultUploadAuditLimit
+		)
+		err = common.WrapError(400, func() (err error) {
+			switch s := r.FormValue("hash"); len(s) {
+			case 0:
+			case 40:
+				f.SHA1 = new(common.SHA1Hash)
+				err = f.SHA1.UnmarshalText([]byte(s))
+			default:
+				f.SHA256 = new(common.SHA256Hash)
+				err = f.SHA256.UnmarshalText([]byte(s))
+			}
+			if err != nil {
+				return
+			}
+			if s := r.FormValue("key"); s != "" {
+				pubID, err = uuid.FromString(s)
+				if err != nil {
+					return
+				}
+			}
+			if s := r.FormValue("ip"); s != "" {
+				f.IPRange, err = parseIPRange(s)
+				if err != nil {
+					return
+				}
+			}
+			if f.SHA1 == nil &&
+				f.SHA256 == nil &&
+				uuid.Equal(pubID, uuid.Nil) &&
+				f.IPRange == nil {
+				return errors.New("no hash, public key or IP to look up")
+			}
+			if s := r.FormValue("limit"); s != "" {
+				limit, err = strconv.ParseUint(s, 10, 32)
+				if err != nil {
+					return
+				}
+				if limit == 0 || limit > maxUploadAuditLimit {
+					return errors.New("limit out of range")
+				}
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		if !uuid.Equal(pubID, uuid.Nil) {
+			var key db.PubKey
+			key, err = db.GetPubKey(pubID)
+			switch err {
+			case nil:
+				f.PublicKey = key.ID
+			case pgx.ErrNoRows:
+				return common.StatusError{
+					Err:  errors.New("unknown public key ID"),
+					Code: 404,
+				}
+			default:
+				return
+			}
+		}
+
+		entries, err := db.GetUploadAudit(r.Context(), f, uint(limit))
+		if err != nil {
+			return
+		}
+		if entries == nil {
+			entries = []db.UploadAuditEntry{}
+		}
+		return serveJSON(w, entries)
+	})
+}
@@ -0,0 +1,87 @@
+package imager
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestUploadOutcome(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name    string
+		err     error
+		outcome string
+	}{
+		{"success", nil, db.UploadInserted},
+		{"client error", errTooLarge, db.UploadRejected},
+		{"banned", common.ErrAccessDenied("banned"), db.UploadRejected},
+		{
+			"server status error",
+			common.StatusError{
+				Err:  errors.New("unavailable"),
+				Code: 503,
+			},
+			db.UploadFailed,
+		},
+		{"other error", errors.New("disk full"), db.UploadFailed},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			test.AssertEquals(t, uploadOutcome(c.err), c.outcome)
+		})
+	}
+}
+
+func TestAuditName(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name, in, out string
+	}{
+		{"valid", "foo", "foo"},
+		{"invalid UTF-8", "foo\xffbar", "foo?bar"},
+		{"too long", strings.Repeat("a", 300), strings.Repeat("a", 200)},
+		{
+			"truncated rune",
+			strings.Repeat("a", 199) + "ä",
+			strings.Repeat("a", 199) + "?",
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			test.AssertEquals(t, auditName(c.in), c.out)
+		})
+	}
+}
+
+func TestUploadAuditNil(t *testing.T) {
+	t.Parallel()
+
+	var a *uploadAudit
+	a.setSHA1(common.SHA1Hash{1})
+	a.setSHA256(common.SHA256Hash{2})
+	a.abandon()
+	test.AssertEquals(t, a.getSHA1(), (*common.SHA1Hash)(nil))
+	test.AssertEquals(t, a.getSHA256(), (*common.SHA256Hash)(nil))
+	test.AssertEquals(t, a.isAbandoned(), false)
+
+	a = new(uploadAudit)
+	a.setSHA1(common.SHA1Hash{1})
+	a.setSHA256(common.SHA256Hash{2})
+	a.abandon()
+	test.AssertEquals(t, *a.getSHA1(), common.SHA1Hash{1})
+	test.AssertEquals(t, *a.getSHA256(), common.SHA256Hash{2})
+	test.AssertEquals(t, a.isAbandoned(), true)
+}
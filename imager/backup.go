@@ -0,0 +1,563 @@
+package imager
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/go-playground/log"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// Directory of image records in backup archives. Files are stored under
+	// their asset paths.
+	backupRecordDir = "records"
+
+	// Max size of a thumbnail or subtitle track in a backup archive
+	maxBackupAssetSize = 16 << 20
+)
+
+// Magic number of zstd frames
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// Command for exporting stored images and their records as a backup archive
+type exportCommand struct {
+	Output string `short:"o" long:"output" description:"File to write the archive to. Defaults to stdout."`
+
+	Format string `short:"f" long:"format" default:"tar" choice:"tar" choice:"zstd" description:"Archive format. zstd compression requires the zstd executable."`
+
+	AfterID uint64 `long:"after-id" description:"Only export images with an ID greater than this, for incremental backups"`
+
+	Since string `long:"since" description:"Only export images stored at or after this RFC 3339 timestamp, for incremental backups"`
+}
+
+func (c *exportCommand) Execute(_ []string) (err error) {
+	var since time.Time
+	if c.Since != "" {
+		since, err = time.Parse(time.RFC3339, c.Since)
+		if err != nil {
+			return
+		}
+	}
+
+	err = db.LoadDB()
+	if err != nil {
+		return
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var w io.WriteCloser = os.Stdout
+	if c.Output != "" {
+		w, err = os.Create(c.Output)
+		if err != nil {
+			return
+		}
+	}
+	defer w.Close()
+	if c.Format == "zstd" {
+		w, err = compressZstd(ctx, w)
+		if err != nil {
+			return
+		}
+		defer w.Close()
+	}
+
+	// Images not yet backfilled with a SHA-256 hash can not be exported. Make
+	// sure the next incremental backup does not advance past them.
+	skipped, firstSkipped, err := db.CountUnhashedImages(ctx, c.AfterID, since)
+	if err != nil {
+		return
+	}
+
+	lastID, n, err := exportImages(ctx, w, c.AfterID, since)
+	if err != nil {
+		return
+	}
+	if skipped != 0 {
+		log.Warnf(
+			"skipped %d images not yet backfilled with SHA-256 hashes",
+			skipped,
+		)
+		if lastID >= firstSkipped {
+			lastID = firstSkipped - 1
+		}
+	}
+	log.Infof(
+		"exported %d images. Pass --after-id %d for the next incremental "+
+			"backup",
+		n,
+		lastID,
+	)
+	return w.Close()
+}
+
+// Write a tar archive of all images with an ID greater than after, that were
+// created no earlier than since. Returns the ID of the last exported image
+// and the number of exported images.
+func exportImages(
+	ctx context.Context,
+	w io.Writer,
+	after uint64,
+	since time.Time,
+) (
+	lastID uint64,
+	n int,
+	err error,
+) {
+	lastID = after
+	tw := tar.NewWriter(w)
+	for {
+		var batch []db.ExportedImage
+		batch, err = db.GetExportBatch(ctx, lastID, since, 100)
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			err = tw.Close()
+			return
+		}
+		for _, img := range batch {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+			err = writeBackupImage(tw, img)
+			if err != nil {
+				return
+			}
+			lastID = img.ID
+			n++
+		}
+	}
+}
+
+// Return the archive paths of the files of an image in the order they are
+// stored in the archive
+func backupFilePaths(img *common.ImageCommon) (paths []string) {
+	p := assets.GetFilePaths(img.SHA256, img.FileType, img.ThumbType)
+	paths = append(paths, p[0])
+	if img.ThumbType != common.NoFile {
+		paths = append(paths, p[1])
+	}
+	for i := range img.Subtitles {
+		paths = append(paths, assets.GetSubtitlePath(img.SHA256, i))
+	}
+	for i := range paths {
+		paths[i] = filepath.ToSlash(paths[i])
+	}
+	return
+}
+
+// Write the record of an image followed by its files to a tar archive
+func writeBackupImage(tw *tar.Writer, img db.ExportedImage) (err error) {
+	rec, err := json.Marshal(img)
+	if err != nil {
+		return
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    path.Join(backupRecordDir, img.SHA256.String()+".json"),
+		Mode:    0644,
+		Size:    int64(len(rec)),
+		ModTime: img.CreatedOn,
+	})
+	if err != nil {
+		return
+	}
+	_, err = tw.Write(rec)
+	if err != nil {
+		return
+	}
+
+	for _, p := range backupFilePaths(&img.ImageCommon) {
+		err = writeBackupFile(tw, p, img.CreatedOn)
+		if err != nil {
+			return fmt.Errorf("exporting image %d: %w", img.ID, err)
+		}
+	}
+	return
+}
+
+// Write a file stored under an asset path to a tar archive
+func writeBackupFile(tw *tar.Writer, name string, modTime time.Time) (
+	err error,
+) {
+	f, err := os.Open(filepath.FromSlash(name))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    info.Size(),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(tw, f)
+	return
+}
+
+// Command for restoring images from an archive produced by exportCommand
+type restoreCommand struct {
+	Input string `short:"i" long:"input" description:"File to read the archive from. Defaults to stdin. zstd compressed archives are detected automatically."`
+}
+
+func (c *restoreCommand) Execute(_ []string) (err error) {
+	err = parallel(db.LoadDB, assets.CreateDirs)
+	if err != nil {
+		return
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var r io.ReadCloser = os.Stdin
+	if c.Input != "" {
+		r, err = os.Open(c.Input)
+		if err != nil {
+			return
+		}
+	}
+	defer r.Close()
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		var rc io.ReadCloser
+		rc, err = decompressZstd(ctx, br)
+		if err != nil {
+			return
+		}
+		defer rc.Close()
+		r = rc
+	} else {
+		r = ioutil.NopCloser(br)
+	}
+
+	var restored, skipped int
+	err = readBackup(r, func(b *backupImage) (err error) {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		ok, err := b.restore(ctx)
+		if err != nil {
+			return
+		}
+		if ok {
+			restored++
+		} else {
+			skipped++
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	log.Infof("restored %d images, skipped %d existing", restored, skipped)
+	return r.Close()
+}
+
+// Image record and files read from a backup archive
+type backupImage struct {
+	db.ExportedImage
+
+	// Source file with verified hashes
+	src *tempFile
+
+	thumb     []byte
+	subtitles [][]byte
+}
+
+// Release any resources held by the image
+func (b *backupImage) release() {
+	if b.src != nil {
+		b.src.Close()
+	}
+}
+
+// Read a file of the image from the archive. Source file hashes and size are
+// verified against the record.
+func (b *backupImage) readFile(name string, r io.Reader) (err error) {
+	paths := backupFilePaths(&b.ImageCommon)
+	i := 0
+	for ; i < len(paths); i++ {
+		if paths[i] == name {
+			break
+		}
+	}
+	switch {
+	case i == len(paths):
+		return fmt.Errorf("unexpected file in archive: %s", name)
+	case i == 0:
+		return b.readSource(r)
+	}
+
+	buf, err := ioutil.ReadAll(io.LimitReader(r, maxBackupAssetSize+1))
+	if err != nil {
+		return
+	}
+	if len(buf) > maxBackupAssetSize {
+		return fmt.Errorf("file too large: %s", name)
+	}
+	track := i - 1
+	if b.ThumbType != common.NoFile {
+		if i == 1 {
+			b.thumb = buf
+			return
+		}
+		track--
+	}
+	b.subtitles[track] = buf
+	return
+}
+
+// Read the source file of the image and verify its hashes and size
+func (b *backupImage) readSource(r io.Reader) (err error) {
+	if b.src != nil {
+		return fmt.Errorf("duplicate source file of image %s", b.SHA256)
+	}
+	tmp, err := ioutil.TempFile("", "shamichan_restore_")
+	if err != nil {
+		return
+	}
+	b.src = &tempFile{tmp}
+
+	var (
+		hSHA256 = sha256.New()
+		hSHA1   = sha1.New()
+		hMD5    = md5.New()
+	)
+	n, err := io.Copy(io.MultiWriter(b.src, hSHA256, hSHA1, hMD5), r)
+	if err != nil {
+		return
+	}
+	_, err = b.src.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	var (
+		id   common.SHA256Hash
+		SHA1 common.SHA1Hash
+		MD5  common.MD5Hash
+	)
+	copy(id[:], hSHA256.Sum(nil))
+	copy(SHA1[:], hSHA1.Sum(nil))
+	copy(MD5[:], hMD5.Sum(nil))
+	if id != b.SHA256 || SHA1 != b.SHA1 || MD5 != b.MD5 ||
+		uint64(n) != b.Size {
+		return fmt.Errorf(
+			"hash or size mismatch of image %s in archive",
+			b.SHA256,
+		)
+	}
+	return
+}
+
+// Check all files of the image were read from the archive
+func (b *backupImage) validate() error {
+	if b.src == nil {
+		return fmt.Errorf("missing source file of image %s", b.SHA256)
+	}
+	if b.ThumbType != common.NoFile && b.thumb == nil {
+		return fmt.Errorf("missing thumbnail of image %s", b.SHA256)
+	}
+	for _, s := range b.subtitles {
+		if s == nil {
+			return fmt.Errorf("missing subtitles of image %s", b.SHA256)
+		}
+	}
+	return nil
+}
+
+// Write the image record and files, unless the image is already stored.
+// Returns, if the image was restored.
+func (b *backupImage) restore(ctx context.Context) (restored bool, err error) {
+	err = db.InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		_, err = db.GetImage(ctx, tx, b.SHA256)
+		switch err {
+		case nil:
+			return
+		case pgx.ErrNoRows:
+		default:
+			return
+		}
+
+		var thumb io.ReadSeeker
+		if b.thumb != nil {
+			thumb = bytes.NewReader(b.thumb)
+		}
+		err = db.RestoreImage(ctx, tx, b.ExportedImage, b.src, thumb)
+		if err != nil {
+			return
+		}
+		err = assets.WriteSubtitles(b.SHA256, b.subtitles)
+		if err != nil {
+			return
+		}
+		restored = true
+		return
+	})
+	if db.IsConflictError(err) {
+		err = nil
+		restored = false
+	}
+	return
+}
+
+// Read an archive produced by exportImages and call fn for each image with
+// all of its files read and verified
+func readBackup(r io.Reader, fn func(*backupImage) error) (err error) {
+	var (
+		tr  = tar.NewReader(r)
+		cur *backupImage
+	)
+	defer func() {
+		if cur != nil {
+			cur.release()
+		}
+	}()
+	flush := func() (err error) {
+		if cur == nil {
+			return
+		}
+		err = cur.validate()
+		if err != nil {
+			return
+		}
+		err = fn(cur)
+		cur.release()
+		cur = nil
+		return
+	}
+
+	for {
+		var h *tar.Header
+		h, err = tr.Next()
+		switch err {
+		case nil:
+		case io.EOF:
+			return flush()
+		default:
+			return
+		}
+
+		if strings.HasPrefix(h.Name, backupRecordDir+"/") {
+			err = flush()
+			if err != nil {
+				return
+			}
+			cur = new(backupImage)
+			err = json.NewDecoder(tr).Decode(&cur.ExportedImage)
+			if err != nil {
+				return
+			}
+			cur.subtitles = make([][]byte, len(cur.Subtitles))
+			continue
+		}
+
+		if cur == nil {
+			return errors.New("file before image record in archive")
+		}
+		err = cur.readFile(h.Name, tr)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// zstd compressor, that pipes through the zstd executable
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close flushes the compressed stream and waits for the compressor to exit.
+// Safe to call multiple times.
+func (z *zstdWriter) Close() (err error) {
+	if z.cmd == nil {
+		return
+	}
+	err = z.WriteCloser.Close()
+	if werr := z.cmd.Wait(); err == nil {
+		err = werr
+	}
+	z.cmd = nil
+	return
+}
+
+// Compress all data written to the returned writer with zstd into w
+func compressZstd(ctx context.Context, w io.Writer) (io.WriteCloser, error) {
+	cmd := exec.CommandContext(ctx, "zstd", "-q", "-c")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &zstdWriter{in, cmd}, nil
+}
+
+// zstd decompressor, that pipes through the zstd executable
+type zstdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close waits for the decompressor to exit. Safe to call multiple times.
+func (z *zstdReader) Close() (err error) {
+	if z.cmd == nil {
+		return
+	}
+	// Drain any trailing data, so the decompressor can exit
+	_, err = io.Copy(ioutil.Discard, z.ReadCloser)
+	if werr := z.cmd.Wait(); err == nil {
+		err = werr
+	}
+	z.cmd = nil
+	return
+}
+
+// Decompress a zstd stream read from r
+func decompressZstd(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, "zstd", "-d", "-q", "-c")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return &zstdReader{out, cmd}, nil
+}
@@ -0,0 +1,144 @@
+package imager
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestBackupArchive(t *testing.T) {
+	t.Parallel()
+
+	src := test.ReadSample(t, "sample.webm")
+	thumb := test.ReadSample(t, "sample.png")
+	subtitles := [][]byte{[]byte("WEBVTT\n")}
+
+	std := db.ExportedImage{
+		ID:        7,
+		CreatedOn: time.Unix(1600000000, 0).UTC(),
+		ImageCommon: common.ImageCommon{
+			FileType:  common.WEBM,
+			ThumbType: common.PNG,
+			Size:      uint64(len(src)),
+			Subtitles: []string{"eng"},
+		},
+	}
+	hashImage(t, bytes.NewReader(src), &std.ImageCommon)
+	err := assets.Write(
+		std.SHA256,
+		std.FileType,
+		std.ThumbType,
+		bytes.NewReader(src),
+		bytes.NewReader(thumb),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = assets.WriteSubtitles(std.SHA256, subtitles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write := func(t *testing.T, w io.Writer, img db.ExportedImage) {
+		t.Helper()
+
+		tw := tar.NewWriter(w)
+		err := writeBackupImage(tw, img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = tw.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(t *testing.T, r io.Reader) {
+		t.Helper()
+
+		var n int
+		err := readBackup(r, func(b *backupImage) error {
+			n++
+			test.AssertEquals(t, b.ExportedImage, std)
+			test.AssertBufferEquals(t, b.thumb, thumb)
+			test.AssertEquals(t, b.subtitles, subtitles)
+
+			buf, err := ioutil.ReadAll(b.src)
+			if err != nil {
+				return err
+			}
+			test.AssertBufferEquals(t, buf, src)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, n, 1)
+	}
+
+	t.Run("tar", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+		write(t, &buf, std)
+		read(t, &buf)
+	})
+
+	t.Run("zstd", func(t *testing.T) {
+		t.Parallel()
+
+		if _, err := exec.LookPath("zstd"); err != nil {
+			t.Skip("zstd not installed")
+		}
+
+		ctx := context.Background()
+		var buf bytes.Buffer
+		w, err := compressZstd(ctx, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(t, w, std)
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasPrefix(buf.Bytes(), zstdMagic) {
+			t.Fatal("not a zstd stream")
+		}
+
+		r, err := decompressZstd(ctx, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read(t, r)
+		err = r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("hash mismatch", func(t *testing.T) {
+		t.Parallel()
+
+		corrupt := std
+		corrupt.MD5[0]++
+		var buf bytes.Buffer
+		write(t, &buf, corrupt)
+		err := readBackup(&buf, func(*backupImage) error {
+			t.Fatal("corrupt image not rejected")
+			return nil
+		})
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package imager
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Return an error with the reason and expiry of a ban, if the uploader is
+// banned by public key or IP
+func checkBan(r *http.Request, pubKey uint64) (err error) {
+	b, err := db.GetBan(r.Context(), pubKey, clientIP(r))
+	switch err {
+	case nil:
+		return errBanned(b)
+	case pgx.ErrNoRows:
+		return nil
+	default:
+		return
+	}
+}
+
+// Create an error describing a ban
+func errBanned(b db.Ban) error {
+	expiry := "permanently"
+	if !b.Expires.IsZero() {
+		expiry = "until " + b.Expires.UTC().Format(time.RFC3339)
+	}
+	return common.ErrAccessDenied(fmt.Sprintf(
+		"banned %s: %s",
+		expiry,
+		b.Reason,
+	))
+}
+
+// Parse an IP or CIDR range
+func parseIPRange(s string) (n *net.IPNet, err error) {
+	if !strings.ContainsRune(s, '/') {
+		ip := parseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP: %s", s)
+		}
+		bits := 8 * len(ip)
+		return &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		}, nil
+	}
+	_, n, err = net.ParseCIDR(s)
+	return
+}
+
+// BanUploader bans the public key with the public ID in the key form field,
+// the IP or CIDR range in the ip form field or both from uploading. The ban
+// lasts for the number of seconds in the duration form field or indefinitely,
+// if unset. Responds with the ID of the created ban. Requires moderator level.
+func BanUploader(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		staff, err := authenticateStaff(
+			w,
+			r,
+			requiredModLevels[common.BanPost],
+		)
+		if err != nil {
+			return
+		}
+
+		var (
+			pubID   uuid.UUID
+			ipRange *net.IPNet
+			expires time.Time
+			reason  = r.FormValue("reason")
+		)
+		err = common.WrapError(400, func() (err error) {
+			if s := r.FormValue("key"); s != "" {
+				pubID, err = uuid.FromString(s)
+				if err != nil {
+					return
+				}
+			}
+			if s := r.FormValue("ip"); s != "" {
+				ipRange, err = parseIPRange(s)
+				if err != nil {
+					return
+				}
+			}
+			if uuid.Equal(pubID, uuid.Nil) && ipRange == nil {
+				return errors.New("no public key or IP to ban")
+			}
+			if reason == "" {
+				return errors.New("no ban reason")
+			}
+			if s := r.FormValue("duration"); s != "" {
+				var sec uint64
+				sec, err = strconv.ParseUint(s, 10, 32)
+				if err != nil {
+					return
+				}
+				expires = time.Now().Add(time.Duration(sec) * time.Second)
+			}
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		var pubKey uint64
+		if !uuid.Equal(pubID, uuid.Nil) {
+			var key db.PubKey
+			key, err = db.GetPubKey(pubID)
+			switch err {
+			case nil:
+				pubKey = key.ID
+			case pgx.ErrNoRows:
+				return common.StatusError{
+					Err:  errors.New("unknown public key ID"),
+					Code: 404,
+				}
+			default:
+				return
+			}
+		}
+
+		var id uint64
+		err = db.InTransaction(r.Context(), func(tx pgx.Tx) (err error) {
+			id, err = db.InsertBan(
+				r.Context(),
+				tx,
+				pubKey,
+				ipRange,
+				reason,
+				expires,
+			)
+			if err != nil {
+				return
+			}
+			return db.LogModeration(
+				r.Context(),
+				tx,
+				common.BanPost,
+				0,
+				staff,
+				fmt.Sprintf("%d: %s", id, reason),
+			)
+		})
+		if err != nil {
+			return
+		}
+		return serveJSON(w, struct {
+			ID uint64 `json:"id"`
+		}{id})
+	})
+}
+
+// LiftBan lifts the ban with the ID in the id form field. Requires moderator
+// level.
+func LiftBan(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		staff, err := authenticateStaff(
+			w,
+			r,
+			requiredModLevels[common.UnbanPost],
+		)
+		if err != nil {
+			return
+		}
+
+		id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+		if err != nil {
+			return common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+
+		err = db.InTransaction(r.Context(), func(tx pgx.Tx) (err error) {
+			err = db.LiftBan(r.Context(), tx, id)
+			switch err {
+			case nil:
+			case pgx.ErrNoRows:
+				return common.StatusError{
+					Err:  errors.New("unknown ban ID"),
+					Code: 404,
+				}
+			default:
+				return
+			}
+			return db.LogModeration(
+				r.Context(),
+				tx,
+				common.UnbanPost,
+				0,
+				staff,
+				strconv.FormatUint(id, 10),
+			)
+		})
+		if err != nil {
+			return
+		}
+		w.WriteHeader(204)
+		return
+	})
+}
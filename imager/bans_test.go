@@ -0,0 +1,137 @@
+package imager
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestErrBanned(t *testing.T) {
+	t.Parallel()
+
+	err := errBanned(db.Ban{
+		Reason:  "spam",
+		Expires: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	test.AssertEquals(t, err, common.ErrAccessDenied(
+		"banned until 2030-01-02T03:04:05Z: spam",
+	))
+
+	err = errBanned(db.Ban{
+		Reason: "proxy",
+	})
+	test.AssertEquals(t, err, common.ErrAccessDenied(
+		"banned permanently: proxy",
+	))
+}
+
+func TestParseIPRange(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		in, out string
+		err     bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"192.0.2.0/24", "192.0.2.0/24", false},
+		{"192.0.2.7/24", "192.0.2.0/24", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"cirno", "", true},
+		{"192.0.2.0/33", "", true},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.in, func(t *testing.T) {
+			t.Parallel()
+
+			n, err := parseIPRange(c.in)
+			if c.err {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.AssertEquals(t, n.String(), c.out)
+		})
+	}
+}
+
+func TestBannedUpload(t *testing.T) {
+	ctx := context.Background()
+	_, kp := test_db.InsertSampleThread(t)
+
+	upload := func(t *testing.T, remote string) error {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader("id=abc"))
+		req.RemoteAddr = remote
+		setAuthHeaders(t, req, kp)
+		_, err := validateUploader(httptest.NewRecorder(), req)
+		return err
+	}
+
+	_, ipRange, err := net.ParseCIDR("203.0.113.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ipBan := insertBan(t, 0, ipRange, "proxy", time.Time{})
+	defer db.InTransaction(ctx, func(tx pgx.Tx) error {
+		return db.LiftBan(ctx, tx, ipBan)
+	})
+
+	t.Run("IP range", func(t *testing.T) {
+		err := upload(t, "203.0.113.1:1234")
+		test.AssertEquals(t, err, common.ErrAccessDenied(
+			"banned permanently: proxy",
+		))
+
+		err = upload(t, "198.51.100.1:1234")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("public key", func(t *testing.T) {
+		expires := time.Now().Add(time.Hour).Round(time.Second)
+		insertBan(t, kp.ID, nil, "spam", expires)
+
+		err := upload(t, "198.51.100.1:1234")
+		test.AssertEquals(t, err, errBanned(db.Ban{
+			Reason:  "spam",
+			Expires: expires,
+		}))
+	})
+}
+
+func insertBan(
+	t *testing.T,
+	pubKey uint64,
+	ipRange *net.IPNet,
+	reason string,
+	expires time.Time,
+) (id uint64) {
+	t.Helper()
+
+	ctx := context.Background()
+	err := db.InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		id, err = db.InsertBan(ctx, tx, pubKey, ipRange, reason, expires)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
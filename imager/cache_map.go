@@ -93,3 +93,11 @@ func (c *cacheMap) GetOrGen(
 func (c *cacheMap) Delete(key interface{}) {
 	c.m.Delete(key)
 }
+
+// Remove all keys from the map
+func (c *cacheMap) Clear() {
+	c.m.Range(func(k, _ interface{}) bool {
+		c.m.Delete(k)
+		return true
+	})
+}
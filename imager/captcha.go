@@ -0,0 +1,182 @@
+package imager
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/bakape/captchouli/v2"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/go-playground/log"
+)
+
+var (
+	errInvalidCaptcha  = common.ErrAccessDenied("invalid captcha solution")
+	errCaptchaStarting = common.StatusError{
+		Err:  errors.New("captcha service starting"),
+		Code: 503,
+	}
+
+	captchaMu sync.Mutex
+
+	// Source of captchas. Nil, until the captcha service has started.
+	captchas captchaSource
+
+	// Captcha service is being started in the background
+	captchasStarting bool
+)
+
+// Issues captchas and checks their solutions
+type captchaSource interface {
+	// Serve a new captcha form
+	serve(w http.ResponseWriter, r *http.Request) error
+
+	// Check the solution of a captcha submitted with a form in r. Returns
+	// errInvalidCaptcha, if the solution is incorrect.
+	check(r *http.Request) error
+}
+
+// Captchas generated from booru images by captchouli
+type captchouliSource struct {
+	s *captchouli.Service
+}
+
+func newCaptchouliSource(tags []string) (src captchaSource, err error) {
+	err = captchouli.Open()
+	if err != nil {
+		return
+	}
+	s, err := captchouli.NewService(captchouli.Options{
+		Quiet: true,
+		Tags:  tags,
+	})
+	if err != nil {
+		return
+	}
+	src = captchouliSource{s}
+	return
+}
+
+func (c captchouliSource) serve(w http.ResponseWriter, r *http.Request) error {
+	return c.s.ServeNewCaptcha(w, r)
+}
+
+func (captchouliSource) check(r *http.Request) (err error) {
+	var (
+		id       [64]byte
+		solution []byte
+	)
+	err = common.WrapError(400, func() (err error) {
+		id, err = captchouli.ExtractID(r)
+		if err != nil {
+			return
+		}
+		solution, err = captchouli.ExtractSolution(r)
+		return
+	})
+	if err != nil {
+		return
+	}
+	err = captchouli.CheckCaptcha(id, solution)
+	if err == captchouli.ErrInvalidSolution {
+		err = errInvalidCaptcha
+	}
+	return
+}
+
+// Return the captcha source. The captcha service is started in the background
+// on first use, which can take a while, as it populates its image pool.
+func getCaptchaSource() (src captchaSource, err error) {
+	captchaMu.Lock()
+	defer captchaMu.Unlock()
+
+	if captchas != nil {
+		return captchas, nil
+	}
+	if !captchasStarting {
+		captchasStarting = true
+		go startCaptchas()
+	}
+	err = errCaptchaStarting
+	return
+}
+
+// Start the captchouli service with the configured tags
+func startCaptchas() {
+	log.Info("captcha: starting service")
+	src, err := newCaptchouliSource(config.Get().CaptchaTags)
+
+	captchaMu.Lock()
+	defer captchaMu.Unlock()
+	captchasStarting = false
+	if err != nil {
+		log.Errorf("captcha: could not start service: %s", err)
+		return
+	}
+	captchas = src
+}
+
+// NewCaptcha serves a new captcha form
+func NewCaptcha(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		if !config.Get().Public.EnableAntispam {
+			return common.StatusError{
+				Err:  errors.New("captchas disabled"),
+				Code: 404,
+			}
+		}
+		src, err := getCaptchaSource()
+		if err != nil {
+			return
+		}
+		return src.serve(w, r)
+	})
+}
+
+// SolveCaptcha checks a captcha solution submitted by an uploader. Uploads of
+// the uploader are accepted for 3 hours after a successful solution, unless
+// its spam score is exceeded again.
+func SolveCaptcha(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		pubKey, err := authenticateUploader(r)
+		if err != nil {
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+		err = r.ParseForm()
+		if err != nil {
+			return bodyError(err)
+		}
+		err = verifyBody(r)
+		if err != nil {
+			return
+		}
+
+		err = validateCaptcha(r, pubKey)
+		if err != nil {
+			return
+		}
+		w.WriteHeader(204)
+		return
+	})
+}
+
+// Validate a captcha solution with the captcha source and record it for pubKey
+func validateCaptcha(r *http.Request, pubKey uint64) (err error) {
+	if !config.Get().Public.EnableAntispam {
+		return
+	}
+
+	src, err := getCaptchaSource()
+	if err != nil {
+		return
+	}
+	err = src.check(r)
+	if err != nil {
+		return
+	}
+	return db.RecordValidCaptcha(r.Context(), pubKey)
+}
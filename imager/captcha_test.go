@@ -0,0 +1,165 @@
+package imager
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/bakape/captchouli/v2"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+// Offline captcha source with a fixed solution
+type testCaptchas struct{}
+
+const testCaptchaSolution = "patchouli"
+
+func (testCaptchas) serve(w http.ResponseWriter, r *http.Request) error {
+	_, err := w.Write([]byte("<form></form>"))
+	return err
+}
+
+func (testCaptchas) check(r *http.Request) error {
+	if r.FormValue("solution") != testCaptchaSolution {
+		return errInvalidCaptcha
+	}
+	return nil
+}
+
+func TestCaptcha(t *testing.T) {
+	captchaMu.Lock()
+	captchas = testCaptchas{}
+	captchaMu.Unlock()
+	defer func() {
+		captchaMu.Lock()
+		captchas = nil
+		captchaMu.Unlock()
+	}()
+
+	conf := *config.Get()
+	defer config.Set(conf)
+	conf.Public.EnableAntispam = true
+	config.Set(conf)
+
+	_, kp := test_db.InsertSampleThread(t)
+
+	upload := func(t *testing.T) error {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader("id=abc"))
+		setAuthHeaders(t, req, kp)
+		_, err := validateUploader(httptest.NewRecorder(), req)
+		return err
+	}
+	solve := func(t *testing.T, solution string) int {
+		t.Helper()
+
+		body := url.Values{"solution": {solution}}.Encode()
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		setAuthHeaders(t, req, kp)
+		rec := httptest.NewRecorder()
+		SolveCaptcha(rec, req)
+		return rec.Code
+	}
+
+	t.Run("new captcha", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		NewCaptcha(rec, httptest.NewRequest("GET", "/", nil))
+		test.AssertEquals(t, rec.Code, 200)
+		test.AssertEquals(t, rec.Body.String(), "<form></form>")
+	})
+
+	test.AssertEquals(t, upload(t), error(errCaptchaRequired))
+
+	t.Run("invalid solution", func(t *testing.T) {
+		test.AssertEquals(t, solve(t, "cirno"), 403)
+		test.AssertEquals(t, upload(t), error(errCaptchaRequired))
+	})
+
+	t.Run("valid solution", func(t *testing.T) {
+		test.AssertEquals(t, solve(t, testCaptchaSolution), 204)
+		err := upload(t)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestCaptchouliSource(t *testing.T) {
+	if testing.Short() {
+		t.Skip("fetches captcha images from the network")
+	}
+
+	src, err := newCaptchouliSource([]string{
+		"patchouli_knowledge",
+		"cirno",
+		"hakurei_reimu",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve a new captcha and return its ID and correct solution
+	newCaptcha := func(t *testing.T) (id [64]byte, solution []byte) {
+		t.Helper()
+
+		rec := httptest.NewRecorder()
+		err := src.serve(rec, httptest.NewRequest("GET", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, solution, err = captchouli.ExtractCaptcha(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	submit := func(id [64]byte, selected []byte) error {
+		form := url.Values{
+			captchouli.IDKey: {base64.StdEncoding.EncodeToString(id[:])},
+		}
+		for _, i := range selected {
+			form.Set(fmt.Sprintf("captchouli-%d", i), "on")
+		}
+		req := httptest.NewRequest(
+			"POST",
+			"/",
+			strings.NewReader(form.Encode()),
+		)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return src.check(req)
+	}
+
+	t.Run("valid solution", func(t *testing.T) {
+		id, solution := newCaptcha(t)
+		err := submit(id, solution)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Solutions can not be reused
+		test.AssertEquals(t, submit(id, solution), errInvalidCaptcha)
+	})
+
+	t.Run("invalid solution", func(t *testing.T) {
+		id, _ := newCaptcha(t)
+		all := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8}
+		test.AssertEquals(t, submit(id, all), errInvalidCaptcha)
+	})
+
+	t.Run("no captcha ID", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/", nil)
+		err := src.check(req)
+		if err, ok := err.(common.StatusError); !ok || err.Code != 400 {
+			t.Fatalf("unexpected error: %#v", err)
+		}
+	})
+}
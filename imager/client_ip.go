@@ -0,0 +1,96 @@
+package imager
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bakape/shamichan/imager/config"
+)
+
+// Reverse proxies, whose forwarding headers are trusted
+var trustedProxies []*net.IPNet
+
+// Parse the trusted reverse proxy CIDR ranges from the server configuration
+func loadTrustedProxies() (err error) {
+	nets := make([]*net.IPNet, 0, len(config.Server.TrustedProxies))
+	for _, c := range config.Server.TrustedProxies {
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(c)
+		if err != nil {
+			return
+		}
+		nets = append(nets, n)
+	}
+	trustedProxies = nets
+	return
+}
+
+// Returns, if ip belongs to a trusted reverse proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve the IP of the client, that sent the request.
+//
+// Forwarding headers are only honoured, if the server is configured to be
+// reverse proxied and the request came from a trusted proxy. The client is
+// then the last address in the forwarding chain, that is not a trusted proxy.
+func clientIP(r *http.Request) net.IP {
+	ip := parseIP(r.RemoteAddr)
+	if !config.Server.ReverseProxied || ip == nil || !isTrustedProxy(ip) {
+		return ip
+	}
+
+	chain := forwardedFor(r.Header.Get("Forwarded"))
+	if len(chain) == 0 {
+		chain = strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	}
+	for i := len(chain) - 1; i >= 0; i-- {
+		hop := parseIP(chain[i])
+		if hop == nil {
+			// Can not trust anything forwarded past a malformed hop
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// Extract the for parameters of the elements of an RFC 7239 Forwarded header
+func forwardedFor(header string) (chain []string) {
+	if header == "" {
+		return
+	}
+	for _, el := range strings.Split(header, ",") {
+		for _, pair := range strings.Split(el, ";") {
+			pair = strings.TrimSpace(pair)
+			if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+				chain = append(chain, strings.Trim(pair[4:], `"`))
+			}
+		}
+	}
+	return
+}
+
+// Parse an IP address with an optional port and IPv6 brackets
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	ip := net.ParseIP(s)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return ip
+}
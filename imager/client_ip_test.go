@@ -0,0 +1,103 @@
+package imager
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestClientIP(t *testing.T) {
+	defer func(conf config.ServerConfigs) {
+		config.Server = conf
+		trustedProxies = nil
+	}(config.Server)
+	config.Server.TrustedProxies = []string{"127.0.0.0/8", "10.0.0.0/8"}
+	err := loadTrustedProxies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name, remote, xff, forwarded, ip string
+		proxied                          bool
+	}{
+		{
+			name:   "direct",
+			remote: "192.0.2.1:1234",
+			ip:     "192.0.2.1",
+		},
+		{
+			name:   "headers ignored, if not reverse proxied",
+			remote: "127.0.0.1:1234",
+			xff:    "192.0.2.1",
+			ip:     "127.0.0.1",
+		},
+		{
+			name:    "untrusted proxy",
+			remote:  "198.51.100.1:1234",
+			xff:     "192.0.2.1",
+			ip:      "198.51.100.1",
+			proxied: true,
+		},
+		{
+			name:    "X-Forwarded-For",
+			remote:  "127.0.0.1:1234",
+			xff:     "192.0.2.1",
+			ip:      "192.0.2.1",
+			proxied: true,
+		},
+		{
+			name:    "spoofed X-Forwarded-For",
+			remote:  "127.0.0.1:1234",
+			xff:     "203.0.113.1, 192.0.2.1, 10.0.0.2",
+			ip:      "192.0.2.1",
+			proxied: true,
+		},
+		{
+			name:    "malformed hop",
+			remote:  "127.0.0.1:1234",
+			xff:     "192.0.2.1, cirno",
+			ip:      "127.0.0.1",
+			proxied: true,
+		},
+		{
+			name:      "Forwarded",
+			remote:    "127.0.0.1:1234",
+			forwarded: `for=192.0.2.1;proto=https, for="[2001:db8::1]:4711"`,
+			ip:        "2001:db8::1",
+			proxied:   true,
+		},
+		{
+			name:      "Forwarded takes precedence",
+			remote:    "127.0.0.1:1234",
+			xff:       "203.0.113.1",
+			forwarded: "For=192.0.2.1",
+			ip:        "192.0.2.1",
+			proxied:   true,
+		},
+		{
+			name:    "only trusted proxies",
+			remote:  "127.0.0.1:1234",
+			xff:     "10.0.0.1",
+			ip:      "10.0.0.1",
+			proxied: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config.Server.ReverseProxied = c.proxied
+			r := httptest.NewRequest("POST", "/", nil)
+			r.RemoteAddr = c.remote
+			if c.xff != "" {
+				r.Header.Set("X-Forwarded-For", c.xff)
+			}
+			if c.forwarded != "" {
+				r.Header.Set("Forwarded", c.forwarded)
+			}
+			test.AssertEquals(t, clientIP(r).String(), c.ip)
+		})
+	}
+}
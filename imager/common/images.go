@@ -29,6 +29,12 @@ var (
 		"RAR",
 		"CBZ",
 		"CBR",
+		"AVIF",
+		"JXL",
+		"OPUS",
+		"M4A",
+		"WAV",
+		"MKV",
 	}
 )
 
@@ -57,6 +63,12 @@ const (
 	RAR
 	CBZ
 	CBR
+	AVIF
+	JXL
+	OPUS
+	M4A
+	WAV
+	MKV
 )
 
 func (f FileType) EncodeText(_ *pgtype.ConnInfo, buf []byte) ([]byte, error) {
@@ -103,6 +115,12 @@ var Extensions = map[FileType]string{
 	CBZ:      "cbz",
 	CBR:      "cbr",
 	SVG:      "svg",
+	AVIF:     "avif",
+	JXL:      "jxl",
+	OPUS:     "opus",
+	M4A:      "m4a",
+	WAV:      "wav",
+	MKV:      "mkv",
 }
 
 type errInvalidHashLen int
@@ -180,6 +198,49 @@ func (h SHA1Hash) String() string {
 	return string(buf)
 }
 
+// SHA-256 hash capable of being encoded to and decoded from Postgres bytea and
+// JSON
+type SHA256Hash [32]byte
+
+func (h SHA256Hash) EncodeBinary(_ *pgtype.ConnInfo, buf []byte) (
+	[]byte, error,
+) {
+	return append(buf, h[:]...), nil
+}
+
+func (h *SHA256Hash) DecodeBinary(_ *pgtype.ConnInfo, src []byte) (err error) {
+	if src == nil {
+		// NULL for images stored before the migration to SHA-256 content
+		// identifiers, that have not been backfilled yet
+		*h = SHA256Hash{}
+		return
+	}
+	if len(src) != 32 {
+		return errInvalidHashLen(len(src))
+	}
+	copy(h[:], src)
+	return
+}
+
+func (h SHA256Hash) MarshalText() ([]byte, error) {
+	dst := make([]byte, 64)
+	hex.Encode(dst, h[:])
+	return dst, nil
+}
+
+func (h *SHA256Hash) UnmarshalText(src []byte) (err error) {
+	if len(src) != 64 {
+		return errInvalidHashLen(len(src) / 2)
+	}
+	_, err = hex.Decode(h[:], src)
+	return
+}
+
+func (h SHA256Hash) String() string {
+	buf, _ := h.MarshalText()
+	return string(buf)
+}
+
 // Image contains a post's image and thumbnail data
 type Image struct {
 	Spoilered bool `json:"spoilered"`
@@ -204,4 +265,12 @@ type ImageCommon struct {
 	Title       *string  `json:"title"`
 	MD5         MD5Hash  `json:"md5"`
 	SHA1        SHA1Hash `json:"sha1"`
+
+	// Primary content identifier. SHA1 is only kept for lookups by legacy
+	// clients.
+	SHA256 SHA256Hash `json:"sha256"`
+
+	// Languages of WebVTT subtitle tracks extracted from the file, in track
+	// order
+	Subtitles []string `json:"subtitles"`
 }
@@ -0,0 +1,130 @@
+package common
+
+import (
+	"fmt"
+
+	"github.com/jackc/pgtype"
+)
+
+var (
+	modLevelStr = [...]string{
+		"",
+		"janitors",
+		"moderators",
+		"owners",
+		"admin",
+	}
+	modActionStr = [...]string{
+		"ban_post",
+		"unban_post",
+		"delete_post",
+		"delete_image",
+		"spoiler_image",
+		"lock_thread",
+		"delete_board",
+		"meido_vision",
+		"purge_post",
+		"shadow_bin_post",
+		"purge_image",
+	}
+)
+
+// ModerationAction is an action performable by moderation staff
+type ModerationAction uint8
+
+// All supported moderation actions
+const (
+	BanPost ModerationAction = iota
+	UnbanPost
+	DeletePost
+	DeleteImage
+	SpoilerImage
+	LockThread
+	DeleteBoard
+	MeidoVision
+	PurgePost
+	ShadowBinPost
+	PurgeImage
+)
+
+func (m ModerationAction) String() string {
+	return modActionStr[m]
+}
+
+func (m ModerationAction) EncodeText(_ *pgtype.ConnInfo, buf []byte) (
+	[]byte,
+	error,
+) {
+	return append(buf, modActionStr[m]...), nil
+}
+
+func (m ModerationAction) MarshalText() ([]byte, error) {
+	return m.EncodeText(nil, nil)
+}
+
+func (m *ModerationAction) DecodeText(_ *pgtype.ConnInfo, src []byte) error {
+	return m.UnmarshalText(src)
+}
+
+func (m *ModerationAction) UnmarshalText(text []byte) error {
+	s := string(text)
+	for i, a := range modActionStr {
+		if s == a {
+			*m = ModerationAction(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid ModerationAction: %s", s)
+}
+
+// ModerationLevel defines the level required to perform an action or the
+// permission level held by a user
+type ModerationLevel uint8
+
+// All available moderation levels
+const (
+	NotStaff ModerationLevel = iota
+	Janitor
+	Moderator
+	BoardOwner
+	Admin
+)
+
+// Returns string representation of moderation level
+func (l ModerationLevel) String() string {
+	return modLevelStr[l]
+}
+
+func (l ModerationLevel) EncodeText(_ *pgtype.ConnInfo, buf []byte) (
+	[]byte,
+	error,
+) {
+	if l == NotStaff {
+		// Not representable in the database
+		return nil, nil
+	}
+	return append(buf, modLevelStr[l]...), nil
+}
+
+func (l ModerationLevel) MarshalText() ([]byte, error) {
+	return []byte(modLevelStr[l]), nil
+}
+
+func (l *ModerationLevel) DecodeText(_ *pgtype.ConnInfo, src []byte) error {
+	if src == nil {
+		*l = NotStaff
+		return nil
+	}
+	return l.UnmarshalText(src)
+}
+
+func (l *ModerationLevel) UnmarshalText(text []byte) error {
+	s := string(text)
+	for i, a := range modLevelStr {
+		if s == a {
+			*l = ModerationLevel(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid ModerationLevel: %s", s)
+}
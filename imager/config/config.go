@@ -5,6 +5,7 @@ package config
 
 import (
 	"sync"
+	"time"
 )
 
 var (
@@ -18,7 +19,27 @@ var (
 	Defaults = Config{
 		Public: Public{
 			EnableAntispam: false,
+			ProofOfWork: ProofOfWork{
+				BaseDifficulty: 16,
+				MaxDifficulty:  24,
+				UploadWindow:   600,
+				UploadsPerBit:  5,
+				QueuedPerBit:   10,
+			},
 			Uploads: Uploads{
+				MaxAttachments: 4,
+				Thumbnails: Thumbnails{
+					OP: ThumbnailDims{
+						Width:  150,
+						Height: 150,
+					},
+					Reply: ThumbnailDims{
+						Width:  150,
+						Height: 150,
+					},
+					JPEGQuality: 90,
+					WEBPQuality: 90,
+				},
 				Max: UploadMaximums{
 					Size:   5,
 					Width:  600,
@@ -26,10 +47,46 @@ var (
 				},
 			},
 		},
+		SpamScores: SpamScores{
+			Image:      7500,
+			ImagePerMB: 1000,
+		},
+		CaptchaTags: []string{
+			"patchouli_knowledge",
+			"cirno",
+			"hakurei_reimu",
+		},
+		RateLimits: RateLimits{
+			IP: RateLimit{
+				Requests: 60,
+				Size:     200,
+			},
+			Key: RateLimit{
+				Requests: 30,
+				Size:     100,
+			},
+		},
+		UploadAuditRetention: 90,
 	}
 )
 
-// Uploads size constraints
+// File categories, that can have separate upload constraints
+type FileCategory string
+
+// File categories, that can have separate upload constraints
+const (
+	Image   FileCategory = "image"
+	Video   FileCategory = "video"
+	Audio   FileCategory = "audio"
+	Archive FileCategory = "archive"
+	Text    FileCategory = "text"
+)
+
+// FileCategories lists all file categories
+var FileCategories = [...]FileCategory{Image, Video, Audio, Archive, Text}
+
+// Uploads size constraints.
+// Zero values mean the value of the parent set of constraints is used.
 type UploadMaximums struct {
 	// Max size in MB
 	Size float64
@@ -41,13 +98,226 @@ type UploadMaximums struct {
 	Height uint64
 }
 
+// SizeBytes returns the max size in bytes
+func (m UploadMaximums) SizeBytes() uint64 {
+	return uint64(m.Size * (1 << 20))
+}
+
+// Constraints on audio and video uploads.
+// Zero values mean no constraint is applied.
+type MediaConstraints struct {
+	// Max duration in seconds
+	MaxDuration uint32 `json:"max_duration"`
+
+	// Max video frame rate in frames per second.
+	// Requires the ffprobe executable.
+	MaxFrameRate float64 `json:"max_frame_rate"`
+
+	// Max average bitrate in kbit/s
+	MaxBitrate uint64 `json:"max_bitrate"`
+
+	// Allowed video codecs per container file type (ex: "WEBM"). Containers
+	// without an entry accept any codec.
+	VideoCodecs map[string][]string `json:"video_codecs"`
+
+	// Allowed audio codecs per container file type (ex: "MP4"). Containers
+	// without an entry accept any codec.
+	AudioCodecs map[string][]string `json:"audio_codecs"`
+
+	// Thread tags (boards), on which videos with audio are rejected
+	ForbidVideoAudio []string `json:"forbid_video_audio"`
+}
+
+// Bounding dimensions of generated thumbnails
+type ThumbnailDims struct {
+	Width, Height uint16
+}
+
+// Thumbnail generation settings.
+// Zero values mean the default value is used.
+//
+// Thumbnails are shared by all posts a file is attached to, so a single
+// thumbnail is generated to fit the larger of the OP and reply dimensions.
+// Clients scale it down to the dimensions of the post it is displayed in.
+type Thumbnails struct {
+	// Display bounding dimensions of thumbnails of files attached to thread
+	// OPs
+	OP ThumbnailDims
+
+	// Display bounding dimensions of thumbnails of files attached to replies
+	Reply ThumbnailDims
+
+	// JPEG thumbnail quality from 1 to 100
+	JPEGQuality uint8 `json:"jpeg_quality"`
+
+	// WEBP thumbnail quality from 1 to 100
+	WEBPQuality uint8 `json:"webp_quality"`
+
+	// Encode WEBP thumbnails losslessly, if the source file is an image no
+	// larger than these dimensions. Lossless thumbnails of small images are
+	// often both sharper and smaller. Zero dimensions disable lossless
+	// encoding.
+	LosslessMax ThumbnailDims `json:"lossless_max"`
+}
+
+// Dims returns the effective display bounding dimensions of thumbnails of files
+// attached to an OP or reply
+func (t *Thumbnails) Dims(op bool) ThumbnailDims {
+	d := t.Reply
+	if op {
+		d = t.OP
+	}
+	if d.Width == 0 {
+		d.Width = 150
+	}
+	if d.Height == 0 {
+		d.Height = 150
+	}
+	return d
+}
+
+// GeneratedDims returns the bounding dimensions of generated thumbnails, large
+// enough to be displayed in both OPs and replies
+func (t *Thumbnails) GeneratedDims() ThumbnailDims {
+	d := t.Dims(true)
+	r := t.Dims(false)
+	if r.Width > d.Width {
+		d.Width = r.Width
+	}
+	if r.Height > d.Height {
+		d.Height = r.Height
+	}
+	return d
+}
+
+// Quality returns the effective JPEG or WEBP thumbnail quality
+func (t *Thumbnails) Quality(jpeg bool) int {
+	q := t.WEBPQuality
+	if jpeg {
+		q = t.JPEGQuality
+	}
+	switch {
+	case q == 0:
+		return 90
+	case q > 100:
+		return 100
+	default:
+		return int(q)
+	}
+}
+
+// Lossless returns, if a thumbnail of an image with the passed dimensions
+// should be encoded losslessly
+func (t *Thumbnails) Lossless(width, height uint16) bool {
+	return t.LosslessMax.Width != 0 &&
+		t.LosslessMax.Height != 0 &&
+		width <= t.LosslessMax.Width &&
+		height <= t.LosslessMax.Height
+}
+
 // Upload configurations
 type Uploads struct {
 	// Use JPEG thumbnails instead of WEBP
 	JPEGThumbnails bool `json:"jpeg_thumbnails"`
 
-	// Uploads size constraints
+	// Maximum number of files attached to a single post.
+	// 0 means only a single file is allowed.
+	MaxAttachments uint `json:"max_attachments"`
+
+	// Thumbnail generation settings
+	Thumbnails Thumbnails
+
+	// Default upload size constraints
 	Max UploadMaximums
+
+	// Upload size constraints for specific file categories. Any unset
+	// constraints default to the values in Max.
+	CategoryMax map[FileCategory]UploadMaximums `json:"category_max"`
+
+	// Constraints on audio and video uploads
+	Media MediaConstraints
+}
+
+// Limits returns the effective upload size constraints for a file category
+func (u *Uploads) Limits(cat FileCategory) UploadMaximums {
+	m := u.CategoryMax[cat]
+	if m.Size == 0 {
+		m.Size = u.Max.Size
+	}
+	if m.Width == 0 {
+		m.Width = u.Max.Width
+	}
+	if m.Height == 0 {
+		m.Height = u.Max.Height
+	}
+	return m
+}
+
+// AttachmentLimit returns the effective maximum number of files attached to a
+// single post
+func (u *Uploads) AttachmentLimit() uint {
+	if u.MaxAttachments == 0 {
+		return 1
+	}
+	return u.MaxAttachments
+}
+
+// MaxSize returns the largest effective upload size in MB across all file
+// categories. Used for rejecting requests before the file type is known.
+func (u *Uploads) MaxSize() (max float64) {
+	for _, c := range FileCategories {
+		if s := u.Limits(c).Size; s > max {
+			max = s
+		}
+	}
+	return
+}
+
+// Hashcash proof-of-work challenges for uploads.
+// Difficulty is the number of leading zero bits of a solution hash.
+type ProofOfWork struct {
+	// Require a solved challenge for each upload instead of a recently solved
+	// captcha
+	Enabled bool `json:"enabled"`
+
+	// Difficulty of challenges for keys without recent uploads on an idle
+	// server
+	BaseDifficulty uint8 `json:"base_difficulty"`
+
+	// Upper bound of challenge difficulty. 0 means no bound.
+	MaxDifficulty uint8 `json:"max_difficulty"`
+
+	// Seconds uploads of a key count towards its challenge difficulty
+	UploadWindow uint32 `json:"upload_window"`
+
+	// Increase difficulty by 1 per this many uploads of the key within
+	// UploadWindow. 0 disables scaling by upload volume.
+	UploadsPerBit uint `json:"uploads_per_bit"`
+
+	// Increase difficulty by 1 per this many files queued for processing on
+	// the server. 0 disables scaling by server load.
+	QueuedPerBit uint `json:"queued_per_bit"`
+}
+
+// Difficulty returns the challenge difficulty for a key with a number of
+// recent uploads, while a number of files are queued for processing
+func (p ProofOfWork) Difficulty(uploads, queued uint) uint8 {
+	d := uint(p.BaseDifficulty)
+	if p.UploadsPerBit != 0 {
+		d += uploads / p.UploadsPerBit
+	}
+	if p.QueuedPerBit != 0 {
+		d += queued / p.QueuedPerBit
+	}
+
+	max := uint(p.MaxDifficulty)
+	if max == 0 {
+		max = 255
+	}
+	if d > max {
+		d = max
+	}
+	return uint8(d)
 }
 
 // Global server configurations exposed to the client
@@ -57,12 +327,87 @@ type Public struct {
 
 	// Upload configurations
 	Uploads Uploads
+
+	// Proof-of-work challenges for uploads
+	ProofOfWork ProofOfWork `json:"proof_of_work"`
+}
+
+// Antispam scores of uploads in milliseconds
+type SpamScores struct {
+	// Score for inserting an image into a post
+	Image uint64
+
+	// Additional score per MB of the inserted file
+	ImagePerMB uint64 `json:"image_per_mb"`
+
+	// Multipliers of the upload score for specific file categories. Unset
+	// categories have a multiplier of 1.
+	CategoryMultipliers map[FileCategory]float64 `json:"category_multipliers"`
+}
+
+// Upload returns the spam score of inserting a file of a category and size
+// in bytes into a post
+func (s SpamScores) Upload(cat FileCategory, size uint64) time.Duration {
+	score := float64(s.Image) + float64(s.ImagePerMB)*float64(size)/(1<<20)
+	if m, ok := s.CategoryMultipliers[cat]; ok {
+		score *= m
+	}
+	return time.Duration(score * float64(time.Millisecond))
+}
+
+// Token bucket budget of uploads per minute. Zero values disable the
+// respective limit.
+type RateLimit struct {
+	// Requests per minute
+	Requests uint
+
+	// Uploaded MB per minute
+	Size float64
+}
+
+// Upload rate limits
+type RateLimits struct {
+	// Budget of each client IP. IPv6 clients are limited per /64 subnet.
+	IP RateLimit
+
+	// Budget of each public key
+	Key RateLimit
+}
+
+// Per-country and per-ASN upload rules. Require GeoIP databases to be
+// configured.
+type IPPolicy struct {
+	// ISO 3166-1 alpha-2 codes of countries denied from uploading
+	DeniedCountries []string `json:"denied_countries"`
+
+	// Numbers of autonomous systems denied from uploading
+	DeniedASNs []uint32 `json:"denied_asns"`
 }
 
 /// Global server configurations
 type Config struct {
 	// Global server configurations exposed to the client
 	Public Public
+
+	// Antispam scores for various client actions
+	SpamScores SpamScores `json:"spam_scores"`
+
+	// Booru tags for the captcha pool
+	CaptchaTags []string `json:"captcha_tags"`
+
+	// Upload rate limits
+	RateLimits RateLimits `json:"rate_limits"`
+
+	// Per-country and per-ASN upload rules
+	IPPolicy IPPolicy `json:"ip_policy"`
+
+	// Days to keep upload audit log entries for. Entries are kept
+	// indefinitely, if 0.
+	UploadAuditRetention uint `json:"upload_audit_retention"`
+
+	// Reject SHA1 hashes in upload hash lookups. Enable, once legacy clients
+	// are no longer in use.
+	DisableSHA1Lookups bool `json:"disable_sha1_lookups"`
 }
 
 // Get returns a pointer to the current server configuration struct. Callers
@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// Amount of score, after exceeding which, a captcha solution is requested
+	spamDetectionThreshold = time.Minute
+)
+
+var (
+	spamScoreBuffer = make(map[uint64]time.Duration)
+	spamMu          sync.RWMutex
+)
+
+// Sync cache and DB spam scores
+func syncSpamScores() (err error) {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+
+	if len(spamScoreBuffer) == 0 {
+		return
+	}
+	err = flushSpamScores()
+	for pubKey := range spamScoreBuffer {
+		delete(spamScoreBuffer, pubKey)
+	}
+	return
+}
+
+// Flush spam scores from buffer to DB
+func flushSpamScores() (err error) {
+	return InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
+		for pubKey, buffered := range spamScoreBuffer {
+			_, err = tx.Exec(
+				context.Background(),
+				`insert into spam_scores as s (public_key, expires)
+				values ($1, now() + $2)
+				on conflict (public_key)
+				do update set expires = (
+					(
+						case
+							when s.expires < now() then now()
+							else s.expires
+						end
+					)
+					+ $2
+				)`,
+				pubKey,
+				buffered,
+			)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+}
+
+// Increments spam detection score of a public key. The increment is buffered
+// and periodically flushed to the database.
+//
+// pubKey: private ID of user public key
+func IncrementSpamScore(pubKey uint64, increment time.Duration) {
+	if !config.Get().Public.EnableAntispam {
+		return
+	}
+
+	spamMu.Lock()
+	spamScoreBuffer[pubKey] += increment
+	spamMu.Unlock()
+}
+
+// NeedCaptcha returns, if the pubKey needs a captcha to proceed with usage
+// of server resources. A solved proof-of-work challenge substitutes for a
+// recently solved captcha, but not for an exceeded spam score.
+func NeedCaptcha(ctx context.Context, pubKey uint64, solvedPoW bool) (
+	need bool,
+	err error,
+) {
+	if !config.Get().Public.EnableAntispam {
+		return
+	}
+
+	// Require a captcha, if none have been solved in 3 hours
+	if !solvedPoW {
+		var has bool
+		has, err = SolvedCaptchaRecently(ctx, pubKey)
+		if err != nil {
+			return
+		}
+		if !has {
+			need = true
+			return
+		}
+	}
+
+	score, err := getSpamScore(ctx, pubKey)
+	if err != nil {
+		return
+	}
+	return score.After(time.Now().Add(spamDetectionThreshold)), err
+}
+
+// Merge cached and DB value and return current score
+func getSpamScore(ctx context.Context, pubKey uint64) (
+	score time.Time,
+	err error,
+) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select expires
+			from spam_scores
+			where public_key = $1 and expires > now()`,
+			pubKey,
+		).
+		Scan(&score)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows:
+		score = time.Now()
+		err = nil
+	default:
+		return
+	}
+
+	spamMu.RLock()
+	score = score.Add(spamScoreBuffer[pubKey])
+	spamMu.RUnlock()
+	return
+}
+
+// RecordValidCaptcha records a solved captcha for pubKey and resets its spam
+// score
+func RecordValidCaptcha(ctx context.Context, pubKey uint64) (err error) {
+	spamMu.Lock()
+	delete(spamScoreBuffer, pubKey)
+	spamMu.Unlock()
+
+	return InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		_, err = tx.Exec(
+			ctx,
+			`insert into last_solved_captchas (public_key, expires)
+			values ($1, now() + interval '3 hours')
+			on conflict (public_key)
+			do update set expires = excluded.expires`,
+			pubKey,
+		)
+		if err != nil {
+			return
+		}
+		_, err = tx.Exec(
+			ctx,
+			`delete from spam_scores
+			where public_key = $1`,
+			pubKey,
+		)
+		return
+	})
+}
+
+// Returns, if pubKey has solved a captcha within the last 3 hours
+func SolvedCaptchaRecently(ctx context.Context, pubKey uint64) (
+	has bool,
+	err error,
+) {
+	if !config.Get().Public.EnableAntispam {
+		has = true
+		return
+	}
+
+	err = db.
+		QueryRow(
+			ctx,
+			`select exists (
+				select
+				from last_solved_captchas
+				where public_key = $1 and expires > now()
+			)`,
+			pubKey,
+		).
+		Scan(&has)
+	return
+}
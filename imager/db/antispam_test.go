@@ -0,0 +1,155 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestSpamScores(t *testing.T) {
+	clearTables(t, "spam_scores", "last_solved_captchas")
+
+	defer config.Set(*config.Get())
+	config.Set(config.Config{
+		Public: config.Public{
+			EnableAntispam: true,
+		},
+	})
+	now := time.Now().Round(time.Second)
+
+	var users [5]uint64
+	for i := range users {
+		users[i], _ = insertSamplePubKey(t)
+	}
+	for i := 0; i < 4; i++ {
+		err := RecordValidCaptcha(context.Background(), users[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	threshold := now.Add(spamDetectionThreshold)
+	for i, score := range [...]time.Time{
+		threshold.Add(-20 * spamDetectionThreshold),
+		threshold.Add(-1 * time.Second),
+		threshold.Add(10 * spamDetectionThreshold),
+	} {
+		assertExec(
+			t,
+			`insert into spam_scores (public_key, expires)
+			values ($1, $2)`,
+			users[i+1],
+			score,
+		)
+	}
+
+	spamMu.Lock()
+	spamScoreBuffer = make(map[uint64]time.Duration)
+	spamMu.Unlock()
+	for i := 0; i < 3; i++ {
+		IncrementSpamScore(users[i], time.Second*10)
+	}
+	err := syncSpamScores()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name                   string
+		pubKey                 uint64
+		solvedPoW, needCaptcha bool
+	}{
+		{
+			name:   "fresh write",
+			pubKey: users[0],
+		},
+		{
+			name:   "overwrite stale value",
+			pubKey: users[1],
+		},
+		{
+			name:        "increment DB value",
+			pubKey:      users[2],
+			needCaptcha: true,
+		},
+		{
+			name:        "DB value over threshold",
+			pubKey:      users[3],
+			needCaptcha: true,
+		},
+		{
+			name:        "no captcha solved in 3h",
+			pubKey:      users[4],
+			needCaptcha: true,
+		},
+		{
+			name:      "proof of work instead of captcha",
+			pubKey:    users[4],
+			solvedPoW: true,
+		},
+		{
+			name:        "proof of work over threshold",
+			pubKey:      users[3],
+			solvedPoW:   true,
+			needCaptcha: true,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			need, err := NeedCaptcha(
+				context.Background(),
+				c.pubKey,
+				c.solvedPoW,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.AssertEquals(t, need, c.needCaptcha)
+		})
+	}
+
+	t.Run("buffered score", func(t *testing.T) {
+		IncrementSpamScore(users[0], 2*spamDetectionThreshold)
+		need, err := NeedCaptcha(context.Background(), users[0], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, need, true)
+
+		err = syncSpamScores()
+		if err != nil {
+			t.Fatal(err)
+		}
+		need, err = NeedCaptcha(context.Background(), users[0], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, need, true)
+	})
+
+	t.Run("clear score", func(t *testing.T) {
+		err := RecordValidCaptcha(context.Background(), users[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		need, err := NeedCaptcha(context.Background(), users[2], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, need, false)
+	})
+
+	t.Run("antispam disabled", func(t *testing.T) {
+		config.Set(config.Config{})
+		need, err := NeedCaptcha(context.Background(), users[3], false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, need, false)
+	})
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/jackc/pgtype"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Outcomes of upload attempts recorded in the upload audit log
+const (
+	UploadInserted = "inserted"
+	UploadRejected = "rejected"
+	UploadFailed   = "failed"
+
+	// Client disconnected before the file was processed. The file might still
+	// have been inserted.
+	UploadAbandoned = "abandoned"
+)
+
+// UploadAttempt is an upload attempt to record in the upload audit log.
+// Zero or empty fields are recorded as unknown.
+type UploadAttempt struct {
+	PublicKey uint64
+	IP        net.IP
+	SHA1      *common.SHA1Hash
+	SHA256    *common.SHA256Hash
+	Name      string
+	Post      uint64
+	Outcome   string
+	Error     string
+}
+
+// UploadAuditEntry is a recorded upload attempt
+type UploadAuditEntry struct {
+	ID        uint64             `json:"id"`
+	PublicKey *uuid.UUID         `json:"public_key"`
+	IP        *string            `json:"ip"`
+	SHA1      *common.SHA1Hash   `json:"sha1"`
+	SHA256    *common.SHA256Hash `json:"sha256"`
+	Name      string             `json:"name"`
+	Post      *uint64            `json:"post"`
+	Outcome   string             `json:"outcome"`
+	Error     *string            `json:"error"`
+	CreatedOn time.Time          `json:"created_on"`
+}
+
+// UploadAuditFilter selects upload audit log entries. Entries must match all
+// set fields.
+type UploadAuditFilter struct {
+	SHA1   *common.SHA1Hash
+	SHA256 *common.SHA256Hash
+
+	PublicKey uint64
+	IPRange   *net.IPNet
+}
+
+// InsertUploadAudit records an upload attempt. The entry is pruned after
+// retention or kept indefinitely, if retention is zero.
+func InsertUploadAudit(
+	ctx context.Context,
+	a UploadAttempt,
+	retention time.Duration,
+) (err error) {
+	var (
+		ip, errStr *string
+		sha1       []byte
+		sha256     []byte
+		post       *uint64
+		expires    *time.Time
+	)
+	if a.IP != nil {
+		s := a.IP.String()
+		ip = &s
+	}
+	if a.SHA1 != nil {
+		sha1 = a.SHA1[:]
+	}
+	if a.SHA256 != nil {
+		sha256 = a.SHA256[:]
+	}
+	if a.Post != 0 {
+		post = &a.Post
+	}
+	if a.Error != "" {
+		errStr = &a.Error
+	}
+	if retention != 0 {
+		t := time.Now().Add(retention)
+		expires = &t
+	}
+
+	_, err = db.Exec(
+		ctx,
+		`insert into upload_audit (
+			public_key, ip, sha1, sha256, name, post, outcome, error,
+			expires
+		)
+		values (
+			$1,
+			$2::inet,
+			$3::bytea,
+			$4::bytea,
+			$5,
+			$6::bigint,
+			$7,
+			$8::text,
+			coalesce($9::timestamptz, 'infinity')
+		)`,
+		a.PublicKey,
+		ip,
+		sha1,
+		sha256,
+		a.Name,
+		post,
+		a.Outcome,
+		errStr,
+		expires,
+	)
+	return
+}
+
+// GetUploadAudit returns up to limit upload audit log entries matching f,
+// newest first
+func GetUploadAudit(
+	ctx context.Context,
+	f UploadAuditFilter,
+	limit uint,
+) (entries []UploadAuditEntry, err error) {
+	var (
+		conds []string
+		args  []interface{}
+	)
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if f.SHA1 != nil {
+		conds = append(conds, "a.sha1 = "+arg(f.SHA1[:]))
+	}
+	if f.SHA256 != nil {
+		conds = append(conds, "a.sha256 = "+arg(f.SHA256[:]))
+	}
+	if f.PublicKey != 0 {
+		conds = append(conds, "a.public_key = "+arg(f.PublicKey))
+	}
+	if f.IPRange != nil {
+		conds = append(conds, "a.ip <<= "+arg(f.IPRange.String())+"::inet")
+	}
+	where := ""
+	if len(conds) != 0 {
+		where = "where " + strings.Join(conds, " and ")
+	}
+
+	r, err := db.Query(
+		ctx,
+		`select a.id, k.public_id, host(a.ip), a.sha1, a.sha256, a.name,
+			a.post, a.outcome, a.error, a.created_on
+		from upload_audit a
+		left join public_keys k on k.id = a.public_key
+		`+where+`
+		order by a.created_on desc, a.id desc
+		limit `+arg(limit),
+		args...,
+	)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var (
+			e      UploadAuditEntry
+			pubID  pgtype.UUID
+			sha1   []byte
+			sha256 []byte
+		)
+		err = r.Scan(
+			&e.ID,
+			&pubID,
+			&e.IP,
+			&sha1,
+			&sha256,
+			&e.Name,
+			&e.Post,
+			&e.Outcome,
+			&e.Error,
+			&e.CreatedOn,
+		)
+		if err != nil {
+			return
+		}
+		if pubID.Status == pgtype.Present {
+			id := uuid.UUID(pubID.Bytes)
+			e.PublicKey = &id
+		}
+		if sha1 != nil {
+			e.SHA1 = new(common.SHA1Hash)
+			copy(e.SHA1[:], sha1)
+		}
+		if sha256 != nil {
+			e.SHA256 = new(common.SHA256Hash)
+			copy(e.SHA256[:], sha256)
+		}
+		entries = append(entries, e)
+	}
+	err = r.Err()
+	return
+}
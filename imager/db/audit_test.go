@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestUploadAudit(t *testing.T) {
+	ctx := context.Background()
+	clearTables(t, "upload_audit")
+	img, _ := prepareSampleImage(t)
+	uploader, pubID := insertSamplePubKey(t)
+	other, _ := insertSamplePubKey(t)
+
+	var unknown common.SHA1Hash
+	copy(unknown[:], test.GenBuf(20))
+
+	attempts := [...]UploadAttempt{
+		{
+			PublicKey: uploader,
+			IP:        net.ParseIP("192.0.2.1"),
+			SHA1:      &img.SHA1,
+			SHA256:    &img.SHA256,
+			Name:      "sample",
+			Post:      1,
+			Outcome:   UploadInserted,
+		},
+		{
+			PublicKey: uploader,
+			IP:        net.ParseIP("2001:db8::1"),
+			SHA1:      &unknown,
+			Name:      "sample",
+			Outcome:   UploadRejected,
+			Error:     "file too large",
+		},
+		{
+			PublicKey: other,
+			IP:        net.ParseIP("192.0.2.2"),
+			Outcome:   UploadFailed,
+			Error:     "disk full",
+		},
+	}
+	for _, a := range attempts {
+		err := InsertUploadAudit(ctx, a, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, ipv4, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name     string
+		filter   UploadAuditFilter
+		outcomes []string
+	}{
+		{
+			name:     "SHA1",
+			filter:   UploadAuditFilter{SHA1: &img.SHA1},
+			outcomes: []string{UploadInserted},
+		},
+		{
+			name:     "SHA-256",
+			filter:   UploadAuditFilter{SHA256: &img.SHA256},
+			outcomes: []string{UploadInserted},
+		},
+		{
+			name:     "public key",
+			filter:   UploadAuditFilter{PublicKey: uploader},
+			outcomes: []string{UploadRejected, UploadInserted},
+		},
+		{
+			name:     "IP range",
+			filter:   UploadAuditFilter{IPRange: ipv4},
+			outcomes: []string{UploadFailed, UploadInserted},
+		},
+		{
+			name: "public key and IP range",
+			filter: UploadAuditFilter{
+				PublicKey: uploader,
+				IPRange:   ipv4,
+			},
+			outcomes: []string{UploadInserted},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			entries, err := GetUploadAudit(ctx, c.filter, 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			outcomes := make([]string, 0, len(entries))
+			for _, e := range entries {
+				outcomes = append(outcomes, e.Outcome)
+			}
+			test.AssertEquals(t, outcomes, c.outcomes)
+		})
+	}
+
+	t.Run("entry", func(t *testing.T) {
+		entries, err := GetUploadAudit(
+			ctx,
+			UploadAuditFilter{SHA1: &img.SHA1},
+			1,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Fatalf("unexpected entry count: %d", len(entries))
+		}
+		e := entries[0]
+		test.AssertEquals(t, *e.PublicKey, pubID)
+		test.AssertEquals(t, *e.IP, "192.0.2.1")
+		test.AssertEquals(t, *e.SHA1, img.SHA1)
+		test.AssertEquals(t, *e.SHA256, img.SHA256)
+		test.AssertEquals(t, e.Name, "sample")
+		test.AssertEquals(t, *e.Post, uint64(1))
+		test.AssertEquals(t, e.Error, (*string)(nil))
+	})
+
+	t.Run("purged image", func(t *testing.T) {
+		var purged common.SHA256Hash
+		copy(purged[:], test.GenBuf(32))
+		err := InsertUploadAudit(
+			ctx,
+			UploadAttempt{
+				PublicKey: uploader,
+				SHA256:    &purged,
+				Outcome:   UploadInserted,
+			},
+			time.Hour,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := GetUploadAudit(
+			ctx,
+			UploadAuditFilter{SHA256: &purged},
+			100,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, len(entries), 1)
+	})
+
+	t.Run("append only", func(t *testing.T) {
+		_, err := db.Exec(ctx, `update upload_audit set name = 'changed'`)
+		if err == nil {
+			t.Fatal("expected error")
+		}
+	})
+
+	t.Run("retention", func(t *testing.T) {
+		err := InsertUploadAudit(
+			ctx,
+			UploadAttempt{
+				PublicKey: other,
+				Outcome:   UploadInserted,
+			},
+			-time.Hour,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = deleteExpired(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := GetUploadAudit(
+			ctx,
+			UploadAuditFilter{PublicKey: other},
+			100,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, len(entries), 1)
+		test.AssertEquals(t, entries[0].Outcome, UploadFailed)
+	})
+}
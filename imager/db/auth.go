@@ -5,14 +5,26 @@ import (
 	"crypto/rand"
 	"fmt"
 
+	"github.com/bakape/pg_util"
 	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
 	uuid "github.com/satori/go.uuid"
 )
 
+// Signature algorithm of a public key
+type KeyType string
+
+// Supported public key signature algorithms
+const (
+	RSAKey       KeyType = "rsa"
+	Ed25519Key   KeyType = "ed25519"
+	ECDSAP256Key KeyType = "ecdsa_p256"
+)
+
 // Write public key to DB, if not already written.
 // Return its private and public IDs and, if this was a fresh insert or an
 // existing key.
-func RegisterPublicKey(pubKey []byte) (
+func RegisterPublicKey(pubKey []byte, keyType KeyType) (
 	privID uint64,
 	pubID uuid.UUID,
 	fresh bool,
@@ -37,10 +49,10 @@ try:
 	// the time the select is executed
 	tag, err = db.Exec(
 		context.Background(),
-		`insert into public_keys (public_id, public_key)
-		values ($1, $2)
+		`insert into public_keys (public_id, public_key, key_type)
+		values ($1, $2, $3)
 		on conflict (public_key) do nothing`,
-		pubID, pubKey,
+		pubID, pubKey, string(keyType),
 	)
 	if err != nil {
 		if err, ok := err.(*pgconn.PgError); ok &&
@@ -64,16 +76,68 @@ try:
 	return
 }
 
+// Public key used for authenticating uploaders
+type PubKey struct {
+	ID      uint64
+	Type    KeyType
+	Key     []byte
+	Revoked bool
+}
+
 // Get public key by its public ID
-func GetPubKey(pubID uuid.UUID) (privID uint64, pubKey []byte, err error) {
+func GetPubKey(pubID uuid.UUID) (key PubKey, err error) {
+	var typ string
 	err = db.
 		QueryRow(
 			context.Background(),
-			`select id, public_key
+			`select id, key_type, public_key, revoked
 			from public_keys
 			where public_id = $1`,
 			pubID,
 		).
-		Scan(&privID, &pubKey)
+		Scan(&key.ID, &typ, &key.Key, &key.Revoked)
+	key.Type = KeyType(typ)
 	return
 }
+
+// Revoke a public key by its public ID. Returns pgx.ErrNoRows, if no such key
+// exists.
+func RevokePubKey(ctx context.Context, pubID uuid.UUID) (err error) {
+	tag, err := db.Exec(
+		ctx,
+		`update public_keys
+		set revoked = true
+		where public_id = $1`,
+		pubID,
+	)
+	if err != nil {
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		err = pgx.ErrNoRows
+	}
+	return
+}
+
+// Listen for public key revocations and deletions on any server instance.
+// onReconnect is called after the connection to the database was lost and
+// revocations may have been missed.
+func ListenPubKeyRevocations(
+	ctx context.Context,
+	onRevoke func(pubID uuid.UUID),
+	onReconnect func(),
+) error {
+	return Listen(pg_util.ListenOpts{
+		Channel: "public_keys.revoked",
+		OnMsg: func(msg string) (err error) {
+			pubID, err := uuid.FromString(msg)
+			if err != nil {
+				return
+			}
+			onRevoke(pubID)
+			return
+		},
+		OnReconnect: onReconnect,
+		Context:     ctx,
+	})
+}
@@ -1,10 +1,13 @@
 package db
 
 import (
+	"context"
 	"crypto/rand"
 	"testing"
+	"time"
 
 	"github.com/bakape/shamichan/imager/test"
+	"github.com/jackc/pgx/v4"
 	uuid "github.com/satori/go.uuid"
 )
 
@@ -16,14 +19,14 @@ func TestRegisterPublicKey(t *testing.T) {
 	}
 
 	// Initial insert
-	privID1, pubID1, fresh, err := RegisterPublicKey(pubKey[:])
+	privID1, pubID1, fresh, err := RegisterPublicKey(pubKey[:], Ed25519Key)
 	if err != nil {
 		t.Fatal(err)
 	}
 	test.AssertEquals(t, fresh, true)
 
 	// Existing key
-	privID2, pubID2, fresh, err := RegisterPublicKey(pubKey[:])
+	privID2, pubID2, fresh, err := RegisterPublicKey(pubKey[:], Ed25519Key)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -31,25 +34,69 @@ func TestRegisterPublicKey(t *testing.T) {
 	test.AssertEquals(t, pubID1, pubID2)
 	test.AssertEquals(t, fresh, false)
 
-	privID3, pubKey3, err := GetPubKey(pubID1)
+	key, err := GetPubKey(pubID1)
 	if err != nil {
 		t.Fatal(err)
 	}
-	test.AssertEquals(t, privID3, privID1)
-	test.AssertEquals(t, pubKey[:], pubKey3)
+	test.AssertEquals(t, key, PubKey{
+		ID:   privID1,
+		Type: Ed25519Key,
+		Key:  pubKey[:],
+	})
 
 	// Different key
 	_, err = rand.Read(pubKey[:])
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, _, fresh, err = RegisterPublicKey(pubKey[:])
+	_, _, fresh, err = RegisterPublicKey(pubKey[:], Ed25519Key)
 	if err != nil {
 		t.Fatal(err)
 	}
 	test.AssertEquals(t, fresh, true)
 }
 
+func TestRevokePubKey(t *testing.T) {
+	ctx := context.Background()
+	_, pubID := insertSamplePubKey(t)
+
+	revoked := make(chan uuid.UUID, 1)
+	listenCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err := ListenPubKeyRevocations(
+		listenCtx,
+		func(id uuid.UUID) {
+			revoked <- id
+		},
+		func() {},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RevokePubKey(ctx, pubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := GetPubKey(pubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, key.Revoked, true)
+
+	select {
+	case id := <-revoked:
+		test.AssertEquals(t, id, pubID)
+	case <-time.After(5 * time.Second):
+		t.Fatal("revocation not notified")
+	}
+
+	t.Run("unknown key", func(t *testing.T) {
+		err := RevokePubKey(ctx, uuid.NewV4())
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+	})
+}
+
 // Does not actually insert a valid public key, but that is fine as they are
 // only read in the websockets module
 func insertSamplePubKey(t *testing.T) (privID uint64, pubID uuid.UUID) {
@@ -60,7 +107,7 @@ func insertSamplePubKey(t *testing.T) (privID uint64, pubID uuid.UUID) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	privID, pubID, _, err = RegisterPublicKey(key[:])
+	privID, pubID, _, err = RegisterPublicKey(key[:], RSAKey)
 	if err != nil {
 		t.Fatal(err)
 	}
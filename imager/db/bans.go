@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Ban of a public key or IP range from uploading
+type Ban struct {
+	ID     uint64
+	Reason string
+
+	// Zero for permanent bans
+	Expires time.Time
+}
+
+// InsertBan bans a public key, an IP range or both from uploading until
+// expires. A zero pubKey or nil ipRange leave the respective field unset. A
+// zero expires makes the ban permanent.
+func InsertBan(
+	ctx context.Context,
+	tx pgx.Tx,
+	pubKey uint64,
+	ipRange *net.IPNet,
+	reason string,
+	expires time.Time,
+) (id uint64, err error) {
+	var (
+		key *uint64
+		ip  *string
+		exp *time.Time
+	)
+	if pubKey != 0 {
+		key = &pubKey
+	}
+	if ipRange != nil {
+		s := ipRange.String()
+		ip = &s
+	}
+	if !expires.IsZero() {
+		exp = &expires
+	}
+
+	err = tx.
+		QueryRow(
+			ctx,
+			`insert into bans (public_key, ip, reason, expires)
+			values (
+				$1::bigint,
+				$2::cidr,
+				$3,
+				coalesce($4::timestamptz, 'infinity')
+			)
+			returning id`,
+			key,
+			ip,
+			reason,
+			exp,
+		).
+		Scan(&id)
+	return
+}
+
+// LiftBan deletes a ban. Returns pgx.ErrNoRows, if no such ban exists.
+func LiftBan(ctx context.Context, tx pgx.Tx, id uint64) (err error) {
+	return tx.
+		QueryRow(ctx, `delete from bans where id = $1 returning id`, id).
+		Scan(&id)
+}
+
+// GetBan returns the longest lasting unexpired ban of pubKey or a range
+// containing ip. Returns pgx.ErrNoRows, if the uploader is not banned.
+func GetBan(ctx context.Context, pubKey uint64, ip net.IP) (b Ban, err error) {
+	var addr *string
+	if ip != nil {
+		s := ip.String()
+		addr = &s
+	}
+
+	var expires *time.Time
+	err = db.
+		QueryRow(
+			ctx,
+			`select id, reason, nullif(expires, 'infinity')
+			from bans
+			where expires > now()
+				and (public_key = $1 or ip >>= $2::inet)
+			order by expires desc
+			limit 1`,
+			pubKey,
+			addr,
+		).
+		Scan(&b.ID, &b.Reason, &expires)
+	if expires != nil {
+		b.Expires = *expires
+	}
+	return
+}
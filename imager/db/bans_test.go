@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestBans(t *testing.T) {
+	ctx := context.Background()
+	banned, _ := insertSamplePubKey(t)
+	other, _ := insertSamplePubKey(t)
+	_, ipRange, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clean := net.ParseIP("198.51.100.1")
+	expires := time.Now().Add(time.Hour).Round(time.Second)
+
+	var keyBan, ipBan uint64
+	err = InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		keyBan, err = InsertBan(ctx, tx, banned, nil, "spam", expires)
+		if err != nil {
+			return
+		}
+		ipBan, err = InsertBan(ctx, tx, 0, ipRange, "proxy", time.Time{})
+		if err != nil {
+			return
+		}
+		_, err = InsertBan(
+			ctx,
+			tx,
+			other,
+			nil,
+			"expired",
+			time.Now().Add(-time.Hour),
+		)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name   string
+		pubKey uint64
+		ip     net.IP
+		ban    Ban
+		err    error
+	}{
+		{
+			name:   "public key",
+			pubKey: banned,
+			ip:     clean,
+			ban: Ban{
+				ID:      keyBan,
+				Reason:  "spam",
+				Expires: expires,
+			},
+		},
+		{
+			name:   "IP range",
+			pubKey: other,
+			ip:     net.ParseIP("192.0.2.7"),
+			ban: Ban{
+				ID:     ipBan,
+				Reason: "proxy",
+			},
+		},
+		{
+			name:   "not banned",
+			pubKey: other,
+			ip:     clean,
+			err:    pgx.ErrNoRows,
+		},
+		{
+			name:   "no IP",
+			pubKey: other,
+			err:    pgx.ErrNoRows,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := GetBan(ctx, c.pubKey, c.ip)
+			test.AssertEquals(t, err, c.err)
+			if err != nil {
+				return
+			}
+			test.AssertEquals(t, b.ID, c.ban.ID)
+			test.AssertEquals(t, b.Reason, c.ban.Reason)
+			test.AssertEquals(t, b.Expires.Equal(c.ban.Expires), true)
+		})
+	}
+
+	t.Run("lift", func(t *testing.T) {
+		lift := func() error {
+			return InTransaction(ctx, func(tx pgx.Tx) error {
+				return LiftBan(ctx, tx, keyBan)
+			})
+		}
+
+		err := lift()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = GetBan(ctx, banned, clean)
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+
+		err = lift()
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+	})
+}
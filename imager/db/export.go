@@ -0,0 +1,166 @@
+package db
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/jackc/pgx/v4"
+)
+
+// Image record with the metadata needed to restore it on a different node
+type ExportedImage struct {
+	ID        uint64    `json:"id"`
+	CreatedOn time.Time `json:"created_on"`
+	common.ImageCommon
+
+	// Alternative hashes of the image
+	Aliases []ImageAlias `json:"aliases"`
+}
+
+// Alternative hashes of an image modified during processing
+type ImageAlias struct {
+	// Only nil for aliases recorded before the migration to SHA-256
+	SHA256 *common.SHA256Hash `json:"sha256"`
+
+	SHA1 common.SHA1Hash `json:"sha1"`
+}
+
+// GetExportBatch returns up to limit image records with an ID greater than
+// after, that were created no earlier than since, ordered by ID.
+// Images without a SHA-256 hash are skipped until they are backfilled.
+func GetExportBatch(
+	ctx context.Context,
+	after uint64,
+	since time.Time,
+	limit int,
+) (
+	images []ExportedImage,
+	err error,
+) {
+	r, err := db.Query(
+		ctx,
+		`select id, created_on, `+imageColumns+`
+		from images
+		where id > $1 and created_on >= $2 and sha256 is not null
+		order by id
+		limit $3`,
+		after,
+		since,
+		limit,
+	)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	byID := make(map[uint64]int)
+	for r.Next() {
+		var img ExportedImage
+		err = scanImage(r, &img.ImageCommon, &img.ID, &img.CreatedOn)
+		if err != nil {
+			return
+		}
+		byID[img.ID] = len(images)
+		images = append(images, img)
+	}
+	err = r.Err()
+	if err != nil || len(images) == 0 {
+		return
+	}
+
+	ids := make([]int64, 0, len(images))
+	for _, img := range images {
+		ids = append(ids, int64(img.ID))
+	}
+	r, err = db.Query(
+		ctx,
+		`select image, sha256, sha1
+		from image_aliases
+		where image = any($1)`,
+		ids,
+	)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var (
+			id    uint64
+			alias ImageAlias
+		)
+		err = r.Scan(&id, &alias.SHA256, &alias.SHA1)
+		if err != nil {
+			return
+		}
+		img := &images[byID[id]]
+		img.Aliases = append(img.Aliases, alias)
+	}
+	err = r.Err()
+	return
+}
+
+// CountUnhashedImages returns the number of images with an ID greater than
+// after, that were created no earlier than since and are not yet backfilled
+// with a SHA-256 hash, and the lowest ID among them
+func CountUnhashedImages(ctx context.Context, after uint64, since time.Time) (
+	n int,
+	firstID uint64,
+	err error,
+) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select count(*), coalesce(min(id), 0)
+			from images
+			where id > $1 and created_on >= $2 and sha256 is null`,
+			after,
+			since,
+		).
+		Scan(&n, &firstID)
+	return
+}
+
+// RestoreImage allocates the files of an exported image and writes its record
+// and aliases to the database
+func RestoreImage(
+	ctx context.Context,
+	tx pgx.Tx,
+	img ExportedImage,
+	src, thumb io.ReadSeeker,
+) (err error) {
+	err = AllocateImage(ctx, tx, img.ImageCommon, src, thumb)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		`update images
+		set created_on = $1
+		where sha256 = $2`,
+		img.CreatedOn,
+		img.SHA256,
+	)
+	if err != nil {
+		return
+	}
+	for _, a := range img.Aliases {
+		_, err = tx.Exec(
+			ctx,
+			`insert into image_aliases (sha256, sha1, image)
+			select $1, $2, id
+			from images
+			where sha256 = $3
+			on conflict do nothing`,
+			a.SHA256,
+			a.SHA1,
+			img.SHA256,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
@@ -2,12 +2,17 @@ package db
 
 import (
 	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
+	"os"
+	"strconv"
 
 	"github.com/bakape/pg_util"
 	"github.com/bakape/shamichan/imager/assets"
 	"github.com/bakape/shamichan/imager/common"
+	"github.com/go-playground/log"
 	"github.com/jackc/pgx/v4"
 )
 
@@ -29,39 +34,95 @@ func AllocateImage(
 	if err != nil {
 		return
 	}
-	return assets.Write(img.SHA1, img.FileType, img.ThumbType, src, thumb)
+	return assets.Write(img.SHA256, img.FileType, img.ThumbType, src, thumb)
 }
 
-// Insert and image into and existing open post. Returns the post's thread.
+// ErrTooManyAttachments is returned, when a post already has the maximum
+// number of attachments
+var ErrTooManyAttachments = errors.New("too many attachments")
+
+// ErrImageNotFound is returned, when inserting an image not in the database
+var ErrImageNotFound = errors.New("image not found")
+
+// Append an image to the attachments of an existing open post. Returns the
+// post's thread.
 //
-// Returns pgx.ErrNoRows, if no open post for the target pubKey was found.
+// Returns pgx.ErrNoRows, if no open post for the target pubKey was found,
+// ErrTooManyAttachments, if the post already has max attachments, and
+// ErrImageNotFound, if no image with the img hash exists.
 func InsertImage(
 	ctx context.Context,
 	tx pgx.Tx,
 	post, pubKey uint64,
-	img common.SHA1Hash,
+	img common.SHA256Hash,
 	name string,
 	spoilered bool,
+	max uint,
 ) (
 	thread uint64,
 	err error,
 ) {
+	var position uint
 	err = tx.
 		QueryRow(
 			ctx,
-			`update posts
-			set image = $1,
-				image_name = $2,
-				image_spoilered = $3
-			where open and public_key = $4 and id = $5 and image is null
-			returning thread`,
-			img,
-			name,
-			spoilered,
+			`select p.thread, (
+				select count(*)
+				from post_attachments a
+				where a.post = p.id
+			)
+			from posts p
+			where open and public_key = $1 and id = $2
+			for update`,
 			pubKey,
 			post,
 		).
-		Scan(&thread)
+		Scan(&thread, &position)
+	if err != nil {
+		return
+	}
+	if position >= max {
+		err = ErrTooManyAttachments
+		return
+	}
+
+	// Bumps the thread and notifies listeners through a trigger
+	res, err := tx.Exec(
+		ctx,
+		`insert into post_attachments (post, position, image, name, spoilered)
+		select $1, $2, id, $3, $4
+		from images
+		where sha256 = $5`,
+		post,
+		position,
+		name,
+		spoilered,
+		img,
+	)
+	if err != nil {
+		return
+	}
+	if res.RowsAffected() == 0 {
+		err = ErrImageNotFound
+		return
+	}
+	if position != 0 {
+		return
+	}
+
+	// Keep the first attachment in the legacy single image columns
+	_, err = tx.Exec(
+		ctx,
+		`update posts
+		set image = (select id from images where sha256 = $1),
+			image_name = $2,
+			image_spoilered = $3
+		where id = $4`,
+		img,
+		name,
+		spoilered,
+		post,
+	)
 	return
 }
 
@@ -105,62 +166,396 @@ func ScheduleImageProcessing(
 	})
 }
 
-// Retrieves a thumbnailed image record from the DB.
+// Retrieves a thumbnailed image record from the DB by its SHA-256 hash or an
+// alias of it.
+// Protects it from possible concurrent deletes until the transaction closes.
+func GetImage(ctx context.Context, tx pgx.Tx, id common.SHA256Hash) (
+	common.ImageCommon,
+	error,
+) {
+	return getImage(ctx, tx, "sha256", id)
+}
+
+// Retrieves a thumbnailed image record from the DB by its SHA1 hash or an
+// alias of it. Only used for lookups by legacy clients.
 // Protects it from possible concurrent deletes until the transaction closes.
-func GetImage(ctx context.Context, tx pgx.Tx, id common.SHA1Hash) (
+func GetImageBySHA1(ctx context.Context, tx pgx.Tx, id common.SHA1Hash) (
+	common.ImageCommon,
+	error,
+) {
+	return getImage(ctx, tx, "sha1", id)
+}
+
+// Columns of an image record in the order scanned by scanImage
+const imageColumns = `
+	sha1,
+	sha256,
+	md5,
+
+	audio,
+	video,
+
+	file_type,
+	thumb_type,
+
+	width,
+	height,
+	thumb_width,
+	thumb_height,
+
+	size,
+	duration,
+
+	title,
+	artist,
+
+	subtitles`
+
+// Scan an image record selected with imageColumns
+func scanImage(r pgx.Row, img *common.ImageCommon, prefix ...interface{},
+) error {
+	return r.Scan(append(
+		prefix,
+		&img.SHA1,
+		&img.SHA256,
+		&img.MD5,
+
+		&img.Audio,
+		&img.Video,
+
+		&img.FileType,
+		&img.ThumbType,
+
+		&img.Width,
+		&img.Height,
+		&img.ThumbWidth,
+		&img.ThumbHeight,
+
+		&img.Size,
+		&img.Duration,
+
+		&img.Title,
+		&img.Artist,
+
+		&img.Subtitles,
+	)...)
+}
+
+// Images not yet backfilled with a SHA-256 hash are treated as absent, so their
+// files are uploaded and processed anew
+func getImage(ctx context.Context, tx pgx.Tx, column string, id interface{}) (
 	img common.ImageCommon,
 	err error,
 ) {
-	err = db.
-		QueryRow(
-			context.Background(),
-			`select
-				md5,
+	err = scanImage(
+		tx.QueryRow(
+			ctx,
+			fmt.Sprintf(
+				`select %[1]s
+				from images
+				where sha256 is not null
+					and (
+						%[2]s = $1
+						or id = (
+							select image
+							from image_aliases
+							where %[2]s = $1
+						)
+					)
+				limit 1
+				for update`,
+				imageColumns,
+				column,
+			),
+			id,
+		),
+		&img,
+	)
+	return
+}
+
+// Image record with its internal ID
+type StoredImage struct {
+	ID uint64
+	common.ImageCommon
+}
+
+// GetImageBatch returns up to limit image records with an ID greater than
+// after, ordered by ID. Used for iterating over all stored images.
+// Images not yet backfilled with a SHA-256 hash are skipped, as their files are
+// still stored under legacy names.
+func GetImageBatch(ctx context.Context, after uint64, limit int) (
+	images []StoredImage,
+	err error,
+) {
+	r, err := db.Query(
+		ctx,
+		`select id, `+imageColumns+`
+		from images
+		where id > $1 and sha256 is not null
+		order by id
+		limit $2`,
+		after,
+		limit,
+	)
+	if err != nil {
+		return
+	}
+	defer r.Close()
 
-				audio,
-				video,
+	for r.Next() {
+		var img StoredImage
+		err = scanImage(r, &img.ImageCommon, &img.ID)
+		if err != nil {
+			return
+		}
+		images = append(images, img)
+	}
+	err = r.Err()
+	return
+}
 
-				file_type,
-				thumb_type,
+// UpdateThumbnail updates the thumbnail description of an image record
+func UpdateThumbnail(
+	ctx context.Context,
+	tx pgx.Tx,
+	id uint64,
+	thumbType common.FileType,
+	width, height uint16,
+) (err error) {
+	_, err = tx.Exec(
+		ctx,
+		`update images
+		set thumb_type = $1,
+			thumb_width = $2,
+			thumb_height = $3
+		where id = $4`,
+		thumbType,
+		// Encoded as strings for compatibility with Postgres domains
+		strconv.FormatUint(uint64(width), 10),
+		strconv.FormatUint(uint64(height), 10),
+		id,
+	)
+	return
+}
 
-				width,
-				height,
-				thumb_width,
-				thumb_height,
+// InsertImageAlias records alternative hashes for an already allocated image.
+// Used for files modified during processing, so uploads of the original file
+// can still be deduplicated.
+func InsertImageAlias(
+	ctx context.Context,
+	tx pgx.Tx,
+	aliasSHA256 common.SHA256Hash,
+	aliasSHA1 common.SHA1Hash,
+	target common.SHA256Hash,
+) (err error) {
+	_, err = tx.Exec(
+		ctx,
+		`insert into image_aliases (sha256, sha1, image)
+		select $1, $2, id
+		from images
+		where sha256 = $3
+		on conflict (sha256) do nothing`,
+		aliasSHA256,
+		aliasSHA1,
+		target,
+	)
+	return
+}
 
-				size,
-				duration,
+// BackfillSHA256 hashes the source files of images stored before the migration
+// to SHA-256 content identifiers and renames their files accordingly.
+// Images that were uploaded again after the migration are merged into the newer
+// record. Images that fail to be migrated are logged and skipped.
+func BackfillSHA256(ctx context.Context) (err error) {
+	type legacyImage struct {
+		id                  uint64
+		sha1                common.SHA1Hash
+		fileType, thumbType common.FileType
+		subtitles           int
+	}
 
-				title,
-				artist
-			from images
-			where sha1 = $1
-			for update`,
-			id,
-		).
-		Scan(
-			&img.MD5,
+	var lastID uint64
+	for {
+		var batch []legacyImage
+		err = func() (err error) {
+			r, err := db.Query(
+				ctx,
+				`select id, sha1, file_type, thumb_type,
+					coalesce(array_length(subtitles, 1), 0)
+				from images
+				where sha256 is null and id > $1
+				order by id
+				limit 100`,
+				lastID,
+			)
+			if err != nil {
+				return
+			}
+			defer r.Close()
 
-			&img.Audio,
-			&img.Video,
+			for r.Next() {
+				var img legacyImage
+				err = r.Scan(
+					&img.id,
+					&img.sha1,
+					&img.fileType,
+					&img.thumbType,
+					&img.subtitles,
+				)
+				if err != nil {
+					return
+				}
+				batch = append(batch, img)
+			}
+			return r.Err()
+		}()
+		if err != nil || len(batch) == 0 {
+			return
+		}
 
-			&img.FileType,
-			&img.ThumbType,
+		for _, img := range batch {
+			lastID = img.id
 
-			&img.Width,
-			&img.Height,
-			&img.ThumbWidth,
-			&img.ThumbHeight,
+			var id common.SHA256Hash
+			id, err = hashLegacyImage(img.sha1, img.fileType, img.thumbType)
+			if err != nil {
+				log.Errorf("sha256 backfill: image %d: %s", img.id, err)
+				err = nil
+				continue
+			}
+			// Files are only renamed, if the record update succeeds, and moved
+			// back, if the commit fails
+			var renamed, merged bool
+			err = InTransaction(ctx, func(tx pgx.Tx) (err error) {
+				var dup uint64
+				err = tx.
+					QueryRow(
+						ctx,
+						`select id
+						from images
+						where sha256 = $1
+						for update`,
+						id,
+					).
+					Scan(&dup)
+				switch err {
+				case nil:
+					merged = true
+					return mergeLegacyImage(ctx, tx, img.id, dup)
+				case pgx.ErrNoRows:
+				default:
+					return
+				}
 
-			&img.Size,
-			&img.Duration,
+				_, err = tx.Exec(
+					ctx,
+					`update images
+					set sha256 = $1
+					where id = $2`,
+					id,
+					img.id,
+				)
+				if err != nil {
+					return
+				}
+				err = assets.MigrateLegacyFiles(
+					img.sha1,
+					id,
+					img.fileType,
+					img.thumbType,
+					img.subtitles,
+				)
+				renamed = err == nil
+				return
+			})
+			if err != nil {
+				if renamed {
+					revErr := assets.RevertLegacyFiles(
+						img.sha1,
+						id,
+						img.fileType,
+						img.thumbType,
+						img.subtitles,
+					)
+					if revErr != nil {
+						// Files are left in an inconsistent state and need
+						// manual intervention
+						return fmt.Errorf(
+							"sha256 backfill: image %d: %s: %w",
+							img.id,
+							err,
+							revErr,
+						)
+					}
+				}
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Errorf("sha256 backfill: image %d: %s", img.id, err)
+				err = nil
+				continue
+			}
+			if merged {
+				err = assets.DeleteLegacyFiles(
+					img.sha1,
+					img.fileType,
+					img.thumbType,
+				)
+				if err != nil {
+					log.Errorf("sha256 backfill: image %d: %s", img.id, err)
+					err = nil
+				}
+			}
+		}
+	}
+}
 
-			&img.Title,
-			&img.Artist,
+// Repoint all references to an image stored before the migration to SHA-256
+// content identifiers to a record of the same file uploaded after it and
+// delete the legacy record
+func mergeLegacyImage(ctx context.Context, tx pgx.Tx, legacy, dup uint64) (
+	err error,
+) {
+	for _, table := range [...]string{
+		"posts",
+		"post_attachments",
+		"pending_images",
+		"image_aliases",
+	} {
+		_, err = tx.Exec(
+			ctx,
+			fmt.Sprintf(`update %s set image = $1 where image = $2`, table),
+			dup,
+			legacy,
 		)
+		if err != nil {
+			return
+		}
+	}
+	_, err = tx.Exec(ctx, `delete from images where id = $1`, legacy)
+	return
+}
+
+// Compute the SHA-256 hash of an image source file stored under its SHA1 hash
+func hashLegacyImage(
+	SHA1 common.SHA1Hash,
+	fileType, thumbType common.FileType,
+) (
+	id common.SHA256Hash,
+	err error,
+) {
+	f, err := os.Open(assets.GetLegacyFilePaths(SHA1, fileType, thumbType)[0])
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
 	if err != nil {
 		return
 	}
-	img.SHA1 = id
+	copy(id[:], h.Sum(nil))
 	return
 }
@@ -3,9 +3,12 @@ package db
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/bakape/shamichan/imager/assets"
 	"github.com/bakape/shamichan/imager/common"
@@ -33,7 +36,8 @@ func prepareSampleImage(t *testing.T) (
 ) {
 	t.Helper()
 
-	clearTables(t, "images")
+	// Posts reference images through their attachments
+	clearTables(t, "threads", "images")
 	setupImageDirs(t)
 
 	img = common.ImageCommon{
@@ -44,9 +48,10 @@ func prepareSampleImage(t *testing.T) (
 		Size:        1 << 20,
 	}
 	copy(img.SHA1[:], test.GenBuf(20))
+	copy(img.SHA256[:], test.GenBuf(32))
 	copy(img.MD5[:], test.GenBuf(16))
 
-	assertNoImage(t, img.SHA1)
+	assertNoImage(t, img.SHA256)
 
 	for i, name := range [...]string{"sample", "thumb"} {
 		files[i] = test.OpenSample(t, name+".jpg")
@@ -66,7 +71,7 @@ func prepareSampleImage(t *testing.T) (
 	return
 }
 
-func assertNoImage(t *testing.T, id common.SHA1Hash) {
+func assertNoImage(t *testing.T, id common.SHA256Hash) {
 	t.Helper()
 
 	err := InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
@@ -82,7 +87,7 @@ func TestAllocateImage(t *testing.T) {
 	// Assert files
 	t.Run("files", func(t *testing.T) {
 		for i, path := range assets.GetFilePaths(
-			std.SHA1,
+			std.SHA256,
 			common.JPEG,
 			common.JPEG,
 		) {
@@ -109,7 +114,19 @@ func TestAllocateImage(t *testing.T) {
 	t.Run("db row", func(t *testing.T) {
 		var img common.ImageCommon
 		err := InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
-			img, err = GetImage(context.Background(), tx, std.SHA1)
+			img, err = GetImage(context.Background(), tx, std.SHA256)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, img, std)
+	})
+
+	t.Run("legacy SHA1 lookup", func(t *testing.T) {
+		var img common.ImageCommon
+		err := InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
+			img, err = GetImageBySHA1(context.Background(), tx, std.SHA1)
 			return
 		})
 		if err != nil {
@@ -218,3 +235,297 @@ func TestAllocateImage(t *testing.T) {
 // 	}
 // 	assertPost(true)
 // }
+
+func TestImageAlias(t *testing.T) {
+	std, _ := prepareSampleImage(t)
+
+	var (
+		alias     common.SHA256Hash
+		aliasSHA1 common.SHA1Hash
+	)
+	copy(alias[:], test.GenBuf(32))
+	copy(aliasSHA1[:], test.GenBuf(20))
+	assertNoImage(t, alias)
+
+	err := InTransaction(context.Background(), func(tx pgx.Tx) error {
+		return InsertImageAlias(
+			context.Background(),
+			tx,
+			alias,
+			aliasSHA1,
+			std.SHA256,
+		)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var img common.ImageCommon
+	err = InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
+		img, err = GetImage(context.Background(), tx, alias)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, img, std)
+
+	err = InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
+		img, err = GetImageBySHA1(context.Background(), tx, aliasSHA1)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, img, std)
+}
+
+func TestBackfillSHA256(t *testing.T) {
+	std, files := prepareSampleImage(t)
+
+	// Simulate an image stored before the migration to SHA-256
+	assertExec(
+		t,
+		`update images set sha256 = null where sha256 = $1`,
+		std.SHA256,
+	)
+	paths := assets.GetFilePaths(std.SHA256, std.FileType, std.ThumbType)
+	legacy := assets.GetLegacyFilePaths(std.SHA1, std.FileType, std.ThumbType)
+	for i := range paths {
+		err := os.Rename(paths[i], legacy[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := BackfillSHA256(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = files[0].Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(std.SHA256[:], h.Sum(nil))
+
+	var img common.ImageCommon
+	err = InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
+		img, err = GetImageBySHA1(context.Background(), tx, std.SHA1)
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, img, std)
+
+	for _, path := range assets.GetFilePaths(
+		std.SHA256,
+		std.FileType,
+		std.ThumbType,
+	) {
+		_, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestBackfillSHA256Duplicate(t *testing.T) {
+	std, files := prepareSampleImage(t)
+
+	// Simulate an image stored before the migration to SHA-256, that was
+	// uploaded again after it
+	assertExec(
+		t,
+		`update images set sha256 = null where sha256 = $1`,
+		std.SHA256,
+	)
+	paths := assets.GetFilePaths(std.SHA256, std.FileType, std.ThumbType)
+	legacy := assets.GetLegacyFilePaths(std.SHA1, std.FileType, std.ThumbType)
+	for i := range paths {
+		err := os.Rename(paths[i], legacy[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := files[0].Seek(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(std.SHA256[:], h.Sum(nil))
+	err = InTransaction(context.Background(), func(tx pgx.Tx) error {
+		return AllocateImage(context.Background(), tx, std, files[0], files[1])
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = BackfillSHA256(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	err = db.
+		QueryRow(
+			context.Background(),
+			`select count(*) from images where sha1 = $1`,
+			std.SHA1,
+		).
+		Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, count, 1)
+
+	for _, path := range legacy {
+		_, err := os.Stat(path)
+		if !os.IsNotExist(err) {
+			t.Fatalf("legacy file not deleted: %s", path)
+		}
+	}
+	for _, path := range assets.GetFilePaths(
+		std.SHA256,
+		std.FileType,
+		std.ThumbType,
+	) {
+		_, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInsertImageAttachments(t *testing.T) {
+	img, _ := prepareSampleImage(t)
+	pubKey, _ := insertSamplePubKey(t)
+	post, err := InsertSampleThread(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	insert := func() error {
+		return InTransaction(context.Background(), func(tx pgx.Tx) error {
+			thread, err := InsertImage(
+				context.Background(),
+				tx,
+				post,
+				pubKey,
+				img.SHA256,
+				"sample",
+				false,
+				2,
+			)
+			if err == nil {
+				test.AssertEquals(t, thread, post)
+			}
+			return err
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := insert(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test.AssertEquals(t, insert(), ErrTooManyAttachments)
+
+	var positions []int
+	err = db.
+		QueryRow(
+			context.Background(),
+			`select array_agg(position order by position)
+			from post_attachments
+			where post = $1`,
+			post,
+		).
+		Scan(&positions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, positions, []int{0, 1})
+
+	var hasImage bool
+	err = db.
+		QueryRow(
+			context.Background(),
+			`select image is not null from posts where id = $1`,
+			post,
+		).
+		Scan(&hasImage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, hasImage, true)
+
+	// Every attachment bumps the thread
+	bumpedOn := func() (at time.Time, err error) {
+		err = db.
+			QueryRow(
+				context.Background(),
+				`select bumped_on from threads where id = $1`,
+				post,
+			).
+			Scan(&at)
+		return
+	}
+	before, err := bumpedOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(
+		context.Background(),
+		`delete from post_attachments where post = $1 and position = 1`,
+		post,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := insert(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := bumpedOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !after.After(before) {
+		t.Fatalf("thread not bumped: %s <= %s", after, before)
+	}
+}
+
+func TestInsertImageNotFound(t *testing.T) {
+	pubKey, _ := insertSamplePubKey(t)
+	post, err := InsertSampleThread(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id common.SHA256Hash
+	copy(id[:], test.GenBuf(32))
+	err = InTransaction(context.Background(), func(tx pgx.Tx) error {
+		_, err := InsertImage(
+			context.Background(),
+			tx,
+			post,
+			pubKey,
+			id,
+			"sample",
+			false,
+			2,
+		)
+		return err
+	})
+	test.AssertEquals(t, err, ErrImageNotFound)
+}
@@ -0,0 +1,62 @@
+package db
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// Progress of resumable background jobs is stored in the main table under the
+// job's name with this prefix
+const jobKeyPrefix = "job_progress:"
+
+// GetJobProgress returns the ID of the last record processed by a resumable
+// background job or 0, if the job has no saved progress
+func GetJobProgress(ctx context.Context, job string) (
+	lastID uint64,
+	err error,
+) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select (val->>'last_id')::bigint
+			from main
+			where key = $1`,
+			jobKeyPrefix+job,
+		).
+		Scan(&lastID)
+	if err == pgx.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SetJobProgress saves the ID of the last record processed by a resumable
+// background job
+func SetJobProgress(
+	ctx context.Context,
+	tx pgx.Tx,
+	job string,
+	lastID uint64,
+) (err error) {
+	_, err = tx.Exec(
+		ctx,
+		`insert into main (key, val)
+		values ($1, jsonb_build_object('last_id', $2::bigint))
+		on conflict (key) do update
+			set val = excluded.val`,
+		jobKeyPrefix+job,
+		lastID,
+	)
+	return
+}
+
+// ClearJobProgress deletes any saved progress of a resumable background job
+func ClearJobProgress(ctx context.Context, job string) (err error) {
+	_, err = db.Exec(
+		ctx,
+		`delete from main where key = $1`,
+		jobKeyPrefix+job,
+	)
+	return
+}
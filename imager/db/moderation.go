@@ -0,0 +1,268 @@
+package db
+
+import (
+	"context"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/jackc/pgx/v4"
+)
+
+// Offset attachments are temporarily moved by, when closing gaps in their
+// positions. Must be larger than the maximum number of attachments.
+const attachmentShift = 1 << 14
+
+// GetStaffLevel returns the moderation level of pubKey. Keys of non-staff
+// have common.NotStaff.
+func GetStaffLevel(ctx context.Context, pubKey uint64) (
+	level common.ModerationLevel,
+	err error,
+) {
+	err = db.
+		QueryRow(ctx, `select level from staff where public_key = $1`, pubKey).
+		Scan(&level)
+	if err == pgx.ErrNoRows {
+		err = nil
+	}
+	return
+}
+
+// SetStaffLevel sets the moderation level of pubKey. Setting common.NotStaff
+// removes pubKey from staff.
+func SetStaffLevel(
+	ctx context.Context,
+	pubKey uint64,
+	level common.ModerationLevel,
+) (err error) {
+	if level == common.NotStaff {
+		_, err = db.Exec(ctx, `delete from staff where public_key = $1`, pubKey)
+		return
+	}
+	_, err = db.Exec(
+		ctx,
+		`insert into staff (public_key, level)
+		values ($1, $2)
+		on conflict (public_key) do update
+			set level = excluded.level`,
+		pubKey,
+		level,
+	)
+	return
+}
+
+// LogModeration records an action performed by the staff member with pubKey.
+// A zero post leaves the entry not associated with any post.
+func LogModeration(
+	ctx context.Context,
+	tx pgx.Tx,
+	action common.ModerationAction,
+	post, pubKey uint64,
+	data string,
+) (err error) {
+	var p *uint64
+	if post != 0 {
+		p = &post
+	}
+	_, err = tx.Exec(
+		ctx,
+		`insert into moderation_log (type, post, public_key, data)
+		values ($1, $2, $3, $4)`,
+		action,
+		p,
+		pubKey,
+		data,
+	)
+	return
+}
+
+// SpoilerImage spoilers the file attached to post at position and returns its
+// SHA-256 hash. Returns pgx.ErrNoRows, if no such attachment exists.
+func SpoilerImage(
+	ctx context.Context,
+	tx pgx.Tx,
+	post uint64,
+	position uint,
+) (img common.SHA256Hash, err error) {
+	err = tx.
+		QueryRow(
+			ctx,
+			`update post_attachments a
+			set spoilered = true
+			from images i
+			where a.post = $1 and a.position = $2 and i.id = a.image
+			returning i.sha256`,
+			post,
+			position,
+		).
+		Scan(&img)
+	if err != nil || position != 0 {
+		return
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`update posts set image_spoilered = true where id = $1`,
+		post,
+	)
+	return
+}
+
+// DeleteImage removes the file attached to post at position and returns its
+// SHA-256 hash. The following attachments are moved up by one position.
+// Returns pgx.ErrNoRows, if no such attachment exists.
+func DeleteImage(
+	ctx context.Context,
+	tx pgx.Tx,
+	post uint64,
+	position uint,
+) (img common.SHA256Hash, err error) {
+	err = tx.
+		QueryRow(
+			ctx,
+			`delete from post_attachments a
+			using images i
+			where a.post = $1 and a.position = $2 and i.id = a.image
+			returning i.sha256`,
+			post,
+			position,
+		).
+		Scan(&img)
+	if err != nil {
+		return
+	}
+	err = removeAttachmentGap(ctx, tx, post, position)
+	return
+}
+
+// Move attachments of post after a removed attachment at position up by one
+// position and update the legacy single image columns, if needed
+func removeAttachmentGap(
+	ctx context.Context,
+	tx pgx.Tx,
+	post uint64,
+	position uint,
+) (err error) {
+	// Rows are updated in no particular order. Move them out of the way first
+	// to not conflict with the primary key.
+	_, err = tx.Exec(
+		ctx,
+		`update post_attachments
+		set position = position + $3
+		where post = $1 and position > $2`,
+		post,
+		position,
+		attachmentShift,
+	)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(
+		ctx,
+		`update post_attachments
+		set position = position - $2 - 1
+		where post = $1 and position >= $2`,
+		post,
+		attachmentShift,
+	)
+	if err != nil || position != 0 {
+		return
+	}
+
+	// Keep the first attachment in the legacy single image columns
+	_, err = tx.Exec(
+		ctx,
+		`update posts p
+		set image = a.image,
+			image_name = coalesce(a.name, ''),
+			image_spoilered = coalesce(a.spoilered, false)
+		from posts q
+		left join post_attachments a on a.post = q.id and a.position = 0
+		where p.id = q.id and q.id = $1`,
+		post,
+	)
+	return
+}
+
+// PurgeImage removes an image from all posts it is attached to and deletes its
+// record. Returns the deleted record for removing its files from storage.
+// Returns pgx.ErrNoRows, if no such image exists.
+func PurgeImage(ctx context.Context, tx pgx.Tx, id common.SHA256Hash) (
+	img common.ImageCommon,
+	err error,
+) {
+	var imageID uint64
+	err = scanImage(
+		tx.QueryRow(
+			ctx,
+			`select id, `+imageColumns+`
+			from images
+			where sha256 = $1
+			for update`,
+			id,
+		),
+		&img,
+		&imageID,
+	)
+	if err != nil {
+		return
+	}
+
+	type attachment struct {
+		post     uint64
+		position uint
+	}
+	var attachments []attachment
+	r, err := tx.Query(
+		ctx,
+		// Later attachments first, so removing gaps does not move the
+		// remaining ones
+		`select post, position
+		from post_attachments
+		where image = $1
+		order by post, position desc`,
+		imageID,
+	)
+	if err != nil {
+		return
+	}
+	for r.Next() {
+		var a attachment
+		err = r.Scan(&a.post, &a.position)
+		if err != nil {
+			r.Close()
+			return
+		}
+		attachments = append(attachments, a)
+	}
+	r.Close()
+	err = r.Err()
+	if err != nil {
+		return
+	}
+
+	for _, a := range attachments {
+		_, err = tx.Exec(
+			ctx,
+			`delete from post_attachments where post = $1 and position = $2`,
+			a.post,
+			a.position,
+		)
+		if err != nil {
+			return
+		}
+		err = removeAttachmentGap(ctx, tx, a.post, a.position)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = tx.Exec(
+		ctx,
+		`delete from pending_images where image = $1`,
+		imageID,
+	)
+	if err != nil {
+		return
+	}
+	_, err = tx.Exec(ctx, `delete from images where id = $1`, imageID)
+	return
+}
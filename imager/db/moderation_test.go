@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/jackc/pgx/v4"
+)
+
+func TestStaffLevel(t *testing.T) {
+	ctx := context.Background()
+	pubKey, _ := insertSamplePubKey(t)
+
+	assertLevel := func(t *testing.T, std common.ModerationLevel) {
+		t.Helper()
+
+		level, err := GetStaffLevel(ctx, pubKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, level, std)
+	}
+
+	assertLevel(t, common.NotStaff)
+	for _, l := range [...]common.ModerationLevel{
+		common.Janitor,
+		common.Admin,
+		common.NotStaff,
+	} {
+		err := SetStaffLevel(ctx, pubKey, l)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertLevel(t, l)
+	}
+}
+
+func TestModerateImages(t *testing.T) {
+	ctx := context.Background()
+	img, _ := prepareSampleImage(t)
+	pubKey, _ := insertSamplePubKey(t)
+	post, err := InsertSampleThread(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		for _, name := range [...]string{"a", "b", "c"} {
+			_, err = InsertImage(ctx, tx, post, pubKey, img.SHA256, name,
+				false, 3)
+			if err != nil {
+				return
+			}
+		}
+		return
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type attachment struct {
+		Name      string
+		Spoilered bool
+	}
+	assertAttachments := func(t *testing.T, std ...attachment) {
+		t.Helper()
+
+		r, err := db.Query(
+			ctx,
+			`select name, spoilered
+			from post_attachments
+			where post = $1
+			order by position`,
+			post,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+
+		var res []attachment
+		for r.Next() {
+			var a attachment
+			err = r.Scan(&a.Name, &a.Spoilered)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, a)
+		}
+		if err := r.Err(); err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, res, std)
+
+		var legacy attachment
+		err = db.
+			QueryRow(
+				ctx,
+				`select image_name, image_spoilered from posts where id = $1`,
+				post,
+			).
+			Scan(&legacy.Name, &legacy.Spoilered)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(std) == 0 {
+			std = append(std, attachment{})
+		}
+		test.AssertEquals(t, legacy, std[0])
+	}
+
+	moderate := func(
+		t *testing.T,
+		fn func(context.Context, pgx.Tx, uint64, uint) (
+			common.SHA256Hash,
+			error,
+		),
+		position uint,
+	) error {
+		t.Helper()
+
+		return InTransaction(ctx, func(tx pgx.Tx) (err error) {
+			id, err := fn(ctx, tx, post, position)
+			if err == nil {
+				test.AssertEquals(t, id, img.SHA256)
+			}
+			return
+		})
+	}
+
+	t.Run("spoiler", func(t *testing.T) {
+		for _, pos := range [...]uint{0, 2} {
+			err := moderate(t, SpoilerImage, pos)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertAttachments(
+			t,
+			attachment{"a", true},
+			attachment{"b", false},
+			attachment{"c", true},
+		)
+
+		err := moderate(t, SpoilerImage, 3)
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		err := moderate(t, DeleteImage, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAttachments(
+			t,
+			attachment{"b", false},
+			attachment{"c", true},
+		)
+
+		err = moderate(t, DeleteImage, 2)
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+	})
+
+	t.Run("log", func(t *testing.T) {
+		err := InTransaction(ctx, func(tx pgx.Tx) error {
+			return LogModeration(ctx, tx, common.DeleteImage, post, pubKey,
+				img.SHA256.String())
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var (
+			action common.ModerationAction
+			data   string
+		)
+		err = db.
+			QueryRow(
+				ctx,
+				`select type, data
+				from moderation_log
+				where post = $1 and public_key = $2`,
+				post,
+				pubKey,
+			).
+			Scan(&action, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, action, common.DeleteImage)
+		test.AssertEquals(t, data, img.SHA256.String())
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		err := InTransaction(ctx, func(tx pgx.Tx) (err error) {
+			purged, err := PurgeImage(ctx, tx, img.SHA256)
+			if err != nil {
+				return
+			}
+			test.AssertEquals(t, purged.SHA256, img.SHA256)
+			return
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertAttachments(t)
+		assertNoImage(t, img.SHA256)
+
+		err = InTransaction(ctx, func(tx pgx.Tx) (err error) {
+			_, err = PurgeImage(ctx, tx, img.SHA256)
+			return
+		})
+		test.AssertEquals(t, err, pgx.ErrNoRows)
+	})
+}
@@ -0,0 +1,29 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// UseNonce records the nonce of a signed request as used until expires.
+// Returns false, if the nonce was already used and has not expired yet.
+func UseNonce(ctx context.Context, nonce [32]byte, expires time.Time) (
+	fresh bool,
+	err error,
+) {
+	tag, err := db.Exec(
+		ctx,
+		`insert into used_nonces (nonce, expires)
+		values ($1, $2)
+		on conflict (nonce) do update
+			set expires = excluded.expires
+			where used_nonces.expires < now()`,
+		nonce[:],
+		expires,
+	)
+	if err != nil {
+		return
+	}
+	fresh = tag.RowsAffected() == 1
+	return
+}
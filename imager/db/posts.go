@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+)
+
+// Return the tags of the thread a post belongs to
+func GetPostTags(ctx context.Context, post uint64) (tags []string, err error) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select t.tags
+			from posts p
+			join threads t on t.id = p.thread
+			where p.id = $1`,
+			post,
+		).
+		Scan(&tags)
+	return
+}
+
+// CanInsertImage returns, if pubKey has an open post to insert images into
+func CanInsertImage(ctx context.Context, pubKey uint64) (can bool, err error) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select exists (
+				select
+				from posts
+				where open and public_key = $1
+			)`,
+			pubKey,
+		).
+		Scan(&can)
+	return
+}
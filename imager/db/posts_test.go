@@ -0,0 +1,36 @@
+package db
+
+import (
+	"context"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestCanInsertImage(t *testing.T) {
+	ctx := context.Background()
+	pubKey, _ := insertSamplePubKey(t)
+
+	can, err := CanInsertImage(ctx, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, can, false)
+
+	post, err := InsertSampleThread(pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	can, err = CanInsertImage(ctx, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, can, true)
+
+	assertExec(t, `update posts set open = false where id = $1`, post)
+	can, err = CanInsertImage(ctx, pubKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, can, false)
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// CountRecentUploads returns the number of files attached by pubKey to posts
+// created within window
+func CountRecentUploads(
+	ctx context.Context,
+	pubKey uint64,
+	window time.Duration,
+) (n uint, err error) {
+	err = db.
+		QueryRow(
+			ctx,
+			`select count(*)
+			from post_attachments a
+			join posts p on p.id = a.post
+			where p.public_key = $1 and p.created_on > now() - $2::interval`,
+			pubKey,
+			window,
+		).
+		Scan(&n)
+	return
+}
+
+// InsertPoWChallenge records a proof-of-work challenge issued to pubKey
+func InsertPoWChallenge(
+	ctx context.Context,
+	challenge [32]byte,
+	pubKey uint64,
+	difficulty uint8,
+	expires time.Time,
+) (err error) {
+	_, err = db.Exec(
+		ctx,
+		`insert into pow_challenges (challenge, public_key, difficulty, expires)
+		values ($1, $2, $3, $4)`,
+		challenge[:],
+		pubKey,
+		difficulty,
+		expires,
+	)
+	return
+}
+
+// UsePoWChallenge deletes an unexpired proof-of-work challenge issued to
+// pubKey and returns its difficulty. Returns pgx.ErrNoRows, if no such
+// challenge exists.
+func UsePoWChallenge(ctx context.Context, challenge [32]byte, pubKey uint64) (
+	difficulty uint8,
+	err error,
+) {
+	err = db.
+		QueryRow(
+			ctx,
+			`delete from pow_challenges
+			where challenge = $1 and public_key = $2 and expires > now()
+			returning difficulty`,
+			challenge[:],
+			pubKey,
+		).
+		Scan(&difficulty)
+	return
+}
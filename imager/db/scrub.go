@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/jackc/pgx/v4"
+)
+
+// Problems with stored files found by the integrity scrubber
+const (
+	ScrubMissing      = "missing"
+	ScrubCorrupt      = "corrupt"
+	ScrubSizeMismatch = "size_mismatch"
+)
+
+// Problem with a stored file found by the integrity scrubber
+type ScrubResult struct {
+	Image       uint64            `json:"image"`
+	SHA256      common.SHA256Hash `json:"sha256"`
+	Path        string            `json:"path"`
+	Problem     string            `json:"problem"`
+	Quarantined bool              `json:"quarantined"`
+	DetectedOn  time.Time         `json:"detected_on"`
+}
+
+// SetScrubResults replaces the scrubbing results of an image
+func SetScrubResults(
+	ctx context.Context,
+	tx pgx.Tx,
+	image uint64,
+	results []ScrubResult,
+) (err error) {
+	_, err = tx.Exec(
+		ctx,
+		`delete from scrub_results
+		where image = $1`,
+		image,
+	)
+	if err != nil {
+		return
+	}
+	for _, r := range results {
+		_, err = tx.Exec(
+			ctx,
+			`insert into scrub_results (image, path, problem, quarantined)
+			values ($1, $2, $3, $4)`,
+			image,
+			r.Path,
+			r.Problem,
+			r.Quarantined,
+		)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetScrubResults returns up to limit of the most recently detected problems
+// with stored files
+func GetScrubResults(ctx context.Context, limit int) (
+	results []ScrubResult,
+	err error,
+) {
+	r, err := db.Query(
+		ctx,
+		`select r.image, i.sha256, r.path, r.problem, r.quarantined,
+			r.detected_on
+		from scrub_results r
+		join images i on i.id = r.image
+		order by r.detected_on desc, r.image, r.path
+		limit $1`,
+		limit,
+	)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var res ScrubResult
+		err = r.Scan(
+			&res.Image,
+			&res.SHA256,
+			&res.Path,
+			&res.Problem,
+			&res.Quarantined,
+			&res.DetectedOn,
+		)
+		if err != nil {
+			return
+		}
+		results = append(results, res)
+	}
+	err = r.Err()
+	return
+}
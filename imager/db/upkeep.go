@@ -1,5 +1,47 @@
 package db
 
+import (
+	"context"
+	"time"
+
+	"github.com/go-playground/log"
+)
+
 // TODO: periodically delete images that do not have a DB record.
 // First build a list of all images on the FS and then read all exiting image
 // records from the DB.
+
+// RunCleanupTasks runs database clean up tasks at regular intervals until ctx
+// is canceled
+func RunCleanupTasks(ctx context.Context) {
+	sec := time.NewTicker(time.Second)
+	defer sec.Stop()
+	min := time.NewTicker(time.Minute)
+	defer min.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sec.C:
+			logError("spam score buffer flush", syncSpamScores)
+		case <-min.C:
+			logError("expired row cleanup", func() error {
+				return deleteExpired(ctx)
+			})
+		}
+	}
+}
+
+// Delete expired rows of all tables inheriting from expiries
+func deleteExpired(ctx context.Context) (err error) {
+	_, err = db.Exec(ctx, `delete from expiries where expires < now()`)
+	return
+}
+
+// Log error of a periodic task, if any
+func logError(prefix string, fn func() error) {
+	if err := fn(); err != nil {
+		log.Errorf("%s: %s", prefix, err)
+	}
+}
@@ -0,0 +1,266 @@
+package imager
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// Maximum size of an MP4 index to load into memory for remuxing
+const maxMoovSize = 64 << 20
+
+// File can not or need not be remuxed
+var errCantRemux = errors.New("can not remux MP4 file")
+
+// Top-level ISOBMFF box
+type mp4Box struct {
+	typ          string
+	offset, size int64
+}
+
+// Remux an MP4 or MOV file, that has its index ("moov" box) located after the
+// media data, to have the index first. This enables browsers to start playback
+// before the entire file has been downloaded. Media data is not modified.
+//
+// Returns a temporary file with the remuxed contents or nil, if the file does
+// not need or can not be remuxed. The caller is responsible for closing and
+// removing the returned file.
+func faststartMP4(rs io.ReadSeeker) (out *os.File, err error) {
+	boxes, err := readMP4Boxes(rs)
+	switch err {
+	case nil:
+	case errCantRemux, io.ErrUnexpectedEOF:
+		return nil, nil
+	default:
+		return
+	}
+
+	var (
+		moov      *mp4Box
+		firstMdat = -1
+	)
+	for i := range boxes {
+		switch boxes[i].typ {
+		case "moov":
+			if moov == nil {
+				moov = &boxes[i]
+			}
+		case "mdat":
+			if firstMdat == -1 {
+				firstMdat = i
+			}
+		}
+	}
+	if moov == nil ||
+		firstMdat == -1 ||
+		moov.offset < boxes[firstMdat].offset ||
+		moov.size > maxMoovSize {
+		return nil, nil
+	}
+
+	index := make([]byte, int(moov.size))
+	_, err = rs.Seek(moov.offset, io.SeekStart)
+	if err != nil {
+		return
+	}
+	_, err = io.ReadFull(rs, index)
+	if err != nil {
+		return
+	}
+	head := 8
+	switch binary.BigEndian.Uint32(index) {
+	case 0:
+		// A size of 0 means the box extends to the end of the file, which will
+		// no longer be true after it is moved. moov.size is bounded by
+		// maxMoovSize, so it always fits the 32 bit field.
+		binary.BigEndian.PutUint32(index, uint32(moov.size))
+	case 1:
+		head = 16
+	}
+	err = patchChunkOffsets(
+		index[head:],
+		boxes[firstMdat].offset,
+		moov.offset,
+		moov.size,
+	)
+	switch err {
+	case nil:
+	case errCantRemux:
+		return nil, nil
+	default:
+		return
+	}
+
+	out, err = ioutil.TempFile("", "shamichan_imager_")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+			out = nil
+		}
+	}()
+
+	copyBox := func(b mp4Box) (err error) {
+		_, err = rs.Seek(b.offset, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.CopyN(out, rs, b.size)
+		return
+	}
+
+	for _, b := range boxes[:firstMdat] {
+		err = copyBox(b)
+		if err != nil {
+			return
+		}
+	}
+	_, err = out.Write(index)
+	if err != nil {
+		return
+	}
+	for _, b := range boxes[firstMdat:] {
+		if b.offset == moov.offset {
+			continue
+		}
+		err = copyBox(b)
+		if err != nil {
+			return
+		}
+	}
+
+	_, err = out.Seek(0, io.SeekStart)
+	return
+}
+
+// Read the headers of all top-level boxes in an ISOBMFF file
+func readMP4Boxes(rs io.ReadSeeker) (boxes []mp4Box, err error) {
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+
+	var (
+		off  int64
+		head [16]byte
+	)
+	for off < size {
+		_, err = rs.Seek(off, io.SeekStart)
+		if err != nil {
+			return
+		}
+		_, err = io.ReadFull(rs, head[:8])
+		if err != nil {
+			return
+		}
+
+		b := mp4Box{
+			typ:    string(head[4:8]),
+			offset: off,
+			size:   int64(binary.BigEndian.Uint32(head[:4])),
+		}
+		headSize := int64(8)
+		switch b.size {
+		case 0:
+			// Box extends to the end of file
+			b.size = size - off
+		case 1:
+			_, err = io.ReadFull(rs, head[8:])
+			if err != nil {
+				return
+			}
+			b.size = int64(binary.BigEndian.Uint64(head[8:]))
+			headSize = 16
+		}
+		if b.size < headSize || b.size > size-off {
+			return nil, errCantRemux
+		}
+
+		boxes = append(boxes, b)
+		off += b.size
+	}
+	return
+}
+
+// Recursively patch all chunk offset tables in the children of the "moov" box,
+// that point to data located between insertAt and the box, to account for the
+// box being moved to insertAt.
+func patchChunkOffsets(buf []byte, insertAt, moovOffset, moovSize int64,
+) error {
+	for len(buf) != 0 {
+		if len(buf) < 8 {
+			return errCantRemux
+		}
+		size := uint64(binary.BigEndian.Uint32(buf))
+		head := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(buf))
+		case 1:
+			if len(buf) < 16 {
+				return errCantRemux
+			}
+			size = binary.BigEndian.Uint64(buf[8:])
+			head = 16
+		}
+		if size < head || size > uint64(len(buf)) {
+			return errCantRemux
+		}
+		body := buf[head:size]
+
+		switch string(buf[4:8]) {
+		case "trak", "mdia", "minf", "stbl":
+			err := patchChunkOffsets(body, insertAt, moovOffset, moovSize)
+			if err != nil {
+				return err
+			}
+		case "stco", "co64":
+			// Skip version and flags
+			if len(body) < 8 {
+				return errCantRemux
+			}
+			entrySize := 4
+			if string(buf[4:8]) == "co64" {
+				entrySize = 8
+			}
+			count := int(binary.BigEndian.Uint32(body[4:]))
+			entries := body[8:]
+			if count > len(entries)/entrySize {
+				return errCantRemux
+			}
+			for i := 0; i < count; i++ {
+				e := entries[i*entrySize:]
+				var off uint64
+				if entrySize == 4 {
+					off = uint64(binary.BigEndian.Uint32(e))
+				} else {
+					off = binary.BigEndian.Uint64(e)
+				}
+				if off < uint64(insertAt) || off >= uint64(moovOffset) {
+					continue
+				}
+				off += uint64(moovSize)
+				if entrySize == 4 {
+					if off > math.MaxUint32 {
+						return errCantRemux
+					}
+					binary.BigEndian.PutUint32(e, uint32(off))
+				} else {
+					binary.BigEndian.PutUint64(e, off)
+				}
+			}
+		case "cmov":
+			// Compressed indexes are not supported
+			return errCantRemux
+		}
+
+		buf = buf[size:]
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package imager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/test"
+)
+
+// Encode an ISOBMFF box
+func mp4BoxBytes(typ string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	buf := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(8+len(body)))
+	copy(buf[4:], typ)
+	return append(buf, body...)
+}
+
+// Encode a chunk offset table box with a single entry
+func stcoBytes(off uint32) []byte {
+	var body [12]byte
+	binary.BigEndian.PutUint32(body[4:], 1)
+	binary.BigEndian.PutUint32(body[8:], off)
+	return mp4BoxBytes("stco", body[:])
+}
+
+func TestFaststartMP4(t *testing.T) {
+	t.Parallel()
+
+	payload := []byte("media data goes here")
+	ftyp := mp4BoxBytes("ftyp", []byte("isom\x00\x00\x02\x00isommp41"))
+	mdat := mp4BoxBytes("mdat", payload)
+	moov := func(off uint32) []byte {
+		return mp4BoxBytes(
+			"moov",
+			mp4BoxBytes(
+				"trak",
+				mp4BoxBytes(
+					"mdia",
+					mp4BoxBytes(
+						"minf",
+						mp4BoxBytes("stbl", stcoBytes(off)),
+					),
+				),
+			),
+		)
+	}
+
+	t.Run("moov at end", func(t *testing.T) {
+		t.Parallel()
+
+		off := uint32(len(ftyp) + 8)
+		src := bytes.Join([][]byte{ftyp, mdat, moov(off)}, nil)
+
+		out, err := faststartMP4(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out == nil {
+			t.Fatal("file not remuxed")
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+
+		res, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newOff := off + uint32(len(moov(0)))
+		test.AssertBufferEquals(
+			t,
+			res,
+			bytes.Join([][]byte{ftyp, moov(newOff), mdat}, nil),
+		)
+		test.AssertBufferEquals(
+			t,
+			res[newOff:int(newOff)+len(payload)],
+			payload,
+		)
+	})
+
+	t.Run("moov extending to end of file", func(t *testing.T) {
+		t.Parallel()
+
+		off := uint32(len(ftyp) + 8)
+		tail := moov(off)
+		binary.BigEndian.PutUint32(tail, 0)
+		src := bytes.Join([][]byte{ftyp, mdat, tail}, nil)
+
+		out, err := faststartMP4(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out == nil {
+			t.Fatal("file not remuxed")
+		}
+		defer os.Remove(out.Name())
+		defer out.Close()
+
+		res, err := ioutil.ReadAll(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		newOff := off + uint32(len(tail))
+		test.AssertBufferEquals(
+			t,
+			res,
+			bytes.Join([][]byte{ftyp, moov(newOff), mdat}, nil),
+		)
+	})
+
+	t.Run("moov at start", func(t *testing.T) {
+		t.Parallel()
+
+		src := bytes.Join([][]byte{ftyp, moov(0), mdat}, nil)
+		out, err := faststartMP4(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			out.Close()
+			os.Remove(out.Name())
+			t.Fatal("file remuxed")
+		}
+	})
+
+	t.Run("corrupt box", func(t *testing.T) {
+		t.Parallel()
+
+		src := bytes.Join([][]byte{ftyp, mdat, moov(0)}, nil)
+		binary.BigEndian.PutUint32(src[len(ftyp):], 1<<30)
+		out, err := faststartMP4(bytes.NewReader(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != nil {
+			out.Close()
+			os.Remove(out.Name())
+			t.Fatal("file remuxed")
+		}
+	})
+}
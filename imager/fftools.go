@@ -0,0 +1,55 @@
+package imager
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/go-playground/log"
+)
+
+// Availability of the FFmpeg command line tools. Some optional processing
+// steps require these in addition to the FFmpeg libraries.
+var ffTools = lookupFFTools()
+
+// Frame rate limits were enabled by a configuration change after startup and
+// can not be enforced
+var errNoFFprobe = common.StatusError{
+	Err:  errors.New("frame rate limit requires the ffprobe executable"),
+	Code: 500,
+}
+
+type ffToolSet struct {
+	ffprobe, ffmpeg bool
+}
+
+func lookupFFTools() (t ffToolSet) {
+	_, err := exec.LookPath("ffprobe")
+	t.ffprobe = err == nil
+	_, err = exec.LookPath("ffmpeg")
+	t.ffmpeg = err == nil
+	return
+}
+
+// Log the features disabled by missing FFmpeg command line tools
+func logMissingFFTools() {
+	if !ffTools.ffprobe || !ffTools.ffmpeg {
+		log.Warn(
+			"ffprobe or ffmpeg executable not found: " +
+				"subtitles will not be extracted from uploads",
+		)
+	}
+}
+
+// Ensure the FFmpeg command line tools required by the configured media
+// constraints are installed
+func checkFFTools(media config.MediaConstraints, tools ffToolSet) error {
+	if media.MaxFrameRate != 0 && !tools.ffprobe {
+		return errors.New(
+			"max_frame_rate requires the ffprobe executable, " +
+				"which is not installed",
+		)
+	}
+	return nil
+}
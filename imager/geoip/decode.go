@@ -0,0 +1,231 @@
+package geoip
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Data field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// Max nesting depth of decoded values. Guards against pointer loops and stack
+// exhaustion on malformed databases.
+const maxDecodingDepth = 64
+
+// Decoder of a data section. Pointers are relative to the start of the
+// section.
+type decoder []byte
+
+// Decode the value at off. Returns the offset after the value.
+//
+// Unsigned integers are decoded as uint64, signed integers as int64, floats
+// as float64, 128 bit integers as *big.Int, maps as map[string]interface{}
+// and arrays as []interface{}.
+func (d decoder) decode(off, depth uint) (
+	val interface{},
+	next uint,
+	err error,
+) {
+	if depth > maxDecodingDepth {
+		return nil, 0, fmt.Errorf("%w: max depth exceeded", ErrInvalidDatabase)
+	}
+
+	typ, size, off, err := d.readControl(off)
+	if err != nil {
+		return
+	}
+
+	if typ == typePointer {
+		var ptr uint
+		ptr, next, err = d.readPointer(off, size)
+		if err != nil {
+			return
+		}
+		val, _, err = d.decode(ptr, depth+1)
+		return
+	}
+
+	switch typ {
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		next = off
+		for i := uint(0); i < size; i++ {
+			var k, v interface{}
+			k, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("%w: non-string map key",
+					ErrInvalidDatabase)
+			}
+			v, next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+			m[key] = v
+		}
+		return m, next, nil
+	case typeArray:
+		arr := make([]interface{}, size)
+		next = off
+		for i := range arr {
+			arr[i], next, err = d.decode(next, depth+1)
+			if err != nil {
+				return
+			}
+		}
+		return arr, next, nil
+	case typeBool:
+		return size != 0, off, nil
+	case typeEndMarker, typeContainer:
+		return nil, 0, fmt.Errorf("%w: unexpected type %d", ErrInvalidDatabase,
+			typ)
+	}
+
+	// Types with a payload of size bytes
+	next = off + size
+	if next > uint(len(d)) || next < off {
+		return nil, 0, fmt.Errorf("%w: value out of bounds", ErrInvalidDatabase)
+	}
+	b := d[off:next]
+	switch typ {
+	case typeString:
+		val = string(b)
+	case typeBytes:
+		val = append([]byte(nil), b...)
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("%w: invalid double size",
+				ErrInvalidDatabase)
+		}
+		val = math.Float64frombits(readUint(b))
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("%w: invalid float size",
+				ErrInvalidDatabase)
+		}
+		val = float64(math.Float32frombits(uint32(readUint(b))))
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size",
+				ErrInvalidDatabase)
+		}
+		val = readUint(b)
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size",
+				ErrInvalidDatabase)
+		}
+		val = int64(int32(readUint(b)))
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("%w: invalid integer size",
+				ErrInvalidDatabase)
+		}
+		val = new(big.Int).SetBytes(b)
+	default:
+		return nil, 0, fmt.Errorf("%w: unknown type %d", ErrInvalidDatabase,
+			typ)
+	}
+	return
+}
+
+// Read the control byte and size of the field at off. Returns the offset of
+// the field payload. For pointers size contains the raw size bits.
+func (d decoder) readControl(off uint) (typ, size, next uint, err error) {
+	b, next, err := d.read(off, 1)
+	if err != nil {
+		return
+	}
+	ctrl := uint(b[0])
+	typ = ctrl >> 5
+	if typ == typePointer {
+		size = ctrl & 0x1f
+		return
+	}
+	if typ == typeExtended {
+		b, next, err = d.read(next, 1)
+		if err != nil {
+			return
+		}
+		typ = 7 + uint(b[0])
+	}
+
+	size = ctrl & 0x1f
+	if size >= 29 {
+		n := size - 28
+		b, next, err = d.read(next, n)
+		if err != nil {
+			return
+		}
+		switch n {
+		case 1:
+			size = 29 + uint(readUint(b))
+		case 2:
+			size = 285 + uint(readUint(b))
+		case 3:
+			size = 65821 + uint(readUint(b))
+		}
+	}
+	return
+}
+
+// Read the offset of a pointer, whose payload starts at off
+func (d decoder) readPointer(off, sizeBits uint) (ptr, next uint, err error) {
+	n := (sizeBits>>3)&0x3 + 1
+	b, next, err := d.read(off, n)
+	if err != nil {
+		return
+	}
+
+	v := (sizeBits&0x7)<<(8*n) | uint(readUint(b))
+	switch n {
+	case 1:
+		ptr = v
+	case 2:
+		ptr = v + 2048
+	case 3:
+		ptr = v + 526336
+	case 4:
+		// The size bits are not part of 32 bit pointers
+		ptr = uint(readUint(b))
+	}
+	return
+}
+
+// Read n bytes at off
+func (d decoder) read(off, n uint) (b []byte, next uint, err error) {
+	next = off + n
+	if next > uint(len(d)) || next < off {
+		return nil, 0, fmt.Errorf("%w: value out of bounds", ErrInvalidDatabase)
+	}
+	return d[off:next], next, nil
+}
+
+// Read a big endian unsigned integer of up to 8 bytes
+func readUint(b []byte) (n uint64) {
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return
+}
@@ -0,0 +1,208 @@
+// Package geoip reads offline GeoIP databases in the MaxMind DB format, such
+// as the GeoLite2 Country, City and ASN databases.
+//
+// Only the subset of the format required for looking up the country and
+// autonomous system of an IP is exposed.
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// Marks the start of the metadata section
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Size of the zeroed separator between the search tree and data section
+const dataSectionSeparator = 16
+
+// ErrInvalidDatabase is returned on malformed database files
+var ErrInvalidDatabase = errors.New("invalid MaxMind database")
+
+// Record of an IP looked up in a database. Fields not contained in the
+// database are left empty.
+type Record struct {
+	// ISO 3166-1 alpha-2 code of the country the IP is located or registered
+	// in
+	Country string
+
+	// Number of the autonomous system the IP belongs to
+	ASN uint32
+}
+
+// Reader of a database loaded into memory
+type Reader struct {
+	buf                   []byte
+	tree, data            []byte
+	nodeCount, recordSize uint
+	ipVersion             uint
+	ipv4Start             uint
+}
+
+// Open reads a database file into memory
+func Open(path string) (r *Reader, err error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	r, err = FromBytes(buf)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", path, err)
+	}
+	return
+}
+
+// FromBytes parses a database from its binary representation
+func FromBytes(buf []byte) (r *Reader, err error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i == -1 {
+		return nil, ErrInvalidDatabase
+	}
+	meta, _, err := decoder(buf[i+len(metadataMarker):]).decode(0, 0)
+	if err != nil {
+		return
+	}
+
+	m, ok := meta.(map[string]interface{})
+	if !ok {
+		return nil, ErrInvalidDatabase
+	}
+	r = &Reader{
+		buf: buf,
+	}
+	for _, f := range [...]struct {
+		key string
+		dst *uint
+	}{
+		{"node_count", &r.nodeCount},
+		{"record_size", &r.recordSize},
+		{"ip_version", &r.ipVersion},
+	} {
+		n, ok := m[f.key].(uint64)
+		if !ok {
+			return nil, fmt.Errorf("%w: no %s in metadata", ErrInvalidDatabase,
+				f.key)
+		}
+		*f.dst = uint(n)
+	}
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%w: unsupported record size %d",
+			ErrInvalidDatabase, r.recordSize)
+	}
+	switch r.ipVersion {
+	case 4, 6:
+	default:
+		return nil, fmt.Errorf("%w: unsupported IP version %d",
+			ErrInvalidDatabase, r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(i) {
+		return nil, ErrInvalidDatabase
+	}
+	r.tree = buf[:treeSize]
+	r.data = buf[treeSize+dataSectionSeparator : i]
+
+	// IPv4 addresses are stored in the ::/96 subnet of IPv6 databases
+	if r.ipVersion == 6 {
+		for j := 0; j < 96 && r.ipv4Start < r.nodeCount; j++ {
+			r.ipv4Start, err = r.readRecord(r.ipv4Start, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return
+}
+
+// Lookup returns the record of an IP. ok is false, if the database contains
+// no record for the IP.
+func (r *Reader) Lookup(ip net.IP) (rec Record, ok bool, err error) {
+	data, ok, err := r.lookup(ip)
+	if err != nil || !ok {
+		return
+	}
+
+	m, _ := data.(map[string]interface{})
+	for _, k := range [...]string{"country", "registered_country"} {
+		if c, ok := m[k].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				rec.Country = code
+				break
+			}
+		}
+	}
+	if asn, ok := m["autonomous_system_number"].(uint64); ok {
+		rec.ASN = uint32(asn)
+	}
+	return
+}
+
+// Find and decode the data record of ip
+func (r *Reader) lookup(ip net.IP) (data interface{}, ok bool, err error) {
+	var node uint
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		node = r.ipv4Start
+	} else if r.ipVersion == 4 {
+		return
+	}
+
+	for i := 0; i < len(ip)*8 && node < r.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-uint(i%8))) & 1
+		node, err = r.readRecord(node, bit)
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case node == r.nodeCount:
+		// Empty record
+		return
+	case node < r.nodeCount:
+		return nil, false, ErrInvalidDatabase
+	}
+	off := node - r.nodeCount - dataSectionSeparator
+	if off >= uint(len(r.data)) {
+		return nil, false, ErrInvalidDatabase
+	}
+	data, _, err = decoder(r.data).decode(off, 0)
+	ok = err == nil
+	return
+}
+
+// Read the left (bit = 0) or right (bit = 1) record of a search tree node
+func (r *Reader) readRecord(node, bit uint) (rec uint, err error) {
+	size := r.recordSize / 4
+	off := node * size
+	if off+size > uint(len(r.tree)) {
+		return 0, ErrInvalidDatabase
+	}
+	b := r.tree[off : off+size]
+
+	switch r.recordSize {
+	case 24:
+		b = b[bit*3:]
+		rec = uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			rec = uint(b[3]&0xf0)<<20 |
+				uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		} else {
+			rec = uint(b[3]&0x0f)<<24 |
+				uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+		}
+	case 32:
+		b = b[bit*4:]
+		rec = uint(b[0])<<24 | uint(b[1])<<16 | uint(b[2])<<8 | uint(b[3])
+	}
+	return
+}
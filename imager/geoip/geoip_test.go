@@ -0,0 +1,371 @@
+package geoip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/test"
+)
+
+// Pointer to an offset in the data section
+type pointer uint
+
+// Append the control bytes of a field
+func writeControl(buf *bytes.Buffer, typ, size uint) {
+	var ext []byte
+	if typ > 7 {
+		ext = []byte{byte(typ - 7)}
+		typ = typeExtended
+	}
+
+	var sizeBytes []byte
+	switch {
+	case size < 29:
+	case size < 285:
+		sizeBytes = []byte{byte(size - 29)}
+		size = 29
+	case size < 65821:
+		size -= 285
+		sizeBytes = []byte{byte(size >> 8), byte(size)}
+		size = 30
+	default:
+		size -= 65821
+		sizeBytes = []byte{byte(size >> 16), byte(size >> 8), byte(size)}
+		size = 31
+	}
+
+	buf.WriteByte(byte(typ<<5 | size))
+	buf.Write(ext)
+	buf.Write(sizeBytes)
+}
+
+// Append the minimal big endian representation of n
+func writeUint(buf *bytes.Buffer, typ uint, n uint64) {
+	var b []byte
+	for ; n != 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	writeControl(buf, typ, uint(len(b)))
+	buf.Write(b)
+}
+
+// Append an encoded value to the data section
+func encode(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case string:
+		writeControl(buf, typeString, uint(len(v)))
+		buf.WriteString(v)
+	case uint16:
+		writeUint(buf, typeUint16, uint64(v))
+	case uint32:
+		writeUint(buf, typeUint32, uint64(v))
+	case uint64:
+		writeUint(buf, typeUint64, v)
+	case bool:
+		var size uint
+		if v {
+			size = 1
+		}
+		writeControl(buf, typeBool, size)
+	case []interface{}:
+		writeControl(buf, typeArray, uint(len(v)))
+		for _, v := range v {
+			encode(buf, v)
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		writeControl(buf, typeMap, uint(len(v)))
+		for _, k := range keys {
+			encode(buf, k)
+			encode(buf, v[k])
+		}
+	case pointer:
+		switch {
+		case v < 2048:
+			buf.Write([]byte{byte(typePointer<<5 | v>>8), byte(v)})
+		case v < 526336:
+			v -= 2048
+			buf.Write([]byte{
+				byte(typePointer<<5 | 1<<3 | v>>16),
+				byte(v >> 8),
+				byte(v),
+			})
+		default:
+			buf.Write([]byte{
+				typePointer<<5 | 3<<3,
+				byte(v >> 24),
+				byte(v >> 16),
+				byte(v >> 8),
+				byte(v),
+			})
+		}
+	default:
+		panic(fmt.Sprintf("unsupported type: %T", v))
+	}
+}
+
+// Record of a search tree node. Points to a node, a data section offset or
+// nothing.
+type testRecord struct {
+	node, data int
+}
+
+var emptyRecord = testRecord{-1, -1}
+
+// Builder of test databases
+type testDB struct {
+	ipVersion, recordSize uint
+	nodes                 [][2]testRecord
+	data                  bytes.Buffer
+}
+
+func newTestDB(ipVersion, recordSize uint) *testDB {
+	return &testDB{
+		ipVersion:  ipVersion,
+		recordSize: recordSize,
+		nodes:      [][2]testRecord{{emptyRecord, emptyRecord}},
+	}
+}
+
+// Append a value to the data section and return its offset
+func (db *testDB) add(v interface{}) pointer {
+	off := pointer(db.data.Len())
+	encode(&db.data, v)
+	return off
+}
+
+// Insert a network pointing to a data section offset
+func (db *testDB) insert(t *testing.T, cidr string, data pointer) {
+	t.Helper()
+
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := []byte(n.IP)
+	ones, _ := n.Mask.Size()
+	if db.ipVersion == 6 && len(ip) == net.IPv4len {
+		ip = append(make([]byte, 12), ip...)
+		ones += 96
+	}
+
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - uint(i%8)) & 1
+		if i == ones-1 {
+			db.nodes[node][bit] = testRecord{-1, int(data)}
+			return
+		}
+		if db.nodes[node][bit].node == -1 {
+			db.nodes = append(db.nodes, [2]testRecord{emptyRecord, emptyRecord})
+			db.nodes[node][bit].node = len(db.nodes) - 1
+		}
+		node = db.nodes[node][bit].node
+	}
+}
+
+// Encode the database
+func (db *testDB) encode() []byte {
+	var buf bytes.Buffer
+	count := uint(len(db.nodes))
+	for _, n := range db.nodes {
+		var recs [2]uint
+		for i, r := range n {
+			switch {
+			case r.node != -1:
+				recs[i] = uint(r.node)
+			case r.data != -1:
+				recs[i] = count + dataSectionSeparator + uint(r.data)
+			default:
+				recs[i] = count
+			}
+		}
+
+		l, r := recs[0], recs[1]
+		switch db.recordSize {
+		case 24:
+			buf.Write([]byte{
+				byte(l >> 16), byte(l >> 8), byte(l),
+				byte(r >> 16), byte(r >> 8), byte(r),
+			})
+		case 28:
+			buf.Write([]byte{
+				byte(l >> 16), byte(l >> 8), byte(l),
+				byte(l>>20&0xf0 | r>>24&0x0f),
+				byte(r >> 16), byte(r >> 8), byte(r),
+			})
+		case 32:
+			buf.Write([]byte{
+				byte(l >> 24), byte(l >> 16), byte(l >> 8), byte(l),
+				byte(r >> 24), byte(r >> 16), byte(r >> 8), byte(r),
+			})
+		}
+	}
+
+	buf.Write(make([]byte, dataSectionSeparator))
+	buf.Write(db.data.Bytes())
+	buf.Write(metadataMarker)
+	encode(&buf, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(db.recordSize),
+		"ip_version":                  uint16(db.ipVersion),
+		"database_type":               "Shamichan-Test",
+		"languages":                   []interface{}{"en"},
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint64(1600000000),
+	})
+	return buf.Bytes()
+}
+
+func TestLookup(t *testing.T) {
+	t.Parallel()
+
+	for _, ipVersion := range [...]uint{4, 6} {
+		for _, recordSize := range [...]uint{24, 28, 32} {
+			ipVersion := ipVersion
+			recordSize := recordSize
+			name := fmt.Sprintf("IPv%d %d bit", ipVersion, recordSize)
+			t.Run(name, func(t *testing.T) {
+				t.Parallel()
+				testLookup(t, ipVersion, recordSize)
+			})
+		}
+	}
+}
+
+func testLookup(t *testing.T, ipVersion, recordSize uint) {
+	db := newTestDB(ipVersion, recordSize)
+
+	// Shared values are referenced through pointers
+	jp := db.add(map[string]interface{}{
+		"iso_code":   "JP",
+		"geoname_id": uint32(1861060),
+	})
+	db.insert(t, "192.0.2.0/24", db.add(map[string]interface{}{
+		"country":                  jp,
+		"autonomous_system_number": uint32(64496),
+		"is_anycast":               true,
+	}))
+	db.insert(t, "198.51.100.0/25", db.add(map[string]interface{}{
+		"registered_country": jp,
+	}))
+	db.insert(t, "203.0.113.7/32", db.add(map[string]interface{}{
+		"autonomous_system_number":       uint32(4200000000),
+		"autonomous_system_organization": "Scarlet Devil Mansion",
+	}))
+	if ipVersion == 6 {
+		db.insert(t, "2001:db8::/32", db.add(map[string]interface{}{
+			"country": map[string]interface{}{
+				"iso_code": "DE",
+			},
+		}))
+	}
+
+	r, err := FromBytes(db.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		ip  string
+		ok  bool
+		rec Record
+	}{
+		{"192.0.2.1", true, Record{"JP", 64496}},
+		{"192.0.2.255", true, Record{"JP", 64496}},
+		{"192.0.3.1", false, Record{}},
+		{"198.51.100.127", true, Record{"JP", 0}},
+		{"198.51.100.128", false, Record{}},
+		{"203.0.113.7", true, Record{"", 4200000000}},
+		{"203.0.113.8", false, Record{}},
+		{"2001:db8::1", ipVersion == 6, Record{}},
+		{"2001:db9::1", false, Record{}},
+	}
+	if ipVersion == 6 {
+		cases[len(cases)-2].rec.Country = "DE"
+	}
+	for _, c := range cases {
+		rec, ok, err := r.Lookup(net.ParseIP(c.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != c.ok {
+			t.Fatalf("%s: found: %t", c.ip, ok)
+		}
+		test.AssertEquals(t, rec, c.rec)
+	}
+}
+
+func TestDecodePointers(t *testing.T) {
+	t.Parallel()
+
+	// Pad the data section to exercise all pointer sizes
+	var buf bytes.Buffer
+	offsets := [...]pointer{0, 3000, 600000}
+	for _, off := range offsets {
+		buf.Write(make([]byte, int(off)-buf.Len()))
+		encode(&buf, fmt.Sprintf("value at %d", off))
+	}
+	for _, off := range offsets {
+		start := uint(buf.Len())
+		encode(&buf, off)
+
+		v, next, err := decoder(buf.Bytes()).decode(start, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, v, interface{}(fmt.Sprintf("value at %d", off)))
+		test.AssertEquals(t, next, uint(buf.Len()))
+	}
+
+	t.Run("loop", func(t *testing.T) {
+		t.Parallel()
+
+		var buf bytes.Buffer
+		encode(&buf, pointer(0))
+		_, _, err := decoder(buf.Bytes()).decode(0, 0)
+		if !errors.Is(err, ErrInvalidDatabase) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func TestInvalidDatabase(t *testing.T) {
+	t.Parallel()
+
+	valid := newTestDB(4, 24)
+	valid.insert(t, "192.0.2.0/24", valid.add("cirno"))
+	buf := valid.encode()
+	meta := bytes.LastIndex(buf, metadataMarker)
+
+	cases := [...]struct {
+		name string
+		buf  []byte
+	}{
+		{"empty", nil},
+		{"no metadata", buf[:meta]},
+		{"truncated tree", buf[meta-10:]},
+		{"truncated metadata", buf[:len(buf)-10]},
+	}
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := FromBytes(c.buf)
+			if !errors.Is(err, ErrInvalidDatabase) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package imager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"io"
+
+	"github.com/bakape/thumbnailer/v2"
+)
+
+const (
+	mimeAVIF = "image/avif"
+	mimeJXL  = "image/jxl"
+
+	// The thumbnailer's built-in matchers run before the ones registered by
+	// this package and detect any ISOBMFF file with a 20 byte file type box
+	// under this MIME type
+	mimeQuickTime = "video/quicktime"
+)
+
+// Detect AVIF images by the brands listed in their ISOBMFF file type box
+func detectAVIF(buf []byte) (mime, ext string) {
+	if len(buf) < 16 || !bytes.Equal(buf[4:8], []byte("ftyp")) {
+		return
+	}
+	size := int(binary.BigEndian.Uint32(buf[:4]))
+	if size < 16 || size%4 != 0 || size > len(buf) {
+		return
+	}
+
+	for i := 8; i < size; i += 4 {
+		if i == 12 {
+			// Minor version number
+			continue
+		}
+		switch string(buf[i : i+4]) {
+		case "avif", "avis":
+			return mimeAVIF, "avif"
+		}
+	}
+	return
+}
+
+// Detect JPEG XL images both as a naked codestream and inside the ISOBMFF
+// container
+func detectJXL(buf []byte) (mime, ext string) {
+	if bytes.HasPrefix(buf, []byte{0xFF, 0x0A}) ||
+		bytes.HasPrefix(buf, []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A")) {
+		return mimeJXL, "jxl"
+	}
+	return
+}
+
+// Detect the MIME type and canonical extension of rs. AVIF images, that the
+// thumbnailer detects as QuickTime, are corrected.
+func detectMIME(rs io.ReadSeeker, accepted map[string]bool) (
+	mime, ext string,
+	err error,
+) {
+	mime, ext, err = thumbnailer.DetectMIME(rs, accepted)
+	if err != nil || mime != mimeQuickTime {
+		return
+	}
+	is, err := isAVIF(rs)
+	if err != nil || !is {
+		return
+	}
+	if accepted != nil && !accepted[mimeAVIF] {
+		err = thumbnailer.ErrUnsupportedMIME(mimeAVIF)
+		return
+	}
+	return mimeAVIF, "avif", nil
+}
+
+// Refine the MIME type of AVIF images, that the thumbnailer detects and
+// processes as QuickTime
+func refineImageMime(rs io.ReadSeeker, src *thumbnailer.Source) (err error) {
+	if src.Mime != mimeQuickTime {
+		return
+	}
+	is, err := isAVIF(rs)
+	if err != nil || !is {
+		return
+	}
+	src.Mime = mimeAVIF
+	src.Extension = "avif"
+
+	// FFmpeg considers images to be video for processing reasons
+	src.HasVideo = false
+	return
+}
+
+// Returns, if the file type box at the start of rs lists an AVIF brand
+func isAVIF(rs io.ReadSeeker) (is bool, err error) {
+	_, err = rs.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	var buf [512]byte
+	n, err := io.ReadFull(rs, buf[:])
+	switch err {
+	case nil, io.EOF, io.ErrUnexpectedEOF:
+		err = nil
+	default:
+		return
+	}
+	mime, _ := detectAVIF(buf[:n])
+	is = mime != ""
+	return
+}
+
+// Thumbnail still image formats the thumbnailer does not handle natively, but
+// FFmpeg can decode
+func processFFImage(rs io.ReadSeeker, src *thumbnailer.Source,
+	opts thumbnailer.Options,
+) (
+	thumb image.Image, err error,
+) {
+	c, err := thumbnailer.NewFFContext(rs)
+	if err != nil {
+		return
+	}
+	defer c.Close()
+
+	src.Dims, err = c.Dims()
+	switch err {
+	case nil:
+	case thumbnailer.ErrStreamNotFound:
+		err = thumbnailer.ErrInvalidImage("no decodable image stream")
+		return
+	default:
+		return
+	}
+
+	max := opts.MaxSourceDims
+	if max.Width != 0 && src.Width > max.Width {
+		err = thumbnailer.ErrTooWide
+		return
+	}
+	if max.Height != 0 && src.Height > max.Height {
+		err = thumbnailer.ErrTooTall
+		return
+	}
+
+	return c.Thumbnail(opts.ThumbDims)
+}
@@ -0,0 +1,211 @@
+package imager
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/thumbnailer/v2"
+)
+
+func TestDetectImageFormats(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name, mime, ext string
+		detect          func([]byte) (string, string)
+		buf             []byte
+	}{
+		{
+			name:   "AVIF",
+			mime:   mimeAVIF,
+			ext:    "avif",
+			detect: detectAVIF,
+			buf: []byte("\x00\x00\x00\x20ftypavif\x00\x00\x00\x00" +
+				"avifmif1miafMA1B"),
+		},
+		{
+			name:   "AVIF image sequence",
+			mime:   mimeAVIF,
+			ext:    "avif",
+			detect: detectAVIF,
+			buf:    []byte("\x00\x00\x00\x14ftypavis\x00\x00\x00\x00msf1"),
+		},
+		{
+			name:   "MP4 is not AVIF",
+			detect: detectAVIF,
+			buf:    []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00mp41"),
+		},
+		{
+			name:   "truncated AVIF",
+			detect: detectAVIF,
+			buf:    []byte("\x00\x00\x00\x20ftypavif"),
+		},
+		{
+			name:   "JXL codestream",
+			mime:   mimeJXL,
+			ext:    "jxl",
+			detect: detectJXL,
+			buf:    []byte{0xFF, 0x0A, 0xFA, 0x7F},
+		},
+		{
+			name:   "JXL container",
+			mime:   mimeJXL,
+			ext:    "jxl",
+			detect: detectJXL,
+			buf:    []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A\x00\x00"),
+		},
+		{
+			name:   "JPEG is not JXL",
+			detect: detectJXL,
+			buf:    []byte{0xFF, 0xD8, 0xFF, 0xE0},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			mime, ext := c.detect(c.buf)
+			test.AssertEquals(t, mime, c.mime)
+			test.AssertEquals(t, ext, c.ext)
+		})
+	}
+}
+
+func TestDetectMIME(t *testing.T) {
+	t.Parallel()
+
+	accepted := map[string]bool{
+		mimeAVIF:      true,
+		mimeJXL:       true,
+		mimeQuickTime: true,
+		"video/mp4":   true,
+	}
+	cases := [...]struct {
+		name, mime, ext string
+		buf             []byte
+	}{
+		{
+			name: "AVIF",
+			mime: mimeAVIF,
+			ext:  "avif",
+			buf: []byte("\x00\x00\x00\x20ftypavif\x00\x00\x00\x00" +
+				"avifmif1miafMA1B"),
+		},
+		{
+			// Matched by the built-in QuickTime signature first
+			name: "AVIF with 20 byte file type box",
+			mime: mimeAVIF,
+			ext:  "avif",
+			buf:  []byte("\x00\x00\x00\x14ftypavis\x00\x00\x00\x00msf1"),
+		},
+		{
+			name: "QuickTime",
+			mime: mimeQuickTime,
+			ext:  "mov",
+			buf:  []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  "),
+		},
+		{
+			name: "MP4",
+			mime: "video/mp4",
+			ext:  "mp4",
+			buf: []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00" +
+				"mp41isom"),
+		},
+		{
+			name: "JXL codestream",
+			mime: mimeJXL,
+			ext:  "jxl",
+			buf:  []byte{0xFF, 0x0A, 0xFA, 0x7F},
+		},
+		{
+			name: "JXL container",
+			mime: mimeJXL,
+			ext:  "jxl",
+			buf:  []byte("\x00\x00\x00\x0CJXL \x0D\x0A\x87\x0A\x00\x00"),
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			mime, ext, err := detectMIME(bytes.NewReader(c.buf), accepted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.AssertEquals(t, mime, c.mime)
+			test.AssertEquals(t, ext, c.ext)
+		})
+	}
+
+	t.Run("AVIF not accepted", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := detectMIME(
+			bytes.NewReader(cases[1].buf),
+			map[string]bool{mimeQuickTime: true},
+		)
+		test.AssertEquals(
+			t,
+			err,
+			error(thumbnailer.ErrUnsupportedMIME(mimeAVIF)),
+		)
+	})
+}
+
+func TestRefineImageMime(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name string
+		buf  []byte
+		in   thumbnailer.Source
+		out  thumbnailer.Source
+	}{
+		{
+			name: "AVIF detected as QuickTime",
+			buf:  []byte("\x00\x00\x00\x14ftypavis\x00\x00\x00\x00msf1"),
+			in: thumbnailer.Source{
+				HasVideo:  true,
+				Mime:      mimeQuickTime,
+				Extension: "mov",
+			},
+			out: thumbnailer.Source{
+				Mime:      mimeAVIF,
+				Extension: "avif",
+			},
+		},
+		{
+			name: "QuickTime",
+			buf:  []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00qt  "),
+			in: thumbnailer.Source{
+				HasVideo:  true,
+				Mime:      mimeQuickTime,
+				Extension: "mov",
+			},
+			out: thumbnailer.Source{
+				HasVideo:  true,
+				Mime:      mimeQuickTime,
+				Extension: "mov",
+			},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			src := c.in
+			err := refineImageMime(bytes.NewReader(c.buf), &src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.AssertEquals(t, src, c.out)
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package imager
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/thumbnailer/v2"
+	"github.com/go-playground/log"
+	"github.com/jackc/pgx/v4"
+)
+
+// Command for importing existing image collections from a directory or a JSON
+// manifest
+type importCommand struct {
+	Manifest string `short:"m" long:"manifest" description:"JSON manifest containing an array of file paths to import. Relative paths are resolved against the directory of the manifest."`
+
+	Parallel uint `short:"j" long:"parallel" default:"4" description:"Maximum number of files to process in parallel"`
+
+	Report string `short:"o" long:"report" description:"File to write the JSON import report to. Defaults to stdout."`
+
+	Args struct {
+		Dir string `positional-arg-name:"directory" description:"Directory to recursively import all files from"`
+	} `positional-args:"yes"`
+}
+
+// Report of a bulk import
+type importReport struct {
+	// Input paths mapped to SHA1 hashes of the stored files. Includes skipped
+	// files.
+	Files map[string]common.SHA1Hash `json:"files"`
+
+	// Input paths, whose files were already stored
+	Skipped []string `json:"skipped"`
+
+	// Input paths mapped to the errors, that prevented their import
+	Failed map[string]string `json:"failed"`
+}
+
+func (c *importCommand) Execute(_ []string) (err error) {
+	var paths []string
+	switch {
+	case c.Manifest != "" && c.Args.Dir != "":
+		return errors.New("either a directory or a manifest must be passed")
+	case c.Manifest != "":
+		paths, err = readImportManifest(c.Manifest)
+	case c.Args.Dir != "":
+		paths, err = listImportDir(c.Args.Dir)
+	default:
+		return errors.New("no directory or manifest to import from")
+	}
+	if err != nil {
+		return
+	}
+
+	err = parallel(db.LoadDB, assets.CreateDirs)
+	if err != nil {
+		return
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	report := importFiles(ctx, paths, c.Parallel)
+	log.Infof(
+		"imported %d files: %d skipped, %d failed",
+		len(report.Files)-len(report.Skipped),
+		len(report.Skipped),
+		len(report.Failed),
+	)
+
+	var w io.Writer = os.Stdout
+	if c.Report != "" {
+		var f *os.File
+		f, err = os.Create(c.Report)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	err = enc.Encode(report)
+	if err != nil {
+		return
+	}
+	return ctx.Err()
+}
+
+// Read the file paths to import from a JSON manifest
+func readImportManifest(path string) (paths []string, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&paths)
+	if err != nil {
+		return
+	}
+	dir := filepath.Dir(path)
+	for i, p := range paths {
+		if !filepath.IsAbs(p) {
+			paths[i] = filepath.Join(dir, p)
+		}
+	}
+	return
+}
+
+// Recursively list all regular files in a directory
+func listImportDir(dir string) (paths []string, err error) {
+	err = filepath.Walk(
+		dir,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		},
+	)
+	return
+}
+
+// Import files with no more than limit files processed in parallel
+func importFiles(ctx context.Context, paths []string, limit uint) (
+	report importReport,
+) {
+	if limit == 0 {
+		limit = 1
+	}
+	report.Files = make(map[string]common.SHA1Hash, len(paths))
+	report.Failed = make(map[string]string)
+
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, limit)
+	)
+	for _, p := range paths {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case sem <- struct{}{}:
+		}
+
+		wg.Add(1)
+		go func(path string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			SHA1, skipped, err := importFile(ctx, path)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("import: %s: %s", path, err)
+				report.Failed[path] = err.Error()
+				return
+			}
+			report.Files[path] = SHA1
+			if skipped {
+				report.Skipped = append(report.Skipped, path)
+			}
+		}(p)
+	}
+	wg.Wait()
+	return
+}
+
+// Process and store a single file, unless it is already stored.
+// Returns the SHA1 hash of the stored file.
+func importFile(ctx context.Context, path string) (
+	SHA1 common.SHA1Hash,
+	skipped bool,
+	err error,
+) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var id common.SHA256Hash
+	_, err = hashFile(id[:], f, sha256.New())
+	if err != nil {
+		return
+	}
+	SHA1, skipped, err = getImportedSHA1(ctx, id)
+	if err != nil || skipped {
+		return
+	}
+
+	var img common.ImageCommon
+	img.SHA256 = id
+	_, err = hashFile(img.SHA1[:], f, sha1.New())
+	if err != nil {
+		return
+	}
+	srcSHA1 := img.SHA1
+
+	res, err := processFile(f, &img, thumbnailer.Options{
+		ThumbDims:         thumbnailDims(),
+		AcceptedMimeTypes: allowedMimeTypes,
+	}, mediaConstraints{})
+	defer res.release()
+	if err != nil {
+		return
+	}
+
+	err = db.InTransaction(ctx, func(tx pgx.Tx) error {
+		return storeProcessedFile(ctx, tx, id, srcSHA1, &img, f, res)
+	})
+	if db.IsConflictError(err) {
+		// An identical file was stored concurrently
+		return getImportedSHA1(ctx, id)
+	}
+	SHA1 = img.SHA1
+	return
+}
+
+// Return the SHA1 hash of an already stored file by its SHA-256 hash, if any
+func getImportedSHA1(ctx context.Context, id common.SHA256Hash) (
+	SHA1 common.SHA1Hash,
+	exists bool,
+	err error,
+) {
+	err = db.InTransaction(ctx, func(tx pgx.Tx) (err error) {
+		img, err := db.GetImage(ctx, tx, id)
+		switch err {
+		case nil:
+			SHA1 = img.SHA1
+			exists = true
+		case pgx.ErrNoRows:
+			err = nil
+		}
+		return
+	})
+	return
+}
@@ -0,0 +1,78 @@
+package imager
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestImport(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "shamichan_import_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(dir)
+	})
+
+	abs, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := [...]string{"sample.gif", "sample.webp", "sample.txt"}
+	manifest := []string{filepath.Join(abs, "nope.png")}
+	for _, f := range files {
+		manifest = append(manifest, filepath.Join(abs, f))
+	}
+	buf, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join(dir, "manifest.json")
+	err = ioutil.WriteFile(manifestPath, buf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := readImportManifest(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test.AssertEquals(t, paths, manifest)
+
+	assertReport := func(t *testing.T, report importReport) {
+		t.Helper()
+
+		test.AssertEquals(t, len(report.Failed), 1)
+		if _, ok := report.Failed[manifest[0]]; !ok {
+			t.Fatalf("missing file not reported as failed: %v", report.Failed)
+		}
+		test.AssertEquals(t, len(report.Files), len(files))
+		for _, f := range files {
+			std := common.SHA1Hash(sha1.Sum(test.ReadSample(t, f)))
+			test.AssertEquals(
+				t,
+				report.Files[filepath.Join(abs, f)],
+				std,
+			)
+		}
+	}
+
+	// Other tests might have already stored some of the same files
+	assertReport(t, importFiles(context.Background(), paths, 2))
+
+	t.Run("skip existing", func(t *testing.T) {
+		report := importFiles(context.Background(), paths, 2)
+		assertReport(t, report)
+		test.AssertEquals(t, len(report.Skipped), len(files))
+	})
+}
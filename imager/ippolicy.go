@@ -0,0 +1,273 @@
+package imager
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/geoip"
+	"github.com/go-playground/log"
+)
+
+// Interval of checking IP policy files for changes
+const ipPolicyReloadInterval = 10 * time.Second
+
+var (
+	errIPBlocked = common.ErrAccessDenied("IP address blocked")
+
+	ipPolicyMu sync.RWMutex
+
+	// Currently loaded IP policy files
+	ipPolicy ipPolicyFiles
+)
+
+// CIDR range from a list file
+type cidrRule struct {
+	net *net.IPNet
+
+	// Position of the rule in the form of path:line
+	source string
+}
+
+// CIDR lists and GeoIP databases of the IP policy loaded from disk
+type ipPolicyFiles struct {
+	allow, deny []cidrRule
+	geoIP       []*geoip.Reader
+
+	// Modification times and sizes of the loaded files
+	versions map[string]fileVersion
+}
+
+// Version of a file on disk
+type fileVersion struct {
+	modTime, size int64
+}
+
+// Return paths of all configured IP policy files
+func ipPolicyPaths() (paths []string) {
+	for _, p := range [...][]string{
+		config.Server.IPAllowLists,
+		config.Server.IPDenyLists,
+		config.Server.GeoIPDatabases,
+	} {
+		paths = append(paths, p...)
+	}
+	return
+}
+
+// Read the versions of all configured IP policy files
+func readIPPolicyVersions() (v map[string]fileVersion, err error) {
+	paths := ipPolicyPaths()
+	v = make(map[string]fileVersion, len(paths))
+	for _, p := range paths {
+		var info os.FileInfo
+		info, err = os.Stat(p)
+		if err != nil {
+			return
+		}
+		v[p] = fileVersion{
+			modTime: info.ModTime().UnixNano(),
+			size:    info.Size(),
+		}
+	}
+	return
+}
+
+// Load all configured IP policy files from disk
+func loadIPPolicy() (err error) {
+	var p ipPolicyFiles
+
+	// Read versions first, so changes during loading trigger another reload
+	p.versions, err = readIPPolicyVersions()
+	if err != nil {
+		return
+	}
+
+	for _, l := range [...]struct {
+		paths []string
+		dst   *[]cidrRule
+	}{
+		{config.Server.IPAllowLists, &p.allow},
+		{config.Server.IPDenyLists, &p.deny},
+	} {
+		for _, path := range l.paths {
+			var rules []cidrRule
+			rules, err = readCIDRList(path)
+			if err != nil {
+				return
+			}
+			*l.dst = append(*l.dst, rules...)
+		}
+	}
+	for _, path := range config.Server.GeoIPDatabases {
+		var r *geoip.Reader
+		r, err = geoip.Open(path)
+		if err != nil {
+			return
+		}
+		p.geoIP = append(p.geoIP, r)
+	}
+
+	ipPolicyMu.Lock()
+	ipPolicy = p
+	ipPolicyMu.Unlock()
+	return
+}
+
+// Parse a file of CIDR ranges or IPs, one per line. Empty lines and lines
+// starting with # are ignored.
+func readCIDRList(path string) (rules []cidrRule, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if !strings.ContainsRune(text, '/') {
+			if strings.ContainsRune(text, ':') {
+				text += "/128"
+			} else {
+				text += "/32"
+			}
+		}
+
+		var n *net.IPNet
+		_, n, err = net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		rules = append(rules, cidrRule{
+			net:    n,
+			source: fmt.Sprintf("%s:%d", path, line),
+		})
+	}
+	err = s.Err()
+	return
+}
+
+// Reload the IP policy files, when any of them changes, until ctx is
+// cancelled
+func watchIPPolicy(ctx context.Context) {
+	if len(ipPolicyPaths()) == 0 {
+		return
+	}
+
+	t := time.NewTicker(ipPolicyReloadInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			// The previous policy is kept, if the new files are invalid
+			reloaded, err := reloadChangedIPPolicy()
+			switch {
+			case err != nil:
+				log.Errorf("ip policy: reloading: %s", err)
+			case reloaded:
+				log.Info("ip policy: reloaded")
+			}
+		}
+	}
+}
+
+// Reload the IP policy files, if any of them changed since they were loaded
+func reloadChangedIPPolicy() (reloaded bool, err error) {
+	v, err := readIPPolicyVersions()
+	if err != nil {
+		return
+	}
+
+	ipPolicyMu.RLock()
+	changed := false
+	for p, ver := range v {
+		if ipPolicy.versions[p] != ver {
+			changed = true
+			break
+		}
+	}
+	ipPolicyMu.RUnlock()
+	if !changed {
+		return
+	}
+
+	err = loadIPPolicy()
+	reloaded = err == nil
+	return
+}
+
+// Return the IP policy rule, that denies ip from uploading, if any
+func matchIPPolicy(ip net.IP) (rule string) {
+	ipPolicyMu.RLock()
+	defer ipPolicyMu.RUnlock()
+
+	for _, r := range ipPolicy.allow {
+		if r.net.Contains(ip) {
+			return ""
+		}
+	}
+	for _, r := range ipPolicy.deny {
+		if r.net.Contains(ip) {
+			return fmt.Sprintf("deny list %s (%s)", r.source, r.net)
+		}
+	}
+
+	conf := config.Get().IPPolicy
+	if len(conf.DeniedCountries) == 0 && len(conf.DeniedASNs) == 0 {
+		return ""
+	}
+	for _, db := range ipPolicy.geoIP {
+		rec, ok, err := db.Lookup(ip)
+		if err != nil {
+			log.Errorf("ip policy: GeoIP lookup of %s: %s", ip, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if rec.Country != "" {
+			for _, c := range conf.DeniedCountries {
+				if strings.EqualFold(c, rec.Country) {
+					return "country " + rec.Country
+				}
+			}
+		}
+		if rec.ASN != 0 {
+			for _, asn := range conf.DeniedASNs {
+				if asn == rec.ASN {
+					return fmt.Sprintf("ASN %d", asn)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// Reject upload requests from clients denied by the IP policy
+func applyIPPolicy(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ip != nil {
+			if rule := matchIPPolicy(ip); rule != "" {
+				log.Infof("ip policy: rejected %s %s: %s", ip, r.URL.Path, rule)
+				http.Error(w, errIPBlocked.Error(), 403)
+				return
+			}
+		}
+		inner(w, r)
+	}
+}
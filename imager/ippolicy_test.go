@@ -0,0 +1,144 @@
+package imager
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+// Write an IP policy list file to dir
+func writeIPList(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIPPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shamichan-ip-policy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	defer func(conf config.ServerConfigs) {
+		config.Server = conf
+		ipPolicy = ipPolicyFiles{}
+	}(config.Server)
+	config.Server.IPAllowLists = []string{
+		writeIPList(t, dir, "allow", "# staff\n192.0.2.10\n"),
+	}
+	config.Server.IPDenyLists = []string{
+		writeIPList(t, dir, "deny", "203.0.113.0/24\n\n2001:db8:1::/48\n"),
+	}
+	config.Server.GeoIPDatabases = []string{"testdata/geoip.mmdb"}
+
+	conf := *config.Get()
+	defer config.Set(conf)
+	conf.IPPolicy = config.IPPolicy{
+		DeniedCountries: []string{"jp"},
+		DeniedASNs:      []uint32{64496},
+	}
+	config.Set(conf)
+
+	err = loadIPPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := [...]struct {
+		name, ip, rule string
+	}{
+		{"no match", "198.18.0.1", ""},
+		{
+			name: "deny list",
+			ip:   "203.0.113.1",
+			rule: "deny list " + dir + "/deny:1 (203.0.113.0/24)",
+		},
+		{
+			name: "IPv6 deny list",
+			ip:   "2001:db8:1::1",
+			rule: "deny list " + dir + "/deny:3 (2001:db8:1::/48)",
+		},
+		{"country", "192.0.2.1", "country JP"},
+		{"allow list", "192.0.2.10", ""},
+		{"ASN", "198.51.100.1", "ASN 64496"},
+		{"allowed country", "2001:db8::1", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			test.AssertEquals(t, matchIPPolicy(net.ParseIP(c.ip)), c.rule)
+		})
+	}
+
+	t.Run("handler", func(t *testing.T) {
+		h := applyIPPolicy(func(w http.ResponseWriter, r *http.Request) {})
+		send := func(remote string) int {
+			r := httptest.NewRequest("POST", "/upload", nil)
+			r.RemoteAddr = remote
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			return rec.Code
+		}
+
+		test.AssertEquals(t, send("203.0.113.1:1234"), 403)
+		test.AssertEquals(t, send("198.18.0.1:1234"), 200)
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		ip := net.ParseIP("198.18.0.1")
+		path := config.Server.IPDenyLists[0]
+		rule := "deny list " + path + ":1 (198.18.0.0/15)"
+		modified := time.Now()
+		write := func(t *testing.T, content string) {
+			t.Helper()
+
+			err := ioutil.WriteFile(path, []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Ensure the modification time changes
+			modified = modified.Add(time.Hour)
+			err = os.Chtimes(path, modified, modified)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reloaded, err := reloadChangedIPPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, reloaded, false)
+
+		write(t, "198.18.0.0/15\n")
+		reloaded, err = reloadChangedIPPolicy()
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, reloaded, true)
+		test.AssertEquals(t, matchIPPolicy(ip), rule)
+		test.AssertEquals(t, matchIPPolicy(net.ParseIP("203.0.113.1")), "")
+
+		// Invalid files do not replace the loaded policy
+		write(t, "cirno\n")
+		_, err = reloadChangedIPPolicy()
+		if err == nil {
+			t.Fatal("invalid list loaded")
+		}
+		test.AssertEquals(t, matchIPPolicy(ip), rule)
+	})
+}
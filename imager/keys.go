@@ -0,0 +1,140 @@
+package imager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	uuid "github.com/satori/go.uuid"
+)
+
+// Maximum length of an upload request signature. Set by 4096 bit RSA keys.
+const maxSignatureLength = 512
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errKeyRevoked       = common.ErrAccessDenied("public key revoked")
+)
+
+// Evict cached public keys, as soon as they are revoked on any server instance
+func listenForRevocations(ctx context.Context) error {
+	return db.ListenPubKeyRevocations(
+		ctx,
+		func(pubID uuid.UUID) {
+			pubKeyCache.Delete(pubID)
+		},
+		// Revocations may have been missed while disconnected
+		pubKeyCache.Clear,
+	)
+}
+
+// Parse a DER-encoded public key and assert it is of the stored type
+func parsePublicKey(keyType db.KeyType, der []byte) (
+	key crypto.PublicKey,
+	err error,
+) {
+	key, err = x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		if keyType != db.RSAKey {
+			return
+		}
+
+		// Some older RSA keys are stored in PKCS #1 form
+		var pkcs1Err error
+		key, pkcs1Err = x509.ParsePKCS1PublicKey(der)
+		if pkcs1Err != nil {
+			return
+		}
+		err = nil
+	}
+
+	var ok bool
+	switch keyType {
+	case db.RSAKey:
+		_, ok = key.(*rsa.PublicKey)
+	case db.Ed25519Key:
+		_, ok = key.(ed25519.PublicKey)
+	case db.ECDSAP256Key:
+		var k *ecdsa.PublicKey
+		k, ok = key.(*ecdsa.PublicKey)
+		ok = ok && k.Curve == elliptic.P256()
+	default:
+		err = fmt.Errorf("unsupported public key type: %s", keyType)
+		return
+	}
+	if !ok {
+		err = fmt.Errorf("public key is not of type %s", keyType)
+	}
+	return
+}
+
+// Verify the signature of msg by key.
+//
+// RSA keys use PKCS #1 v1.5 signatures and ECDSA keys signatures either in
+// ASN.1 DER or raw r || s form, as produced by WebCrypto. Both sign the
+// SHA-256 hash of msg. Ed25519 keys sign msg directly.
+func verifySignature(key crypto.PublicKey, msg, sig []byte) (err error) {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(msg)
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig)
+		if err != nil {
+			err = errInvalidSignature
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, msg, sig) {
+			err = errInvalidSignature
+		}
+	case *ecdsa.PublicKey:
+		var r, s *big.Int
+		r, s, err = parseECDSASignature(key, sig)
+		if err != nil {
+			return
+		}
+		hash := sha256.Sum256(msg)
+		if !ecdsa.Verify(key, hash[:], r, s) {
+			err = errInvalidSignature
+		}
+	default:
+		err = fmt.Errorf("unsupported public key: %T", key)
+	}
+	return
+}
+
+// Parse an ECDSA signature in either raw r || s or ASN.1 DER form
+func parseECDSASignature(key *ecdsa.PublicKey, sig []byte) (
+	r, s *big.Int,
+	err error,
+) {
+	size := (key.Curve.Params().BitSize + 7) / 8
+	if len(sig) == size*2 {
+		r = new(big.Int).SetBytes(sig[:size])
+		s = new(big.Int).SetBytes(sig[size:])
+		return
+	}
+
+	var parsed struct {
+		R, S *big.Int
+	}
+	rest, err := asn1.Unmarshal(sig, &parsed)
+	if err != nil {
+		return
+	}
+	if len(rest) != 0 {
+		err = errInvalidSignature
+		return
+	}
+	r, s = parsed.R, parsed.S
+	return
+}
@@ -0,0 +1,249 @@
+package imager
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+func TestVerifySignature(t *testing.T) {
+	t.Parallel()
+
+	msg := []byte("public ID, nonce, timestamp and body hash")
+	digest := sha256.Sum256(msg)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecP384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkix := func(t *testing.T, key crypto.PublicKey) []byte {
+		t.Helper()
+
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	signECDSA := func(t *testing.T, raw bool) []byte {
+		t.Helper()
+
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if raw {
+			sig := make([]byte, 64)
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+			return sig
+		}
+		sig, err := asn1.Marshal(struct{ R, S interface{} }{r, s})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+
+	cases := [...]struct {
+		name    string
+		keyType db.KeyType
+		der     func(t *testing.T) []byte
+		sign    func(t *testing.T) []byte
+		parseOK bool
+	}{
+		{
+			name:    "RSA PKIX",
+			keyType: db.RSAKey,
+			der: func(t *testing.T) []byte {
+				return pkix(t, &rsaKey.PublicKey)
+			},
+			sign: func(t *testing.T) []byte {
+				sig, err := rsa.SignPKCS1v15(
+					rand.Reader,
+					rsaKey,
+					crypto.SHA256,
+					digest[:],
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			},
+			parseOK: true,
+		},
+		{
+			name:    "RSA PKCS1",
+			keyType: db.RSAKey,
+			der: func(t *testing.T) []byte {
+				return x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+			},
+			sign: func(t *testing.T) []byte {
+				sig, err := rsa.SignPKCS1v15(
+					rand.Reader,
+					rsaKey,
+					crypto.SHA256,
+					digest[:],
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return sig
+			},
+			parseOK: true,
+		},
+		{
+			name:    "Ed25519",
+			keyType: db.Ed25519Key,
+			der: func(t *testing.T) []byte {
+				return pkix(t, edPub)
+			},
+			sign: func(t *testing.T) []byte {
+				return ed25519.Sign(edPriv, msg)
+			},
+			parseOK: true,
+		},
+		{
+			name:    "ECDSA DER",
+			keyType: db.ECDSAP256Key,
+			der: func(t *testing.T) []byte {
+				return pkix(t, &ecKey.PublicKey)
+			},
+			sign: func(t *testing.T) []byte {
+				return signECDSA(t, false)
+			},
+			parseOK: true,
+		},
+		{
+			name:    "ECDSA raw",
+			keyType: db.ECDSAP256Key,
+			der: func(t *testing.T) []byte {
+				return pkix(t, &ecKey.PublicKey)
+			},
+			sign: func(t *testing.T) []byte {
+				return signECDSA(t, true)
+			},
+			parseOK: true,
+		},
+		{
+			name:    "type mismatch",
+			keyType: db.ECDSAP256Key,
+			der: func(t *testing.T) []byte {
+				return pkix(t, edPub)
+			},
+		},
+		{
+			name:    "unsupported curve",
+			keyType: db.ECDSAP256Key,
+			der: func(t *testing.T) []byte {
+				return pkix(t, &ecP384Key.PublicKey)
+			},
+		},
+		{
+			name:    "PKCS1 non-RSA",
+			keyType: db.Ed25519Key,
+			der: func(t *testing.T) []byte {
+				return x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey)
+			},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := parsePublicKey(c.keyType, c.der(t))
+			if !c.parseOK {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sig := c.sign(t)
+			err = verifySignature(key, msg, sig)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			sig[len(sig)/2]++
+			err = verifySignature(key, msg, sig)
+			if err == nil {
+				t.Fatal("tampered signature accepted")
+			}
+
+			err = verifySignature(key, []byte("other message"), c.sign(t))
+			test.AssertEquals(t, err, errInvalidSignature)
+		})
+	}
+}
+
+func TestRevokedKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := listenForRevocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, kp := test_db.InsertSampleThread(t)
+	validate := func() error {
+		req := httptest.NewRequest("POST", "/", strings.NewReader("id=abc"))
+		setAuthHeaders(t, req, kp)
+		_, err := validateUploader(httptest.NewRecorder(), req)
+		return err
+	}
+
+	// Cache the key
+	err = validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.RevokePubKey(ctx, kp.PubID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err = validate()
+		if err == errKeyRevoked || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	test.AssertEquals(t, err, errKeyRevoked)
+}
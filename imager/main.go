@@ -21,8 +21,52 @@ import (
 
 func main() {
 	err := func() (err error) {
-		_, err = flags.Parse(&config.Server)
-		if err != nil {
+		parser := flags.NewParser(&config.Server, flags.Default)
+		parser.SubcommandsOptional = true
+		for _, c := range [...]struct {
+			name, short, long string
+			data              interface{}
+		}{
+			{
+				"regenerate-thumbnails",
+				"regenerate thumbnails of all stored images",
+				"Regenerate thumbnails of all stored images with the current " +
+					"thumbnailing settings. Resumes after interruption.",
+				&regenerateThumbnailsCommand{},
+			},
+			{
+				"import",
+				"import files from a directory or JSON manifest",
+				"Process and store files from a directory or a JSON manifest " +
+					"of file paths. Already stored files are skipped. Writes " +
+					"a JSON report mapping input paths to SHA1 hashes.",
+				&importCommand{},
+			},
+			{
+				"export",
+				"export stored images as a backup archive",
+				"Write image records and files as a tar or zstd compressed " +
+					"tar archive. Can be incremental since an image ID or " +
+					"timestamp.",
+				&exportCommand{},
+			},
+			{
+				"restore",
+				"restore images from a backup archive",
+				"Restore image records and files from an archive written by " +
+					"the export command. File hashes are verified and " +
+					"already stored images are skipped.",
+				&restoreCommand{},
+			},
+		} {
+			_, err = parser.AddCommand(c.name, c.short, c.long, c.data)
+			if err != nil {
+				return
+			}
+		}
+		_, err = parser.Parse()
+		if err != nil || parser.Active != nil {
+			// Commands are executed during parsing
 			return
 		}
 
@@ -32,19 +76,60 @@ func main() {
 			arg := os.Args[i]
 			// To match all of -d --d -database --database
 			if strings.HasSuffix(arg, "-d") ||
-				strings.HasSuffix(arg, "-database") {
+				strings.HasSuffix(arg, "-database") ||
+				strings.HasSuffix(arg, "-admin-token") {
 				args = append(args, arg, "****")
-				i++ // Jump to args after password
+				i++ // Jump to args after secret
 			} else {
 				args = append(args, arg)
 			}
 		}
 		gspt.SetProcTitle(strings.Join(args, " "))
 
+		logMissingFFTools()
+
+		err = loadTrustedProxies()
+		if err != nil {
+			return
+		}
+		err = loadIPPolicy()
+		if err != nil {
+			return
+		}
+
 		err = parallel(db.LoadDB, assets.CreateDirs)
 		if err != nil {
 			return
 		}
+		err = checkFFTools(config.Get().Public.Uploads.Media, ffTools)
+		if err != nil {
+			return
+		}
+		err = listenForRevocations(context.Background())
+		if err != nil {
+			return
+		}
+		if config.Get().Public.EnableAntispam {
+			// Start populating the captcha pool before the first request
+			getCaptchaSource()
+		}
+
+		go db.RunCleanupTasks(context.Background())
+		go func() {
+			// Legacy images are looked up by SHA1 until backfilled
+			err := db.BackfillSHA256(context.Background())
+			if err != nil {
+				log.Println(err)
+			}
+		}()
+		go watchIPPolicy(context.Background())
+		if config.Server.ScrubBandwidth > 0 {
+			go runScrubber(
+				context.Background(),
+				config.Server.ScrubBandwidth,
+				config.Server.ScrubQuarantine,
+			)
+		}
 
 		return startWebServer()
 	}()
@@ -91,8 +176,37 @@ func startWebServer() (err error) {
 		}
 	}
 
-	http.Handle("/upload", postOnly(NewImageUpload))
-	http.Handle("/upload-hash", postOnly(UploadImageHash))
+	getOnly := func(inner http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				w.WriteHeader(405)
+				return
+			}
+			inner(w, r)
+		}
+	}
+
+	// Uploads are subject to the IP policy and rate limits
+	upload := func(inner http.HandlerFunc) http.HandlerFunc {
+		return postOnly(applyIPPolicy(limitByIP(inner)))
+	}
+
+	http.Handle("/upload", upload(NewImageUpload))
+	http.Handle("/upload-hash", upload(UploadImageHash))
+	http.Handle("/upload-url", upload(UploadImageURL))
+	http.Handle("/captcha/new", getOnly(NewCaptcha))
+	http.Handle("/captcha/solve", postOnly(SolveCaptcha))
+	http.Handle("/pow/challenge", postOnly(PoWChallenge))
+	http.Handle("/moderation/spoiler-image", postOnly(SpoilerImage))
+	http.Handle("/moderation/delete-image", postOnly(DeleteImage))
+	http.Handle("/moderation/purge-image", postOnly(PurgeImage))
+	http.Handle("/moderation/uploads", postOnly(UploadAudit))
+	http.Handle("/moderation/ban", postOnly(BanUploader))
+	http.Handle("/moderation/unban", postOnly(LiftBan))
+	http.Handle("/admin/scrub/progress", getOnly(adminOnly(ScrubProgress)))
+	http.Handle("/admin/scrub/results", getOnly(adminOnly(ScrubResults)))
+	http.Handle("/admin/keys/revoke", postOnly(adminOnly(RevokePubKey)))
+	http.Handle("/admin/staff", postOnly(adminOnly(SetStaffLevel)))
 	http.Handle(
 		"/health-check",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,194 @@
+package imager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/thumbnailer/v2"
+)
+
+// Constraints on uploaded audio and video files
+type mediaConstraints struct {
+	config.MediaConstraints
+
+	// Reject videos with audio streams
+	forbidVideoAudio bool
+}
+
+// Create a media constraint violation error
+func errMediaConstraint(format string, args ...interface{}) error {
+	return common.StatusError{
+		Err:  fmt.Errorf(format, args...),
+		Code: 400,
+	}
+}
+
+// Validate an audio or video file against the configured constraints.
+// img must already have its file type, streams, duration and size populated.
+func (c *mediaConstraints) check(
+	rs io.ReadSeeker,
+	img *common.ImageCommon,
+	length time.Duration,
+) (err error) {
+	cat := fileCategory(img)
+	switch cat {
+	case config.Video, config.Audio:
+	default:
+		return
+	}
+
+	if c.forbidVideoAudio && cat == config.Video && img.Video && img.Audio {
+		return errMediaConstraint("videos with audio not allowed on this board")
+	}
+	if c.MaxDuration != 0 && img.Duration > c.MaxDuration {
+		return errMediaConstraint(
+			"duration of %ds exceeds maximum of %ds",
+			img.Duration,
+			c.MaxDuration,
+		)
+	}
+	if c.MaxBitrate != 0 && length > 0 {
+		rate := uint64(float64(img.Size) * 8 / 1000 / length.Seconds())
+		if rate > c.MaxBitrate {
+			return errMediaConstraint(
+				"bitrate of %dkbit/s exceeds maximum of %dkbit/s",
+				rate,
+				c.MaxBitrate,
+			)
+		}
+	}
+
+	buf, _ := img.FileType.MarshalText()
+	container := string(buf)
+	allowedVideo, checkVideo := c.VideoCodecs[container]
+	allowedAudio, checkAudio := c.AudioCodecs[container]
+
+	// Video streams in audio files are cover art
+	checkVideo = checkVideo && cat == config.Video && img.Video
+	checkAudio = checkAudio && img.Audio
+	if checkVideo || checkAudio {
+		_, err = rs.Seek(0, io.SeekStart)
+		if err != nil {
+			return
+		}
+		var ctx *thumbnailer.FFContext
+		ctx, err = thumbnailer.NewFFContext(rs)
+		if err != nil {
+			return
+		}
+		defer ctx.Close()
+
+		checkCodec := func(
+			typ thumbnailer.FFMediaType,
+			kind string,
+			allowed []string,
+		) (err error) {
+			codec, err := ctx.CodecName(typ)
+			if err != nil {
+				return
+			}
+			for _, a := range allowed {
+				if a == codec {
+					return
+				}
+			}
+			return errMediaConstraint(
+				"%s codec %s not allowed in %s files",
+				kind,
+				codec,
+				container,
+			)
+		}
+
+		if checkVideo {
+			err = checkCodec(thumbnailer.FFVideo, "video", allowedVideo)
+			if err != nil {
+				return
+			}
+		}
+		if checkAudio {
+			err = checkCodec(thumbnailer.FFAudio, "audio", allowedAudio)
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	if c.MaxFrameRate != 0 && cat == config.Video && img.Video {
+		var rate float64
+		rate, err = frameRate(rs)
+		if err != nil {
+			return
+		}
+		if rate > c.MaxFrameRate {
+			return errMediaConstraint(
+				"frame rate of %.2ffps exceeds maximum of %.2ffps",
+				rate,
+				c.MaxFrameRate,
+			)
+		}
+	}
+
+	return
+}
+
+// Read the average frame rate of the first video stream of a file.
+//
+// Requires the ffprobe executable. If it is not installed, errNoFFprobe is
+// returned.
+func frameRate(rs io.ReadSeeker) (rate float64, err error) {
+	if !ffTools.ffprobe {
+		err = errNoFFprobe
+		return
+	}
+
+	path, cleanup, err := sourcePath(rs)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "v:0",
+		"-show_entries", "stream=avg_frame_rate",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		path,
+	).
+		Output()
+	if err != nil {
+		return
+	}
+	return parseFrameRate(strings.TrimSpace(string(out)))
+}
+
+// Parse a frame rate in FFmpeg's rational number format, like "30000/1001".
+// Unknown frame rates are reported as "0/0" and return 0.
+func parseFrameRate(s string) (rate float64, err error) {
+	i := strings.IndexByte(s, '/')
+	if i == -1 {
+		return strconv.ParseFloat(s, 64)
+	}
+	num, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return
+	}
+	den, err := strconv.ParseFloat(s[i+1:], 64)
+	if err != nil || den == 0 {
+		return
+	}
+	rate = num / den
+	return
+}
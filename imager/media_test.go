@@ -0,0 +1,181 @@
+package imager
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestParseFrameRate(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		in   string
+		rate float64
+	}{
+		{"30/1", 30},
+		{"30000/1001", 30000.0 / 1001},
+		{"0/0", 0},
+		{"25", 25},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.in, func(t *testing.T) {
+			t.Parallel()
+
+			rate, err := parseFrameRate(c.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.AssertEquals(t, rate, c.rate)
+		})
+	}
+}
+
+func TestMediaConstraints(t *testing.T) {
+	t.Parallel()
+
+	video := common.ImageCommon{
+		FileType: common.WEBM,
+		Video:    true,
+		Audio:    true,
+		Duration: 60,
+		Size:     1 << 20,
+	}
+
+	cases := [...]struct {
+		name        string
+		img         common.ImageCommon
+		constraints mediaConstraints
+		fail        bool
+	}{
+		{
+			name: "no constraints",
+			img:  video,
+		},
+		{
+			name: "duration within limit",
+			img:  video,
+			constraints: mediaConstraints{
+				MediaConstraints: config.MediaConstraints{
+					MaxDuration: 60,
+				},
+			},
+		},
+		{
+			name: "duration exceeded",
+			img:  video,
+			constraints: mediaConstraints{
+				MediaConstraints: config.MediaConstraints{
+					MaxDuration: 59,
+				},
+			},
+			fail: true,
+		},
+		{
+			name: "bitrate exceeded",
+			img:  video,
+			constraints: mediaConstraints{
+				MediaConstraints: config.MediaConstraints{
+					MaxBitrate: 100,
+				},
+			},
+			fail: true,
+		},
+		{
+			name: "audio in video forbidden",
+			img:  video,
+			constraints: mediaConstraints{
+				forbidVideoAudio: true,
+			},
+			fail: true,
+		},
+		{
+			name: "audio file on board forbidding audio in videos",
+			img: common.ImageCommon{
+				FileType: common.MP3,
+				Audio:    true,
+				Duration: 60,
+			},
+			constraints: mediaConstraints{
+				forbidVideoAudio: true,
+			},
+		},
+		{
+			name: "not media",
+			img: common.ImageCommon{
+				FileType: common.PNG,
+			},
+			constraints: mediaConstraints{
+				MediaConstraints: config.MediaConstraints{
+					MaxDuration: 1,
+					MaxBitrate:  1,
+				},
+				forbidVideoAudio: true,
+			},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := c.constraints.check(
+				bytes.NewReader(nil),
+				&c.img,
+				time.Duration(c.img.Duration)*time.Second,
+			)
+			switch {
+			case c.fail && err == nil:
+				t.Fatal("expected error")
+			case c.fail:
+				test.AssertEquals(t, err.(common.StatusError).Code, 400)
+			case err != nil:
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckFFTools(t *testing.T) {
+	t.Parallel()
+
+	limited := config.MediaConstraints{MaxFrameRate: 30}
+	cases := [...]struct {
+		name  string
+		media config.MediaConstraints
+		tools ffToolSet
+		fail  bool
+	}{
+		{
+			name: "no frame rate limit",
+		},
+		{
+			name:  "frame rate limit",
+			media: limited,
+			tools: ffToolSet{ffprobe: true},
+		},
+		{
+			name:  "frame rate limit without ffprobe",
+			media: limited,
+			tools: ffToolSet{ffmpeg: true},
+			fail:  true,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			err := checkFFTools(c.media, c.tools)
+			test.AssertEquals(t, err != nil, c.fail)
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package imager
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/jackc/pgx/v4"
+	uuid "github.com/satori/go.uuid"
+)
+
+var (
+	errInsufficientLevel = common.ErrAccessDenied("insufficient staff level")
+	errNoAttachment      = common.StatusError{
+		Err:  errors.New("no such attachment"),
+		Code: 404,
+	}
+	errUnknownImage = common.StatusError{
+		Err:  errors.New("unknown image"),
+		Code: 404,
+	}
+
+	// Minimum staff levels required to perform moderation actions
+	requiredModLevels = map[common.ModerationAction]common.ModerationLevel{
+		common.SpoilerImage: common.Janitor,
+		common.DeleteImage:  common.Janitor,
+		common.PurgeImage:   common.Moderator,
+		common.BanPost:      common.Moderator,
+		common.UnbanPost:    common.Moderator,
+	}
+)
+
+// Verify the request signature of a staff member and ensure it has at least
+// the required level. Parses and verifies the request form.
+func authenticateStaff(
+	w http.ResponseWriter,
+	r *http.Request,
+	required common.ModerationLevel,
+) (pubKey uint64, err error) {
+	pubKey, err = authenticateUploader(r)
+	if err != nil {
+		return
+	}
+	level, err := db.GetStaffLevel(r.Context(), pubKey)
+	if err != nil {
+		return
+	}
+	if required == common.NotStaff || level < required {
+		err = errInsufficientLevel
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	err = r.ParseForm()
+	if err != nil {
+		err = bodyError(err)
+		return
+	}
+	err = verifyBody(r)
+	return
+}
+
+// SpoilerImage spoilers the file attached to the post in the post form field
+// at the position in the position form field
+func SpoilerImage(w http.ResponseWriter, r *http.Request) {
+	moderateAttachment(w, r, common.SpoilerImage, db.SpoilerImage)
+}
+
+// DeleteImage removes the file attached to the post in the post form field at
+// the position in the position form field from the post
+func DeleteImage(w http.ResponseWriter, r *http.Request) {
+	moderateAttachment(w, r, common.DeleteImage, db.DeleteImage)
+}
+
+// Perform a moderation action on a single post attachment and log it
+func moderateAttachment(
+	w http.ResponseWriter,
+	r *http.Request,
+	action common.ModerationAction,
+	fn func(
+		ctx context.Context,
+		tx pgx.Tx,
+		post uint64,
+		position uint,
+	) (common.SHA256Hash, error),
+) {
+	handleError(w, r, func() (err error) {
+		pubKey, err := authenticateStaff(w, r, requiredModLevels[action])
+		if err != nil {
+			return
+		}
+
+		var (
+			post     uint64
+			position uint64
+		)
+		err = common.WrapError(400, func() (err error) {
+			post, err = strconv.ParseUint(r.FormValue("post"), 10, 64)
+			if err != nil {
+				return
+			}
+			position, err = strconv.ParseUint(r.FormValue("position"), 10, 15)
+			return
+		})
+		if err != nil {
+			return
+		}
+
+		err = db.InTransaction(r.Context(), func(tx pgx.Tx) (err error) {
+			img, err := fn(r.Context(), tx, post, uint(position))
+			switch err {
+			case nil:
+			case pgx.ErrNoRows:
+				return errNoAttachment
+			default:
+				return
+			}
+			return db.LogModeration(
+				r.Context(),
+				tx,
+				action,
+				post,
+				pubKey,
+				img.String(),
+			)
+		})
+		if err != nil {
+			return
+		}
+		w.WriteHeader(204)
+		return
+	})
+}
+
+// PurgeImage removes the file with the SHA-256 hash in the id form field from
+// all posts and deletes it from storage
+func PurgeImage(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		pubKey, err := authenticateStaff(
+			w,
+			r,
+			requiredModLevels[common.PurgeImage],
+		)
+		if err != nil {
+			return
+		}
+
+		var id common.SHA256Hash
+		err = id.UnmarshalText([]byte(r.FormValue("id")))
+		if err != nil {
+			return common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+
+		var img common.ImageCommon
+		err = db.InTransaction(r.Context(), func(tx pgx.Tx) (err error) {
+			img, err = db.PurgeImage(r.Context(), tx, id)
+			switch err {
+			case nil:
+			case pgx.ErrNoRows:
+				return errUnknownImage
+			default:
+				return
+			}
+			return db.LogModeration(
+				r.Context(),
+				tx,
+				common.PurgeImage,
+				0,
+				pubKey,
+				id.String(),
+			)
+		})
+		if err != nil {
+			return
+		}
+
+		err = assets.Delete(img.SHA256, img.FileType, img.ThumbType)
+		if err != nil {
+			return
+		}
+		w.WriteHeader(204)
+		return
+	})
+}
+
+// SetStaffLevel sets the staff level of the public key with the public ID in
+// the id form field to the level in the level form field. An empty level
+// removes the key from staff.
+func SetStaffLevel(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		var (
+			pubID uuid.UUID
+			level common.ModerationLevel
+		)
+		err = common.WrapError(400, func() (err error) {
+			pubID, err = uuid.FromString(r.FormValue("id"))
+			if err != nil {
+				return
+			}
+			return level.UnmarshalText([]byte(r.FormValue("level")))
+		})
+		if err != nil {
+			return
+		}
+
+		key, err := db.GetPubKey(pubID)
+		switch err {
+		case nil:
+		case pgx.ErrNoRows:
+			return common.StatusError{
+				Err:  errors.New("unknown public key ID"),
+				Code: 404,
+			}
+		default:
+			return
+		}
+		err = db.SetStaffLevel(r.Context(), key.ID, level)
+		if err != nil {
+			return
+		}
+		w.WriteHeader(204)
+		return
+	})
+}
@@ -0,0 +1,88 @@
+package imager
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+func TestModerationLevels(t *testing.T) {
+	post, kp := test_db.InsertSampleThread(t)
+
+	send := func(t *testing.T, h http.HandlerFunc, form url.Values) int {
+		t.Helper()
+
+		body := strings.NewReader(form.Encode())
+		req := httptest.NewRequest("POST", "/", body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		setAuthHeaders(t, req, kp)
+		rec := httptest.NewRecorder()
+		h(rec, req)
+		return rec.Code
+	}
+	setLevel := func(t *testing.T, level common.ModerationLevel) {
+		t.Helper()
+
+		err := db.SetStaffLevel(context.Background(), kp.ID, level)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	attachment := url.Values{
+		"post":     {strconv.FormatUint(post, 10)},
+		"position": {"0"},
+	}
+	purge := url.Values{
+		"id": {strings.Repeat("ab", 32)},
+	}
+	ban := url.Values{
+		"ip":     {"192.0.2.0/24"},
+		"reason": {"spam"},
+	}
+	unban := url.Values{
+		"id": {"0"},
+	}
+
+	t.Run("not staff", func(t *testing.T) {
+		test.AssertEquals(t, send(t, SpoilerImage, attachment), 403)
+		test.AssertEquals(t, send(t, DeleteImage, attachment), 403)
+		test.AssertEquals(t, send(t, PurgeImage, purge), 403)
+		test.AssertEquals(t, send(t, BanUploader, ban), 403)
+		test.AssertEquals(t, send(t, LiftBan, unban), 403)
+	})
+
+	t.Run("janitor", func(t *testing.T) {
+		setLevel(t, common.Janitor)
+		defer setLevel(t, common.NotStaff)
+
+		// Post has no attachments
+		test.AssertEquals(t, send(t, SpoilerImage, attachment), 404)
+		test.AssertEquals(t, send(t, DeleteImage, attachment), 404)
+		test.AssertEquals(t, send(t, PurgeImage, purge), 403)
+		test.AssertEquals(t, send(t, BanUploader, ban), 403)
+		test.AssertEquals(t, send(t, LiftBan, unban), 403)
+	})
+
+	t.Run("moderator", func(t *testing.T) {
+		setLevel(t, common.Moderator)
+		defer setLevel(t, common.NotStaff)
+
+		test.AssertEquals(t, send(t, PurgeImage, purge), 404)
+		test.AssertEquals(
+			t,
+			send(t, PurgeImage, url.Values{"id": {"cirno"}}),
+			400,
+		)
+		test.AssertEquals(t, send(t, LiftBan, unban), 404)
+	})
+}
@@ -0,0 +1,180 @@
+package imager
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// Time a proof-of-work challenge can be solved within
+	powChallengeTTL = 5 * time.Minute
+
+	// Maximum length of a proof-of-work solution nonce
+	maxPoWNonceLength = 64
+)
+
+var (
+	errPoWRequired = common.ErrAccessDenied("proof of work required")
+	errInvalidPoW  = common.ErrAccessDenied("invalid proof of work")
+)
+
+// Proof-of-work challenge issued to an uploader
+type powChallenge struct {
+	Challenge  []byte    `json:"challenge"`
+	Difficulty uint8     `json:"difficulty"`
+	Expires    time.Time `json:"expires"`
+}
+
+// PoWChallenge issues a proof-of-work challenge bound to the public key of the
+// uploader. To solve it, the uploader must find a nonce, such that the SHA-256
+// hash of the challenge followed by the nonce has at least difficulty leading
+// zero bits. The solution is sent with the next upload in the X-PoW-Challenge
+// and X-PoW-Nonce headers. Uploads with a solution need no recently solved
+// captcha.
+func PoWChallenge(w http.ResponseWriter, r *http.Request) {
+	handleError(w, r, func() (err error) {
+		conf := config.Get().Public.ProofOfWork
+		if !conf.Enabled {
+			return common.StatusError{
+				Err:  errors.New("proof of work disabled"),
+				Code: 404,
+			}
+		}
+
+		// Not validateUploader, as challenges are solved instead of captchas
+		pubKey, err := admitUploader(w, r)
+		if err != nil {
+			return
+		}
+		err = verifyBody(r)
+		if err != nil {
+			return
+		}
+
+		var c [32]byte
+		_, err = rand.Read(c[:])
+		if err != nil {
+			return
+		}
+		difficulty, err := powDifficulty(r.Context(), conf, pubKey)
+		if err != nil {
+			return
+		}
+		expires := time.Now().Add(powChallengeTTL)
+		err = db.InsertPoWChallenge(r.Context(), c, pubKey, difficulty, expires)
+		if err != nil {
+			return
+		}
+		return serveJSON(w, powChallenge{
+			Challenge:  c[:],
+			Difficulty: difficulty,
+			Expires:    expires,
+		})
+	})
+}
+
+// Compute the challenge difficulty for pubKey from its recent upload volume
+// and the current server load
+func powDifficulty(
+	ctx context.Context,
+	conf config.ProofOfWork,
+	pubKey uint64,
+) (difficulty uint8, err error) {
+	var uploads uint
+	if conf.UploadsPerBit != 0 {
+		uploads, err = db.CountRecentUploads(
+			ctx,
+			pubKey,
+			time.Duration(conf.UploadWindow)*time.Second,
+		)
+		if err != nil {
+			return
+		}
+	}
+	difficulty = conf.Difficulty(uploads, thumbnailingQueueLength())
+	return
+}
+
+// Verify the solution to a proof-of-work challenge issued to pubKey, if
+// proof-of-work is enabled. The challenge is consumed in either case.
+func verifyPoW(r *http.Request, pubKey uint64) (err error) {
+	if !config.Get().Public.ProofOfWork.Enabled {
+		return
+	}
+
+	var (
+		challenge [32]byte
+		nonce     []byte
+	)
+	if r.Header.Get("X-PoW-Challenge") == "" {
+		return errPoWRequired
+	}
+	err = common.WrapError(400, func() (err error) {
+		n, err := base64.StdEncoding.Decode(
+			challenge[:],
+			[]byte(r.Header.Get("X-PoW-Challenge")),
+		)
+		if err != nil {
+			return
+		}
+		if n != len(challenge) {
+			return fmt.Errorf("invalid X-PoW-Challenge length: %d", n)
+		}
+
+		nonce, err = base64.StdEncoding.DecodeString(
+			r.Header.Get("X-PoW-Nonce"),
+		)
+		if err != nil {
+			return
+		}
+		if len(nonce) > maxPoWNonceLength {
+			return fmt.Errorf("invalid X-PoW-Nonce length: %d", len(nonce))
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+
+	difficulty, err := db.UsePoWChallenge(r.Context(), challenge, pubKey)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows:
+		return errInvalidPoW
+	default:
+		return
+	}
+	if !checkPoW(challenge, nonce, difficulty) {
+		return errInvalidPoW
+	}
+	return
+}
+
+// Return, if the SHA-256 hash of challenge followed by nonce has at least
+// difficulty leading zero bits
+func checkPoW(challenge [32]byte, nonce []byte, difficulty uint8) bool {
+	h := sha256.New()
+	h.Write(challenge[:])
+	h.Write(nonce)
+
+	var zeros int
+	for _, b := range h.Sum(nil) {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros >= int(difficulty)
+}
@@ -0,0 +1,195 @@
+package imager
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+// Find a nonce solving a proof-of-work challenge
+func solvePoW(challenge [32]byte, difficulty uint8) []byte {
+	nonce := make([]byte, 8)
+	for i := uint64(0); ; i++ {
+		binary.LittleEndian.PutUint64(nonce, i)
+		if checkPoW(challenge, nonce, difficulty) {
+			return nonce
+		}
+	}
+}
+
+func TestCheckPoW(t *testing.T) {
+	t.Parallel()
+
+	var challenge [32]byte
+	copy(challenge[:], "patchouli knowledge")
+
+	for _, d := range [...]uint8{0, 1, 8, 12} {
+		nonce := solvePoW(challenge, d)
+		test.AssertEquals(t, checkPoW(challenge, nonce, d), true)
+	}
+
+	// Practically impossible to solve by chance
+	test.AssertEquals(t, checkPoW(challenge, []byte("cirno"), 64), false)
+}
+
+func TestPoWDifficulty(t *testing.T) {
+	t.Parallel()
+
+	conf := config.ProofOfWork{
+		BaseDifficulty: 16,
+		MaxDifficulty:  20,
+		UploadsPerBit:  5,
+		QueuedPerBit:   10,
+	}
+	cases := [...]struct {
+		name            string
+		conf            config.ProofOfWork
+		uploads, queued uint
+		difficulty      uint8
+	}{
+		{"base", conf, 0, 0, 16},
+		{"below step", conf, 4, 9, 16},
+		{"recent uploads", conf, 10, 0, 18},
+		{"server load", conf, 0, 20, 18},
+		{"both", conf, 5, 10, 18},
+		{"capped", conf, 100, 100, 20},
+		{
+			name: "no scaling",
+			conf: config.ProofOfWork{
+				BaseDifficulty: 10,
+			},
+			uploads:    100,
+			queued:     100,
+			difficulty: 10,
+		},
+		{
+			name: "no cap",
+			conf: config.ProofOfWork{
+				BaseDifficulty: 250,
+				UploadsPerBit:  1,
+			},
+			uploads:    100,
+			difficulty: 255,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := c.conf.Difficulty(c.uploads, c.queued)
+			test.AssertEquals(t, d, c.difficulty)
+		})
+	}
+}
+
+func TestPoWChallenge(t *testing.T) {
+	conf := *config.Get()
+	defer config.Set(conf)
+	conf.Public.EnableAntispam = true
+	conf.Public.ProofOfWork = config.ProofOfWork{
+		Enabled:        true,
+		BaseDifficulty: 8,
+	}
+	config.Set(conf)
+
+	_, kp := test_db.InsertSampleThread(t)
+
+	issue := func(t *testing.T) (c powChallenge) {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+		setAuthHeaders(t, req, kp)
+		rec := httptest.NewRecorder()
+		PoWChallenge(rec, req)
+		test.AssertEquals(t, rec.Code, 200)
+		err := json.NewDecoder(rec.Body).Decode(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, c.Difficulty, uint8(8))
+		return
+	}
+	verify := func(t *testing.T, challenge [32]byte, nonce []byte) error {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/", nil)
+		enc := base64.StdEncoding.EncodeToString
+		req.Header.Set("X-PoW-Challenge", enc(challenge[:]))
+		req.Header.Set("X-PoW-Nonce", enc(nonce))
+		return verifyPoW(req, kp.ID)
+	}
+
+	t.Run("no solution", func(t *testing.T) {
+		err := verifyPoW(httptest.NewRequest("POST", "/", nil), kp.ID)
+		test.AssertEquals(t, err, errPoWRequired)
+	})
+
+	t.Run("valid solution", func(t *testing.T) {
+		var challenge [32]byte
+		copy(challenge[:], issue(t).Challenge)
+		nonce := solvePoW(challenge, 8)
+
+		err := verify(t, challenge, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Challenges can only be used once
+		err = verify(t, challenge, nonce)
+		test.AssertEquals(t, err, errInvalidPoW)
+	})
+
+	t.Run("invalid solution", func(t *testing.T) {
+		var challenge [32]byte
+		copy(challenge[:], issue(t).Challenge)
+		nonce := solvePoW(challenge, 8)
+		for checkPoW(challenge, nonce, 8) {
+			nonce[0]++
+		}
+
+		err := verify(t, challenge, nonce)
+		test.AssertEquals(t, err, errInvalidPoW)
+	})
+
+	t.Run("upload without captcha", func(t *testing.T) {
+		upload := func(t *testing.T, solve bool) error {
+			t.Helper()
+
+			req := httptest.NewRequest("POST", "/", strings.NewReader(""))
+			if solve {
+				var challenge [32]byte
+				copy(challenge[:], issue(t).Challenge)
+				enc := base64.StdEncoding.EncodeToString
+				req.Header.Set("X-PoW-Challenge", enc(challenge[:]))
+				req.Header.Set(
+					"X-PoW-Nonce",
+					enc(solvePoW(challenge, 8)),
+				)
+			}
+			setAuthHeaders(t, req, kp)
+			_, err := validateUploader(httptest.NewRecorder(), req)
+			return err
+		}
+
+		test.AssertEquals(t, upload(t, false), error(errPoWRequired))
+		if err := upload(t, true); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("unknown challenge", func(t *testing.T) {
+		var challenge [32]byte
+		copy(challenge[:], "reimu")
+		err := verify(t, challenge, solvePoW(challenge, 8))
+		test.AssertEquals(t, err, errInvalidPoW)
+	})
+}
@@ -0,0 +1,244 @@
+package imager
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+)
+
+// Time after which idle client budgets are dropped
+const rateLimitIdleTimeout = 10 * time.Minute
+
+var (
+	errRateLimited = common.StatusError{
+		Err:  errors.New("rate limit exceeded"),
+		Code: 429,
+	}
+	errLengthRequired = common.StatusError{
+		Err:  errors.New("Content-Length required"),
+		Code: 411,
+	}
+
+	// Upload budgets of client IPs and public keys
+	ipLimits  = newRateLimiter()
+	keyLimits = newRateLimiter()
+)
+
+// Token bucket, that refills to its capacity in one minute
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take n tokens from a bucket with the given capacity. Returns the time to wait
+// before retrying, if there are not enough tokens. Amounts larger than the
+// capacity are taken from a full bucket and leave it in debt.
+func (b *tokenBucket) take(n, capacity float64, now time.Time) (
+	retryAfter time.Duration,
+) {
+	rate := b.refill(capacity, now)
+	need := math.Min(n, capacity)
+	if b.tokens < need {
+		return time.Duration((need - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens -= n
+	return 0
+}
+
+// Take n tokens from a bucket with the given capacity unconditionally, which
+// can leave it in debt
+func (b *tokenBucket) debit(n, capacity float64, now time.Time) {
+	b.refill(capacity, now)
+	b.tokens -= n
+}
+
+// Refill the bucket with tokens accrued since the last access and return the
+// refill rate per second
+func (b *tokenBucket) refill(capacity float64, now time.Time) (rate float64) {
+	rate = capacity / 60
+	if b.last.IsZero() {
+		b.tokens = capacity
+	} else {
+		b.tokens = math.Min(
+			capacity,
+			b.tokens+now.Sub(b.last).Seconds()*rate,
+		)
+	}
+	b.last = now
+	return
+}
+
+// Request and byte budgets of a single client
+type clientBudget struct {
+	requests, bytes tokenBucket
+}
+
+// Token bucket rate limits keyed by client
+type rateLimiter struct {
+	mu sync.Mutex
+	m  map[interface{}]*clientBudget
+}
+
+// Create new rateLimiter and start eviction scheduler.
+//
+// Must never become unreachable or will result in a memory leak.
+func newRateLimiter() (l *rateLimiter) {
+	l = &rateLimiter{
+		m: make(map[interface{}]*clientBudget),
+	}
+
+	go func() {
+		for {
+			time.Sleep(time.Minute)
+
+			threshold := time.Now().Add(-rateLimitIdleTimeout)
+			l.mu.Lock()
+			for k, b := range l.m {
+				if b.requests.last.Before(threshold) &&
+					b.bytes.last.Before(threshold) {
+					delete(l.m, k)
+				}
+			}
+			l.mu.Unlock()
+		}
+	}()
+
+	return
+}
+
+// Charge a request uploading size bytes against the budget of client. Returns
+// the time to wait before retrying, if the budget is exceeded.
+func (l *rateLimiter) take(
+	client interface{},
+	limit config.RateLimit,
+	size uint64,
+) (retryAfter time.Duration) {
+	if limit.Requests == 0 && limit.Size == 0 {
+		return
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.get(client)
+	if limit.Requests != 0 {
+		retryAfter = b.requests.take(1, float64(limit.Requests), now)
+		if retryAfter != 0 {
+			return
+		}
+	}
+	if limit.Size != 0 && size != 0 {
+		retryAfter = b.bytes.take(float64(size), limit.Size*(1<<20), now)
+		if retryAfter != 0 && limit.Requests != 0 {
+			// Refund the rejected request
+			b.requests.tokens++
+		}
+	}
+	return
+}
+
+// Charge size bytes transferred after a request was admitted against the
+// budget of client. The budget can be left in debt.
+func (l *rateLimiter) charge(
+	client interface{},
+	limit config.RateLimit,
+	size uint64,
+) {
+	if limit.Size == 0 || size == 0 {
+		return
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.get(client).bytes.debit(float64(size), limit.Size*(1<<20), now)
+}
+
+// Return the budget of client, creating it, if none. Requires lock.
+func (l *rateLimiter) get(client interface{}) *clientBudget {
+	b := l.m[client]
+	if b == nil {
+		b = new(clientBudget)
+		l.m[client] = b
+	}
+	return b
+}
+
+// Return the key for limiting the client IP of a request. IPv6 clients are
+// limited per /64 subnet, as they are commonly assigned a whole subnet.
+func ipLimitKey(r *http.Request) string {
+	ip := clientIP(r)
+	if len(ip) == net.IPv6len {
+		ip = ip.Mask(net.CIDRMask(64, 128))
+	}
+	return ip.String()
+}
+
+// Return the declared size of the request body. The server does not read
+// more than the declared size.
+func requestSize(r *http.Request) uint64 {
+	if r.ContentLength > 0 {
+		return uint64(r.ContentLength)
+	}
+	return 0
+}
+
+// Set the Retry-After header of a rate limited response
+func setRetryAfter(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set(
+		"Retry-After",
+		strconv.Itoa(int(math.Ceil(wait.Seconds()))),
+	)
+}
+
+// Limit upload requests by client IP. Request bodies of unknown length are
+// rejected, as they can not be charged before reading.
+func limitByIP(inner http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength < 0 {
+			http.Error(w, errLengthRequired.Error(), 411)
+			return
+		}
+		wait := ipLimits.take(
+			ipLimitKey(r),
+			config.Get().RateLimits.IP,
+			requestSize(r),
+		)
+		if wait != 0 {
+			setRetryAfter(w, wait)
+			http.Error(w, errRateLimited.Error(), 429)
+			return
+		}
+		inner(w, r)
+	}
+}
+
+// Charge an upload request against the budget of a public key
+func limitByKey(w http.ResponseWriter, r *http.Request, pubKey uint64) error {
+	if r.ContentLength < 0 {
+		return errLengthRequired
+	}
+	wait := keyLimits.take(pubKey, config.Get().RateLimits.Key, requestSize(r))
+	if wait != 0 {
+		setRetryAfter(w, wait)
+		return errRateLimited
+	}
+	return nil
+}
+
+// Charge size bytes fetched on behalf of a client against the budgets of its
+// IP and public key
+func chargeFetched(r *http.Request, pubKey uint64, size uint64) {
+	conf := config.Get().RateLimits
+	ipLimits.charge(ipLimitKey(r), conf.IP, size)
+	keyLimits.charge(pubKey, conf.Key, size)
+}
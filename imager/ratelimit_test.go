@@ -0,0 +1,116 @@
+package imager
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestTokenBucket(t *testing.T) {
+	t.Parallel()
+
+	var b tokenBucket
+	now := time.Now()
+
+	for i := 0; i < 60; i++ {
+		test.AssertEquals(t, b.take(1, 60, now), time.Duration(0))
+	}
+	test.AssertEquals(t, b.take(1, 60, now), time.Second)
+
+	// Refills at capacity per minute
+	now = now.Add(2 * time.Second)
+	test.AssertEquals(t, b.take(2, 60, now), time.Duration(0))
+	test.AssertEquals(t, b.take(1, 60, now), time.Second)
+
+	t.Run("larger than capacity", func(t *testing.T) {
+		t.Parallel()
+
+		var b tokenBucket
+		now := time.Now()
+		test.AssertEquals(t, b.take(120, 60, now), time.Duration(0))
+
+		// Bucket is left in debt
+		now = now.Add(time.Minute)
+		test.AssertEquals(t, b.take(1, 60, now), time.Second)
+	})
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Parallel()
+
+	l := newRateLimiter()
+	limit := config.RateLimit{
+		Requests: 2,
+		Size:     1,
+	}
+
+	test.AssertEquals(t, l.take("a", limit, 1<<19), time.Duration(0))
+	test.AssertEquals(t, l.take("a", limit, 1<<19), time.Duration(0))
+
+	// Out of requests
+	if l.take("a", limit, 0) == 0 {
+		t.Fatal("request not limited")
+	}
+
+	// Budgets are separate per client
+	test.AssertEquals(t, l.take("b", limit, 1<<19), time.Duration(0))
+
+	// Out of bytes. The request is not charged.
+	if l.take("b", limit, 1<<20) == 0 {
+		t.Fatal("upload size not limited")
+	}
+	test.AssertEquals(t, l.take("b", limit, 0), time.Duration(0))
+
+	// Disabled limits
+	for i := 0; i < 10; i++ {
+		wait := l.take("c", config.RateLimit{}, 1<<30)
+		test.AssertEquals(t, wait, time.Duration(0))
+	}
+
+	// Bytes charged after admission leave the budget in debt
+	l.charge("d", limit, 2<<20)
+	if l.take("d", limit, 1) == 0 {
+		t.Fatal("charged bytes not limited")
+	}
+}
+
+func TestLimitByIP(t *testing.T) {
+	conf := *config.Get()
+	defer config.Set(conf)
+	conf.RateLimits.IP = config.RateLimit{
+		Requests: 1,
+	}
+	config.Set(conf)
+
+	h := limitByIP(func(w http.ResponseWriter, r *http.Request) {})
+	send := func(remote string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", strings.NewReader("id=abc"))
+		r.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		h(rec, r)
+		return rec
+	}
+
+	test.AssertEquals(t, send("192.0.2.10:1234").Code, 200)
+	rec := send("192.0.2.10:4321")
+	test.AssertEquals(t, rec.Code, 429)
+	test.AssertEquals(t, rec.Header().Get("Retry-After"), "60")
+
+	// IPv6 clients are limited per /64 subnet
+	test.AssertEquals(t, send("[2001:db8::1]:1234").Code, 200)
+	test.AssertEquals(t, send("[2001:db8::2]:1234").Code, 429)
+	test.AssertEquals(t, send("[2001:db8:0:1::1]:1234").Code, 200)
+
+	// Bodies of unknown length can not be charged
+	r := httptest.NewRequest("POST", "/", strings.NewReader("id=abc"))
+	r.RemoteAddr = "192.0.2.11:1234"
+	r.ContentLength = -1
+	rec = httptest.NewRecorder()
+	h(rec, r)
+	test.AssertEquals(t, rec.Code, 411)
+}
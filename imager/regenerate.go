@@ -0,0 +1,192 @@
+package imager
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/thumbnailer/v2"
+	"github.com/go-playground/log"
+	"github.com/jackc/pgx/v4"
+)
+
+// Name of the thumbnail regeneration job for saving its progress
+const regenerateThumbnailsJob = "regenerate_thumbnails"
+
+// Command for regenerating the thumbnails of all stored images with the
+// current thumbnailing settings
+type regenerateThumbnailsCommand struct {
+	Rate float64 `long:"rate" default:"5" description:"Maximum number of thumbnails to regenerate per second"`
+
+	Restart bool `long:"restart" description:"Discard saved progress and start from the first image"`
+}
+
+func (c *regenerateThumbnailsCommand) Execute(_ []string) (err error) {
+	err = parallel(db.LoadDB, assets.CreateDirs)
+	if err != nil {
+		return
+	}
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if c.Restart {
+		err = db.ClearJobProgress(ctx, regenerateThumbnailsJob)
+		if err != nil {
+			return
+		}
+	}
+	return regenerateThumbnails(ctx, c.Rate)
+}
+
+// Return a context, that is canceled on SIGINT or SIGTERM
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-ch:
+			log.Info("interrupted: saving progress")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(ch)
+	}()
+	return ctx, cancel
+}
+
+// Regenerate thumbnails of all stored images at no more than rate images per
+// second. Progress is saved after each image, so the job resumes after
+// interruption.
+func regenerateThumbnails(ctx context.Context, rate float64) (err error) {
+	if rate <= 0 {
+		rate = 1
+	}
+	tick := time.NewTicker(time.Duration(float64(time.Second) / rate))
+	defer tick.Stop()
+
+	lastID, err := db.GetJobProgress(ctx, regenerateThumbnailsJob)
+	if err != nil {
+		return
+	}
+	var done int
+	for {
+		var batch []db.StoredImage
+		batch, err = db.GetImageBatch(ctx, lastID, 100)
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			log.Infof("regenerated thumbnails of %d images", done)
+			return db.ClearJobProgress(ctx, regenerateThumbnailsJob)
+		}
+
+		for _, img := range batch {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-tick.C:
+			}
+
+			err = regenerateThumbnail(ctx, img)
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				log.Errorf(
+					"regenerating thumbnail of image %d: %s",
+					img.ID,
+					err,
+				)
+			}
+			err = db.InTransaction(ctx, func(tx pgx.Tx) error {
+				return db.SetJobProgress(
+					ctx,
+					tx,
+					regenerateThumbnailsJob,
+					img.ID,
+				)
+			})
+			if err != nil {
+				return
+			}
+			lastID = img.ID
+			done++
+		}
+	}
+}
+
+// Regenerate the thumbnail of a single image from its stored source file
+func regenerateThumbnail(ctx context.Context, img db.StoredImage) (err error) {
+	f, err := os.Open(
+		assets.GetFilePaths(img.SHA256, img.FileType, img.ThumbType)[0],
+	)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	var (
+		thumbType               = common.NoFile
+		thumbBuf                []byte
+		thumbWidth, thumbHeight uint16
+	)
+	_, thumb, err := thumbnailer.Process(f, thumbnailer.Options{
+		ThumbDims:         thumbnailDims(),
+		AcceptedMimeTypes: allowedMimeTypes,
+	})
+	defer releaseThumbImage(thumb)
+	switch err {
+	case nil:
+		thumbType = thumbnailType()
+	case thumbnailer.ErrCantThumbnail:
+		err = nil
+	default:
+		return
+	}
+	if thumb != nil {
+		regenerated := img.ImageCommon
+		regenerated.ThumbType = thumbType
+		thumbBuf, err = encodeThumbnail(thumb, &regenerated)
+		if err != nil {
+			return
+		}
+		defer putThumbBuffer(thumbBuf)
+		b := thumb.Bounds()
+		thumbWidth = uint16(b.Dx())
+		thumbHeight = uint16(b.Dy())
+		err = assets.WriteThumbnail(
+			img.SHA256,
+			thumbType,
+			bytes.NewReader(thumbBuf),
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	err = db.InTransaction(ctx, func(tx pgx.Tx) error {
+		return db.UpdateThumbnail(
+			ctx,
+			tx,
+			img.ID,
+			thumbType,
+			thumbWidth,
+			thumbHeight,
+		)
+	})
+	if err != nil {
+		return
+	}
+
+	if img.ThumbType != thumbType {
+		err = assets.DeleteThumbnail(img.SHA256, img.ThumbType)
+	}
+	return
+}
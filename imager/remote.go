@@ -0,0 +1,335 @@
+package imager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"syscall"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+)
+
+const (
+	// Timeout for fetching a remote file, including all redirects
+	remoteFetchTimeout = 30 * time.Second
+
+	// Maximum number of redirects to follow, when fetching a remote file
+	maxRemoteRedirects = 5
+)
+
+var (
+	// Fetches remote files only from public addresses
+	publicFetcher = newRemoteFetcher(isPublicIP)
+
+	// Address ranges not routable on the public internet
+	nonPublicNets = parseCIDRs(
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+
+		// NAT64 and 6to4 can embed private IPv4 addresses
+		"64:ff9b::/96",
+		"64:ff9b:1::/48",
+		"2002::/16",
+
+		"100::/64",
+		"2001:db8::/32",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	)
+
+	errNonPublicAddress = common.StatusError{
+		Err:  errors.New("URL resolves to a non-public address"),
+		Code: 400,
+	}
+	errTooManyRedirects = common.StatusError{
+		Err:  errors.New("too many redirects"),
+		Code: 400,
+	}
+)
+
+// Parse a list of CIDR ranges. Panics on invalid input.
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// Returns, if ip is routable on the public internet
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fetches remote files over HTTP(S), only connecting to permitted addresses
+type remoteFetcher struct {
+	client http.Client
+}
+
+// Create a remote file fetcher, that only connects to addresses for which
+// isAllowed returns true. Addresses are checked after DNS resolution, so
+// hostnames resolving to forbidden addresses are also rejected.
+func newRemoteFetcher(isAllowed func(net.IP) bool) *remoteFetcher {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !isAllowed(ip) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+	return &remoteFetcher{
+		client: http.Client{
+			Transport: &http.Transport{
+				// Proxies would bypass the address checks
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 10 * time.Second,
+				MaxIdleConns:          16,
+				IdleConnTimeout:       time.Minute,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) > maxRemoteRedirects {
+					return errTooManyRedirects
+				}
+				return validateRemoteURL(req.URL)
+			},
+		},
+	}
+}
+
+// Validate a remote file URL before fetching
+func validateRemoteURL(u *url.URL) error {
+	switch u.Scheme {
+	case "http", "https":
+	default:
+		return common.StatusError{
+			Err:  fmt.Errorf("unsupported URL scheme: %s", u.Scheme),
+			Code: 400,
+		}
+	}
+	if u.User != nil {
+		return common.StatusError{
+			Err:  errors.New("URL credentials not allowed"),
+			Code: 400,
+		}
+	}
+	return nil
+}
+
+// Fetch a remote file into a temporary file no larger than max bytes.
+// The caller is responsible for closing the returned file, which also removes
+// it.
+func (f *remoteFetcher) fetch(ctx context.Context, u *url.URL, max int64) (
+	file *tempFile,
+	size int64,
+	err error,
+) {
+	err = validateRemoteURL(u)
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	res, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		var se common.StatusError
+		if errors.As(err, &se) {
+			err = se
+		} else {
+			err = common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		err = common.StatusError{
+			Err:  fmt.Errorf("remote server responded with %s", res.Status),
+			Code: 400,
+		}
+		return
+	}
+	if res.ContentLength > max {
+		err = errTooLarge
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "shamichan_imager_")
+	if err != nil {
+		return
+	}
+	file = &tempFile{tmp}
+	defer func() {
+		if err != nil {
+			file.Close()
+			file = nil
+		}
+	}()
+
+	// Read one byte over the limit to detect oversized files
+	size, err = io.Copy(file, io.LimitReader(res.Body, max+1))
+	if err != nil {
+		err = common.StatusError{
+			Err:  err,
+			Code: 400,
+		}
+		return
+	}
+	if size > max {
+		err = errTooLarge
+		return
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	return
+}
+
+// Temporary file, that is removed on closing
+type tempFile struct {
+	*os.File
+}
+
+func (f *tempFile) Close() error {
+	err := f.File.Close()
+	os.Remove(f.Name())
+	return err
+}
+
+// UploadImageURL fetches a file from a remote URL and inserts it into the
+// client's open post, as if it was uploaded by the client
+func UploadImageURL(w http.ResponseWriter, r *http.Request) {
+	uploadImageURL(w, r, publicFetcher)
+}
+
+// Separate function for easier testability
+func uploadImageURL(
+	w http.ResponseWriter,
+	r *http.Request,
+	fetcher *remoteFetcher,
+) {
+	handleError(w, r, func() (err error) {
+		var req insertionRequest
+		req.ctx = r.Context()
+		req.audit = new(uploadAudit)
+		defer func() { auditUpload(r, req, err) }()
+
+		req.pubKey, err = validateUploader(w, r)
+		if err != nil {
+			return
+		}
+		can, err := db.CanInsertImage(r.Context(), req.pubKey)
+		if err != nil {
+			return
+		}
+		if !can {
+			return errNoCandidatePost
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 4<<10)
+		err = r.ParseForm()
+		if err != nil {
+			return bodyError(err)
+		}
+		err = verifyBody(r)
+		if err != nil {
+			return
+		}
+		u, err := url.Parse(r.FormValue("url"))
+		if err != nil {
+			return common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+		name := r.FormValue("name")
+		if name == "" {
+			switch name = path.Base(u.Path); name {
+			case ".", "/":
+				name = ""
+			}
+		}
+		err = req.extract(r, name)
+		if err != nil {
+			return
+		}
+
+		// The limit of the actual file type is checked after detection
+		max := int64(config.Get().Public.Uploads.MaxSize() * (1024 * 1024))
+		file, size, err := fetcher.fetch(req.ctx, u, max)
+		if err != nil {
+			return
+		}
+		chargeFetched(r, req.pubKey, uint64(size))
+
+		select {
+		case err = <-requestThumbnailing(thumbnailingRequest{
+			insertionRequest: req,
+			file:             file,
+			size:             int(size),
+		}):
+		case <-req.ctx.Done():
+			req.audit.abandon()
+			return
+		}
+		if err == io.EOF {
+			err = common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+		return
+	})
+}
@@ -0,0 +1,223 @@
+package imager
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+// Fetcher for tests, that can connect to the local test origin
+var localFetcher = newRemoteFetcher(func(net.IP) bool {
+	return true
+})
+
+// Start a local origin serving the sample files and redirects
+func newTestOrigin(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			const prefix = "/redirect/"
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				n, _ := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+				target := "/sample.png"
+				if n > 1 {
+					target = "/redirect/" + strconv.Itoa(n-1)
+				}
+				http.Redirect(w, r, target, 302)
+				return
+			}
+			http.ServeFile(w, r, "testdata"+r.URL.Path)
+		},
+	))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestIsPublicIP(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		ip     string
+		public bool
+	}{
+		{"1.1.1.1", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fd00::1", false},
+		{"fe80::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"64:ff9b:1::7f00:1", false},
+		{"2002:c0a8:101::1", false},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.ip, func(t *testing.T) {
+			t.Parallel()
+
+			test.AssertEquals(t, isPublicIP(net.ParseIP(c.ip)), c.public)
+		})
+	}
+}
+
+func TestRemoteFetch(t *testing.T) {
+	t.Parallel()
+
+	origin := newTestOrigin(t)
+	parse := func(t *testing.T, path string) *url.URL {
+		t.Helper()
+
+		u, err := url.Parse(origin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	assertCode := func(t *testing.T, err error, code int) {
+		t.Helper()
+
+		if err == nil {
+			t.Fatal("expected error")
+		}
+		se, ok := err.(common.StatusError)
+		if !ok {
+			t.Fatalf("unexpected error type: %#v", err)
+		}
+		test.AssertEquals(t, se.Code, code)
+	}
+
+	t.Run("success", func(t *testing.T) {
+		t.Parallel()
+
+		f, size, err := localFetcher.fetch(
+			context.Background(),
+			parse(t, "/redirect/2"),
+			1<<20,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		std := test.ReadSample(t, "sample.png")
+		test.AssertEquals(t, size, int64(len(std)))
+		buf, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertBufferEquals(t, buf, std)
+	})
+
+	t.Run("loopback address", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := publicFetcher.fetch(
+			context.Background(),
+			parse(t, "/sample.png"),
+			1<<20,
+		)
+		test.AssertEquals(t, err, error(errNonPublicAddress))
+	})
+
+	t.Run("too many redirects", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := localFetcher.fetch(
+			context.Background(),
+			parse(t, "/redirect/"+strconv.Itoa(maxRemoteRedirects+1)),
+			1<<20,
+		)
+		test.AssertEquals(t, err, error(errTooManyRedirects))
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := localFetcher.fetch(
+			context.Background(),
+			parse(t, "/sample.png"),
+			1<<10,
+		)
+		test.AssertEquals(t, err, error(errTooLarge))
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		t.Parallel()
+
+		_, _, err := localFetcher.fetch(
+			context.Background(),
+			parse(t, "/nope.png"),
+			1<<20,
+		)
+		assertCode(t, err, 400)
+	})
+
+	t.Run("unsupported scheme", func(t *testing.T) {
+		t.Parallel()
+
+		u, err := url.Parse("file:///etc/passwd")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = localFetcher.fetch(context.Background(), u, 1<<20)
+		assertCode(t, err, 400)
+	})
+}
+
+func TestUploadURL(t *testing.T) {
+	t.Parallel()
+
+	origin := newTestOrigin(t)
+	thread, kp := test_db.InsertSampleThread(t)
+
+	body := url.Values{
+		"url":  {origin.URL + "/sample.png"},
+		"post": {strconv.FormatUint(thread, 10)},
+	}.
+		Encode()
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	setAuthHeaders(t, req, kp)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+
+	uploadImageURL(rec, req, localFetcher)
+	if rec.Code != 200 {
+		t.Fatalf("failed thumbnailing: %s", rec.Body.String())
+	}
+
+	f := test.OpenSample(t, "sample.png")
+	defer f.Close()
+	std := common.Image{
+		ImageCommon: common.ImageCommon{
+			FileType:    common.PNG,
+			ThumbType:   common.WEBP,
+			Width:       0x0500,
+			Height:      0x02d0,
+			ThumbWidth:  0x96,
+			ThumbHeight: 0x54,
+			Size:        0x09af2e,
+		},
+		Name: "sample",
+	}
+	hashImage(t, f, &std.ImageCommon)
+	assertImage(t, thread, std)
+}
@@ -0,0 +1,152 @@
+package imager
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+)
+
+// Maximum difference between the signed timestamp of a request and the
+// server's clock. Nonces are remembered for this long after the timestamp.
+const signatureMaxAge = 5 * time.Minute
+
+var (
+	errSignatureExpired = common.StatusError{
+		Err:  errors.New("request signature expired"),
+		Code: 403,
+	}
+	errReplayedRequest = common.StatusError{
+		Err:  errors.New("request nonce already used"),
+		Code: 403,
+	}
+	errBodyHashMismatch = common.StatusError{
+		Err:  errors.New("request body does not match signed hash"),
+		Code: 403,
+	}
+
+	// Nonces used on this instance mapped to their expiry times. Avoids most
+	// database round trips for replayed requests.
+	usedNonces = struct {
+		sync.Mutex
+		m         map[[32]byte]time.Time
+		lastPrune time.Time
+	}{
+		m: make(map[[32]byte]time.Time),
+	}
+)
+
+// Check a signed request timestamp is within the expiry window and return the
+// time the signature expires
+func checkSignatureTime(unix int64) (expires time.Time, err error) {
+	signed := time.Unix(unix, 0)
+	now := time.Now()
+	if signed.Before(now.Add(-signatureMaxAge)) ||
+		signed.After(now.Add(signatureMaxAge)) {
+		err = errSignatureExpired
+		return
+	}
+	expires = signed.Add(signatureMaxAge)
+	return
+}
+
+// Record a request nonce as used until expires. Returns errReplayedRequest,
+// if the nonce was already used on any instance.
+func useNonce(ctx context.Context, nonce [32]byte, expires time.Time) (
+	err error,
+) {
+	now := time.Now()
+
+	usedNonces.Lock()
+	if exp, ok := usedNonces.m[nonce]; ok && exp.After(now) {
+		usedNonces.Unlock()
+		return errReplayedRequest
+	}
+	usedNonces.m[nonce] = expires
+	if now.Sub(usedNonces.lastPrune) > time.Minute {
+		for n, exp := range usedNonces.m {
+			if !exp.After(now) {
+				delete(usedNonces.m, n)
+			}
+		}
+		usedNonces.lastPrune = now
+	}
+	usedNonces.Unlock()
+
+	fresh, err := db.UseNonce(ctx, nonce, expires)
+	if err != nil {
+		return
+	}
+	if !fresh {
+		return errReplayedRequest
+	}
+	return
+}
+
+// Verifies the request body hashes to the signed hash, once it is read to EOF
+type bodyVerifier struct {
+	r        io.ReadCloser
+	h        hash.Hash
+	expected [32]byte
+
+	// Result of the verification. Returned on all reads after EOF.
+	err error
+}
+
+func newBodyVerifier(r io.ReadCloser, expected [32]byte) *bodyVerifier {
+	return &bodyVerifier{
+		r:        r,
+		h:        sha256.New(),
+		expected: expected,
+	}
+}
+
+func (b *bodyVerifier) Read(p []byte) (n int, err error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err = b.r.Read(p)
+	b.h.Write(p[:n])
+	if err == io.EOF {
+		var sum [32]byte
+		copy(sum[:], b.h.Sum(nil))
+		if sum != b.expected {
+			err = errBodyHashMismatch
+		}
+		b.err = err
+	}
+	return
+}
+
+func (b *bodyVerifier) Close() error {
+	return b.r.Close()
+}
+
+// Read any remaining request body to verify it matches its signed hash.
+// Must be called after parsing the request body of a validated uploader.
+func verifyBody(r *http.Request) (err error) {
+	_, err = io.Copy(ioutil.Discard, r.Body)
+	if err != nil {
+		err = bodyError(err)
+	}
+	return
+}
+
+// Convert an error from reading or parsing the request body to a StatusError
+func bodyError(err error) error {
+	if errors.Is(err, errBodyHashMismatch) {
+		return errBodyHashMismatch
+	}
+	return common.StatusError{
+		Err:  err,
+		Code: 400,
+	}
+}
@@ -0,0 +1,151 @@
+package imager
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/test"
+	"github.com/bakape/shamichan/imager/test/test_db"
+)
+
+func TestCheckSignatureTime(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cases := [...]struct {
+		name string
+		time time.Time
+		err  error
+	}{
+		{"current", now, nil},
+		{"clock skew", now.Add(time.Minute), nil},
+		{
+			"expired",
+			now.Add(-signatureMaxAge - time.Minute),
+			errSignatureExpired,
+		},
+		{
+			"future",
+			now.Add(signatureMaxAge + time.Minute),
+			errSignatureExpired,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := checkSignatureTime(c.time.Unix())
+			test.AssertEquals(t, err, c.err)
+		})
+	}
+}
+
+func TestBodyVerifier(t *testing.T) {
+	t.Parallel()
+
+	body := []byte("id=abc&post=1")
+	hash := sha256.Sum256(body)
+
+	t.Run("valid", func(t *testing.T) {
+		t.Parallel()
+
+		v := newBodyVerifier(ioutil.NopCloser(bytes.NewReader(body)), hash)
+		buf, err := ioutil.ReadAll(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertBufferEquals(t, buf, body)
+	})
+
+	t.Run("tampered", func(t *testing.T) {
+		t.Parallel()
+
+		v := newBodyVerifier(
+			ioutil.NopCloser(strings.NewReader("id=abc&post=2")),
+			hash,
+		)
+		_, err := ioutil.ReadAll(v)
+		test.AssertEquals(t, err, error(errBodyHashMismatch))
+
+		// Subsequent reads must not hide the mismatch
+		_, err = v.Read(make([]byte, 1))
+		test.AssertEquals(t, err, error(errBodyHashMismatch))
+	})
+}
+
+func TestReplayProtection(t *testing.T) {
+	t.Parallel()
+
+	_, kp := test_db.InsertSampleThread(t)
+	const body = "id=abc"
+
+	var nonce [32]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validate := func(t *testing.T, timestamp int64) error {
+		t.Helper()
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		signRequest(t, req, kp, nonce, timestamp)
+		_, err := validateUploader(httptest.NewRecorder(), req)
+		if err != nil {
+			return err
+		}
+		return verifyBody(req)
+	}
+
+	err = validate(t, time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		err := validate(t, time.Now().Unix())
+		test.AssertEquals(t, err, error(errReplayedRequest))
+	})
+
+	t.Run("replay on different instance", func(t *testing.T) {
+		usedNonces.Lock()
+		delete(usedNonces.m, nonce)
+		usedNonces.Unlock()
+
+		err := validate(t, time.Now().Unix())
+		test.AssertEquals(t, err, error(errReplayedRequest))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = validate(t, time.Now().Add(-time.Hour).Unix())
+		test.AssertEquals(t, err, error(errSignatureExpired))
+	})
+
+	t.Run("tampered body", func(t *testing.T) {
+		_, err := rand.Read(nonce[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		signRequest(t, req, kp, nonce, time.Now().Unix())
+		req.Body = ioutil.NopCloser(strings.NewReader("id=abd"))
+
+		_, err = validateUploader(httptest.NewRecorder(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.AssertEquals(t, verifyBody(req), error(errBodyHashMismatch))
+	})
+}
@@ -2,10 +2,15 @@ package imager
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"hash"
 	"io"
 	"mime/multipart"
 	"runtime"
+
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/jackc/pgx/v4"
 )
 
 var (
@@ -40,6 +45,11 @@ func requestThumbnailing(req thumbnailingRequest) <-chan error {
 	return ch
 }
 
+// Return the number of files waiting to be processed
+func thumbnailingQueueLength() uint {
+	return uint(len(_scheduleJob) + len(_scheduleSmallJob))
+}
+
 // Queue thumbnailing jobs to reduce resource contention and prevent OOM
 func init() {
 	for _, ch := range [...]<-chan jobRequest{_scheduleJob, _scheduleSmallJob} {
@@ -103,15 +113,27 @@ func hashFile(
 }
 
 func processRequest(req thumbnailingRequest) (err error) {
-	var id [20]byte
-	_, err = hashFile(id[:], req.file, sha1.New())
+	var id common.SHA256Hash
+	_, err = hashFile(id[:], req.file, sha256.New())
 	if err != nil {
 		return
 	}
 
-	err = tryInsertExisting(req.insertionRequest, id)
+	err = tryInsertExisting(
+		req.insertionRequest,
+		func(tx pgx.Tx) (common.ImageCommon, error) {
+			return db.GetImage(req.ctx, tx, id)
+		},
+	)
 	if err != errNotProcessed {
 		return
 	}
-	return insertNewThumbnail(req, id)
+
+	var SHA1 common.SHA1Hash
+	_, err = hashFile(SHA1[:], req.file, sha1.New())
+	if err != nil {
+		return
+	}
+	req.audit.setSHA1(SHA1)
+	return insertNewThumbnail(req, id, SHA1)
 }
@@ -0,0 +1,335 @@
+package imager
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/go-playground/log"
+	"github.com/jackc/pgx/v4"
+)
+
+const (
+	// Name of the scrubber job for saving its progress
+	scrubJob = "scrub"
+
+	// Delay between the end of a scrubbing pass and the start of the next
+	scrubPassInterval = 24 * time.Hour
+
+	// Delay before resuming a failed scrubbing pass
+	scrubRetryInterval = time.Minute
+
+	// Maximum unused read time a throttle accumulates. Reads after idle
+	// periods are not allowed to exceed the limit by more than this.
+	throttleMaxBurst = time.Second
+)
+
+// Progress of the integrity scrubber
+type scrubProgress struct {
+	Running bool `json:"running"`
+
+	// ID of the last scrubbed image in the current pass
+	LastID uint64 `json:"last_id"`
+
+	// Images and bytes checked in the current pass
+	Checked   uint64 `json:"checked"`
+	BytesRead uint64 `json:"bytes_read"`
+
+	// Problems found in the current pass
+	Problems uint64 `json:"problems"`
+
+	// Number of completed passes since startup
+	Passes uint64 `json:"passes"`
+
+	PassStartedOn       time.Time  `json:"pass_started_on"`
+	LastPassCompletedOn *time.Time `json:"last_pass_completed_on"`
+}
+
+var (
+	scrubProgressMu sync.Mutex
+	scrubState      scrubProgress
+)
+
+// Return the current progress of the integrity scrubber
+func getScrubProgress() scrubProgress {
+	scrubProgressMu.Lock()
+	defer scrubProgressMu.Unlock()
+	return scrubState
+}
+
+// Modify the progress of the integrity scrubber
+func updateScrubProgress(fn func(p *scrubProgress)) {
+	scrubProgressMu.Lock()
+	defer scrubProgressMu.Unlock()
+	fn(&scrubState)
+}
+
+// Limits reads to a set number of bytes per second
+type throttle struct {
+	bytesPerSecond float64
+	start          time.Time
+	read           float64
+}
+
+func newThrottle(bytesPerSecond float64) *throttle {
+	return &throttle{
+		bytesPerSecond: bytesPerSecond,
+		start:          time.Now(),
+	}
+}
+
+// Return a reader, that reads from r no faster than the throttle allows
+func (t *throttle) reader(r io.Reader) io.Reader {
+	return throttledReader{t, r}
+}
+
+// Account for n bytes read and sleep, if reading is ahead of the limit
+func (t *throttle) wait(n int) {
+	t.read += float64(n)
+	expected := time.Duration(t.read / t.bytesPerSecond * float64(time.Second))
+	elapsed := time.Since(t.start)
+	switch {
+	case expected > elapsed:
+		time.Sleep(expected - elapsed)
+	case elapsed-expected > throttleMaxBurst:
+		// Don't accumulate unused bandwidth during idle periods
+		t.start = time.Now().Add(-expected - throttleMaxBurst)
+	}
+}
+
+type throttledReader struct {
+	t *throttle
+	r io.Reader
+}
+
+func (r throttledReader) Read(p []byte) (n int, err error) {
+	// Keep sleeps short for smoother throughput
+	if len(p) > 64<<10 {
+		p = p[:64<<10]
+	}
+	n, err = r.r.Read(p)
+	r.t.wait(n)
+	return
+}
+
+// Continuously scrub all stored images at no more than bandwidth MB/s.
+// Blocks until ctx is canceled.
+func runScrubber(ctx context.Context, bandwidth float64, quarantine bool) {
+	for {
+		wait := scrubPassInterval
+		err := scrubPass(ctx, newThrottle(bandwidth*(1<<20)), quarantine)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Errorf("scrubber: %s", err)
+			// The pass resumes from its saved progress
+			wait = scrubRetryInterval
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Scrub all stored images, resuming from any saved progress
+func scrubPass(ctx context.Context, t *throttle, quarantine bool) (
+	err error,
+) {
+	lastID, err := db.GetJobProgress(ctx, scrubJob)
+	if err != nil {
+		return
+	}
+	updateScrubProgress(func(p *scrubProgress) {
+		p.Running = true
+		p.LastID = lastID
+		p.Checked = 0
+		p.BytesRead = 0
+		p.Problems = 0
+		p.PassStartedOn = time.Now()
+	})
+	defer updateScrubProgress(func(p *scrubProgress) {
+		p.Running = false
+	})
+
+	for {
+		var batch []db.StoredImage
+		batch, err = db.GetImageBatch(ctx, lastID, 100)
+		if err != nil {
+			return
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		for _, img := range batch {
+			if err = ctx.Err(); err != nil {
+				return
+			}
+
+			results, read, scrubErr := scrubImage(img, t, quarantine)
+			if scrubErr != nil {
+				// Keep the results of the previous pass
+				log.Errorf("scrubber: image %d: %s", img.ID, scrubErr)
+			}
+			err = db.InTransaction(ctx, func(tx pgx.Tx) (err error) {
+				if scrubErr == nil {
+					err = db.SetScrubResults(ctx, tx, img.ID, results)
+					if err != nil {
+						return
+					}
+				}
+				return db.SetJobProgress(ctx, tx, scrubJob, img.ID)
+			})
+			lastID = img.ID
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// Most likely the image was deleted during the pass
+				log.Errorf("scrubber: image %d: %s", img.ID, err)
+				err = nil
+				continue
+			}
+			updateScrubProgress(func(p *scrubProgress) {
+				p.LastID = img.ID
+				p.Checked++
+				p.BytesRead += read
+				p.Problems += uint64(len(results))
+			})
+		}
+	}
+
+	err = db.ClearJobProgress(ctx, scrubJob)
+	if err != nil {
+		return
+	}
+	updateScrubProgress(func(p *scrubProgress) {
+		now := time.Now()
+		p.Passes++
+		p.LastPassCompletedOn = &now
+		log.Infof(
+			"scrubber: checked %d images, found %d problems",
+			p.Checked,
+			p.Problems,
+		)
+	})
+	return
+}
+
+// Verify the files of a stored image exist and the source file matches its
+// recorded hashes and size. Returns any problems found and the number of bytes
+// read.
+func scrubImage(img db.StoredImage, t *throttle, quarantine bool) (
+	results []db.ScrubResult,
+	read uint64,
+	err error,
+) {
+	paths := assets.GetFilePaths(img.SHA256, img.FileType, img.ThumbType)
+	add := func(path, problem string) {
+		res := db.ScrubResult{
+			Image:   img.ID,
+			SHA256:  img.SHA256,
+			Path:    path,
+			Problem: problem,
+		}
+		if quarantine && problem != db.ScrubMissing {
+			_, err := assets.Quarantine(path)
+			if err != nil {
+				log.Errorf("scrubber: quarantining %s: %s", path, err)
+			} else {
+				res.Quarantined = true
+			}
+		}
+		results = append(results, res)
+	}
+
+	problem, read, err := scrubSource(paths[0], &img.ImageCommon, t)
+	if err != nil {
+		return
+	}
+	if problem != "" {
+		add(paths[0], problem)
+	}
+
+	others := make([]string, 0, 1+len(img.Subtitles))
+	if img.ThumbType != common.NoFile {
+		others = append(others, paths[1])
+	}
+	for i := range img.Subtitles {
+		others = append(others, assets.GetSubtitlePath(img.SHA256, i))
+	}
+	for _, p := range others {
+		_, err = os.Stat(p)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			err = nil
+			add(p, db.ScrubMissing)
+		default:
+			return
+		}
+	}
+	return
+}
+
+// Verify the source file of an image matches its recorded hashes and size
+func scrubSource(path string, img *common.ImageCommon, t *throttle) (
+	problem string,
+	read uint64,
+	err error,
+) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+			problem = db.ScrubMissing
+		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	if uint64(info.Size()) != img.Size {
+		problem = db.ScrubSizeMismatch
+		return
+	}
+
+	var (
+		hSHA256 = sha256.New()
+		hSHA1   = sha1.New()
+		hMD5    = md5.New()
+	)
+	n, err := io.Copy(io.MultiWriter(hSHA256, hSHA1, hMD5), t.reader(f))
+	read = uint64(n)
+	if err != nil {
+		return
+	}
+
+	var (
+		id   common.SHA256Hash
+		SHA1 common.SHA1Hash
+		MD5  common.MD5Hash
+	)
+	copy(id[:], hSHA256.Sum(nil))
+	copy(SHA1[:], hSHA1.Sum(nil))
+	copy(MD5[:], hMD5.Sum(nil))
+	if id != img.SHA256 || SHA1 != img.SHA1 || MD5 != img.MD5 {
+		problem = db.ScrubCorrupt
+	}
+	return
+}
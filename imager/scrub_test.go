@@ -0,0 +1,184 @@
+package imager
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bakape/shamichan/imager/assets"
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
+	"github.com/bakape/shamichan/imager/db"
+	"github.com/bakape/shamichan/imager/test"
+)
+
+func TestScrubImage(t *testing.T) {
+	t.Parallel()
+
+	src := test.ReadSample(t, "sample.jpg")
+	thumb := test.ReadSample(t, "sample.png")
+
+	// Write the files of a new image, that has a unique hash
+	write := func(t *testing.T, buf []byte) db.StoredImage {
+		t.Helper()
+
+		img := db.StoredImage{
+			ID: 1,
+			ImageCommon: common.ImageCommon{
+				FileType:  common.JPEG,
+				ThumbType: common.PNG,
+				Size:      uint64(len(buf)),
+			},
+		}
+		hashImage(t, bytes.NewReader(buf), &img.ImageCommon)
+		err := assets.Write(
+			img.SHA256,
+			img.FileType,
+			img.ThumbType,
+			bytes.NewReader(buf),
+			bytes.NewReader(thumb),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+	unique := func() []byte {
+		return append(append([]byte(nil), src...), test.GenBuf(32)...)
+	}
+	paths := func(img db.StoredImage) [2]string {
+		return assets.GetFilePaths(img.SHA256, img.FileType, img.ThumbType)
+	}
+
+	cases := [...]struct {
+		name       string
+		quarantine bool
+		damage     func(t *testing.T, img *db.StoredImage)
+		problems   []string
+	}{
+		{
+			name:   "intact",
+			damage: func(*testing.T, *db.StoredImage) {},
+		},
+		{
+			name: "corrupt",
+			damage: func(t *testing.T, img *db.StoredImage) {
+				img.MD5[0]++
+			},
+			problems: []string{db.ScrubCorrupt},
+		},
+		{
+			name: "size mismatch",
+			damage: func(t *testing.T, img *db.StoredImage) {
+				img.Size++
+			},
+			problems: []string{db.ScrubSizeMismatch},
+		},
+		{
+			name: "missing source",
+			damage: func(t *testing.T, img *db.StoredImage) {
+				err := os.Remove(paths(*img)[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			problems: []string{db.ScrubMissing},
+		},
+		{
+			name: "missing thumbnail and subtitles",
+			damage: func(t *testing.T, img *db.StoredImage) {
+				err := os.Remove(paths(*img)[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				img.Subtitles = []string{"eng"}
+			},
+			problems: []string{db.ScrubMissing, db.ScrubMissing},
+		},
+		{
+			name:       "quarantine",
+			quarantine: true,
+			damage: func(t *testing.T, img *db.StoredImage) {
+				img.SHA1[0]++
+			},
+			problems: []string{db.ScrubCorrupt},
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			img := write(t, unique())
+			c.damage(t, &img)
+
+			res, _, err := scrubImage(img, newThrottle(1<<30), c.quarantine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			problems := make([]string, 0, len(res))
+			for _, r := range res {
+				problems = append(problems, r.Problem)
+				test.AssertEquals(t, r.Quarantined, c.quarantine)
+			}
+			if c.problems == nil {
+				c.problems = []string{}
+			}
+			test.AssertEquals(t, problems, c.problems)
+
+			if c.quarantine {
+				_, err = os.Stat(paths(img)[0])
+				if !os.IsNotExist(err) {
+					t.Fatalf("file not quarantined: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestThrottleBurst(t *testing.T) {
+	t.Parallel()
+
+	th := newThrottle(1 << 20)
+	th.start = th.start.Add(-time.Hour)
+
+	// Unused bandwidth of the idle hour is discarded
+	th.wait(1)
+	if d := time.Since(th.start); d > throttleMaxBurst+time.Second {
+		t.Fatalf("burst not capped: %s", d)
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	h := adminOnly(func(w http.ResponseWriter, r *http.Request) {})
+
+	cases := [...]struct {
+		name, token, header string
+		code                int
+	}{
+		{"disabled", "", "Bearer ", 404},
+		{"no token", "secret", "", 403},
+		{"invalid token", "secret", "Bearer wrong", 403},
+		{"valid token", "secret", "Bearer secret", 200},
+	}
+
+	defer func(token string) {
+		config.Server.AdminToken = token
+	}(config.Server.AdminToken)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			config.Server.AdminToken = c.token
+			req := httptest.NewRequest("GET", "/", nil)
+			if c.header != "" {
+				req.Header.Set("Authorization", c.header)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, req)
+			test.AssertEquals(t, rec.Code, c.code)
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package imager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/bakape/shamichan/imager/common"
+)
+
+const (
+	// Maximum number of subtitle tracks to extract from a single file
+	maxSubtitleTracks = 16
+
+	// Maximum size of a single converted WebVTT track
+	maxSubtitleSize = 1 << 20
+)
+
+// Subtitle codecs FFmpeg can convert to WebVTT. Bitmap subtitles like PGS and
+// VobSub are skipped.
+var textSubtitleCodecs = map[string]bool{
+	"subrip":   true,
+	"srt":      true,
+	"ass":      true,
+	"ssa":      true,
+	"webvtt":   true,
+	"mov_text": true,
+	"text":     true,
+}
+
+// Subtitle track of a video container
+type subtitleTrack struct {
+	// Language of the track as specified in the container or "und"
+	language string
+
+	// Track converted to WebVTT
+	vtt []byte
+}
+
+// Extract all text subtitle tracks from a video container and convert them to
+// WebVTT.
+//
+// Subtitle extraction requires the ffprobe and ffmpeg executables. If these
+// are not installed, no subtitles are extracted.
+func extractSubtitles(rs io.ReadSeeker, typ common.FileType) (
+	tracks []subtitleTrack,
+	err error,
+) {
+	switch typ {
+	case common.WEBM, common.MKV, common.MP4:
+	default:
+		return
+	}
+	if !ffTools.ffprobe || !ffTools.ffmpeg {
+		return
+	}
+
+	path, cleanup, err := sourcePath(rs)
+	if err != nil {
+		return
+	}
+	defer cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	out, err := exec.CommandContext(
+		ctx,
+		"ffprobe",
+		"-v", "error",
+		"-select_streams", "s",
+		"-show_entries", "stream=index,codec_name:stream_tags=language",
+		"-of", "json",
+		path,
+	).
+		Output()
+	if err != nil {
+		return
+	}
+	var probe struct {
+		Streams []struct {
+			Index     int    `json:"index"`
+			CodecName string `json:"codec_name"`
+			Tags      struct {
+				Language string `json:"language"`
+			} `json:"tags"`
+		} `json:"streams"`
+	}
+	err = json.Unmarshal(out, &probe)
+	if err != nil {
+		return
+	}
+
+	dir, err := ioutil.TempDir("", "shamichan_subtitles_")
+	if err != nil {
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Convert all tracks in a single pass over the file. Each track is written
+	// to its own output file, that stops growing past the size limit.
+	type candidate struct {
+		language, path string
+	}
+	var (
+		candidates []candidate
+		args       = []string{"-v", "error", "-i", path}
+	)
+	for _, s := range probe.Streams {
+		if len(candidates) == maxSubtitleTracks {
+			break
+		}
+		if !textSubtitleCodecs[s.CodecName] {
+			continue
+		}
+
+		lang := s.Tags.Language
+		if lang == "" || len(lang) > 35 {
+			lang = "und"
+		}
+		c := candidate{
+			language: lang,
+			path:     filepath.Join(dir, strconv.Itoa(s.Index)+".vtt"),
+		}
+		candidates = append(candidates, c)
+		args = append(
+			args,
+			"-map", "0:"+strconv.Itoa(s.Index),
+			"-fs", strconv.Itoa(maxSubtitleSize+1),
+			"-f", "webvtt",
+			c.path,
+		)
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	err = exec.CommandContext(ctx, "ffmpeg", args...).Run()
+	if err != nil {
+		return
+	}
+
+	for _, c := range candidates {
+		var vtt []byte
+		vtt, err = ioutil.ReadFile(c.path)
+		switch {
+		case err == nil:
+		case os.IsNotExist(err):
+			err = nil
+			continue
+		default:
+			return
+		}
+		if len(vtt) > maxSubtitleSize ||
+			!bytes.HasPrefix(vtt, []byte("WEBVTT")) {
+			continue
+		}
+		tracks = append(tracks, subtitleTrack{
+			language: c.language,
+			vtt:      vtt,
+		})
+	}
+	return
+}
+
+// Return a file system path to the contents of rs, dumping it to a temporary
+// file, if needed. cleanup must be called after the path is no longer used.
+func sourcePath(rs io.ReadSeeker) (path string, cleanup func(), err error) {
+	cleanup = func() {}
+
+	if f, ok := rs.(*os.File); ok {
+		path = f.Name()
+		return
+	}
+
+	tmp, err := ioutil.TempFile("", "shamichan_imager_")
+	if err != nil {
+		return
+	}
+	cleanup = func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	_, err = rs.Seek(0, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(tmp, rs)
+	}
+	if err != nil {
+		cleanup()
+		cleanup = func() {}
+		return
+	}
+	path = tmp.Name()
+	return
+}
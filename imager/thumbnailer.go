@@ -1,10 +1,15 @@
 package imager
 
 import (
+	"bytes"
 	"image"
+	"image/jpeg"
 	"io"
 
+	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
 	"github.com/bakape/thumbnailer/v2"
+	"github.com/chai2010/webp"
 )
 
 const mimePDF = "application/pdf"
@@ -13,6 +18,8 @@ func init() {
 	for _, fn := range [...]thumbnailer.MatcherFunc{
 		detectTarGZ,
 		detectTarXZ,
+		detectAVIF,
+		detectJXL,
 		detectText, // Has to be last, in case any other formats are pure UTF-8
 	} {
 		thumbnailer.RegisterMatcher(fn)
@@ -25,6 +32,9 @@ func init() {
 	} {
 		thumbnailer.RegisterProcessor(m, noopProcessor)
 	}
+	for _, m := range [...]string{mimeAVIF, mimeJXL} {
+		thumbnailer.RegisterProcessor(m, processFFImage)
+	}
 }
 
 // Does nothing.
@@ -36,3 +46,56 @@ func noopProcessor(rs io.ReadSeeker, _ *thumbnailer.Source,
 ) {
 	return nil, thumbnailer.ErrCantThumbnail
 }
+
+// Return the bounding dimensions of generated thumbnails
+func thumbnailDims() thumbnailer.Dims {
+	d := config.Get().Public.Uploads.Thumbnails.GeneratedDims()
+	return thumbnailer.Dims{
+		Width:  uint(d.Width),
+		Height: uint(d.Height),
+	}
+}
+
+// Return the file type of generated thumbnails
+func thumbnailType() common.FileType {
+	if config.Get().Public.Uploads.JPEGThumbnails {
+		return common.JPEG
+	}
+	return common.WEBP
+}
+
+// Encode the thumbnail of img to img.ThumbType. The returned buffer is from the
+// thumbnail buffer pool.
+func encodeThumbnail(thumb image.Image, img *common.ImageCommon) (
+	buf []byte,
+	err error,
+) {
+	conf := config.Get().Public.Uploads.Thumbnails
+	w := bytes.NewBuffer(getThumbBuffer())
+	switch img.ThumbType {
+	case common.JPEG:
+		err = jpeg.Encode(w, thumb, &jpeg.Options{
+			Quality: conf.Quality(true),
+		})
+	case common.WEBP:
+		err = webp.Encode(w, thumb, &webp.Options{
+			Lossless: fileCategories[img.FileType] == config.Image &&
+				conf.Lossless(img.Width, img.Height),
+			Quality: float32(conf.Quality(false)),
+		})
+	}
+	if err != nil {
+		return
+	}
+	buf = w.Bytes()
+	return
+}
+
+// Add the internal buffer of a thumbnail produced by the thumbnailer to the
+// thumbnail buffer pool
+func releaseThumbImage(thumb image.Image) {
+	// Only image type used in thumbnailer by default
+	if img, ok := thumb.(*image.RGBA); ok {
+		putThumbBuffer(img.Pix)
+	}
+}
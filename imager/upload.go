@@ -6,27 +6,26 @@ import (
 	"context"
 	"crypto"
 	"crypto/md5"
-	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"image"
-	"image/jpeg"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
 
+	"github.com/bakape/shamichan/imager/assets"
 	"github.com/bakape/shamichan/imager/common"
 	"github.com/bakape/shamichan/imager/config"
 	"github.com/bakape/shamichan/imager/db"
 	"github.com/bakape/thumbnailer/v2"
-	"github.com/chai2010/webp"
 	"github.com/go-playground/log"
 	"github.com/jackc/pgx/v4"
 	uuid "github.com/satori/go.uuid"
@@ -38,7 +37,6 @@ import (
 // TODO: read processed images by listening to the table from Rust
 // TODO: handle pending image existing on post closure by closing the post
 // only after the image has finished processing. Do this with an exists check.
-// TODO: increment spam score on receiving the request.
 // TODO: t/o upload request after 3 minutes
 // TODO: In Rust, if post is already closed then simply NOP
 // TODO: separate processing indicator on the client for files that are already
@@ -51,8 +49,11 @@ var (
 		"image/png":                     common.PNG,
 		"image/gif":                     common.GIF,
 		"image/webp":                    common.WEBP,
+		mimeAVIF:                        common.AVIF,
+		mimeJXL:                         common.JXL,
 		mimePDF:                         common.PDF,
 		"video/webm":                    common.WEBM,
+		"video/x-matroska":              common.MKV,
 		"application/ogg":               common.OGG,
 		"video/mp4":                     common.MP4,
 		"video/quicktime":               common.MP4,
@@ -62,12 +63,44 @@ var (
 		mimeTarXZ:                       common.TXZ,
 		mimeZip:                         common.ZIP,
 		"audio/x-flac":                  common.FLAC,
+		mimeOpus:                        common.OPUS,
+		mimeM4A:                         common.M4A,
+		mimeWAV:                         common.WAV,
 		mimeText:                        common.TXT,
 		"application/x-rar-compressed":  common.RAR,
 		"application/vnd.comicbook+zip": common.CBZ,
 		"application/vnd.comicbook-rar": common.CBR,
 	}
 
+	// Categories of file types used for applying upload constraints
+	fileCategories = map[common.FileType]config.FileCategory{
+		common.JPEG:     config.Image,
+		common.PNG:      config.Image,
+		common.GIF:      config.Image,
+		common.WEBP:     config.Image,
+		common.SVG:      config.Image,
+		common.AVIF:     config.Image,
+		common.JXL:      config.Image,
+		common.WEBM:     config.Video,
+		common.MKV:      config.Video,
+		common.MP4:      config.Video,
+		common.OGG:      config.Video,
+		common.MP3:      config.Audio,
+		common.FLAC:     config.Audio,
+		common.OPUS:     config.Audio,
+		common.M4A:      config.Audio,
+		common.WAV:      config.Audio,
+		common.ZIP:      config.Archive,
+		common.SevenZip: config.Archive,
+		common.TGZ:      config.Archive,
+		common.TXZ:      config.Archive,
+		common.RAR:      config.Archive,
+		common.CBZ:      config.Archive,
+		common.CBR:      config.Archive,
+		common.TXT:      config.Text,
+		common.PDF:      config.Text,
+	}
+
 	pubKeyCache = newCacheMap()
 
 	// MIME types from thumbnailer to accept
@@ -81,10 +114,22 @@ var (
 		Err:  errors.New("no post found for image insertion"),
 		Code: 404,
 	}
+	errCaptchaRequired = common.StatusError{
+		Err:  errors.New("captcha required"),
+		Code: 403,
+	}
+	errTooManyAttachments = common.StatusError{
+		Err:  errors.New("post attachment limit reached"),
+		Code: 400,
+	}
 	errNotProcessed = common.StatusError{
 		Err:  errors.New("hash not in database"),
 		Code: 404,
 	}
+	errSHA1LookupsDisabled = common.StatusError{
+		Err:  errors.New("SHA1 hash lookups disabled"),
+		Code: 400,
+	}
 )
 
 func init() {
@@ -100,6 +145,7 @@ type insertionRequest struct {
 	post, pubKey uint64
 	name         string
 	ctx          context.Context
+	audit        *uploadAudit
 }
 
 // Handles the clients' image (or other file) upload request
@@ -107,6 +153,8 @@ func NewImageUpload(w http.ResponseWriter, r *http.Request) {
 	handleError(w, r, func() (err error) {
 		var req insertionRequest
 		req.ctx = r.Context()
+		req.audit = new(uploadAudit)
+		defer func() { auditUpload(r, req, err) }()
 
 		req.pubKey, err = validateUploader(w, r)
 		if err != nil {
@@ -120,8 +168,11 @@ func NewImageUpload(w http.ResponseWriter, r *http.Request) {
 			return errNoCandidatePost
 		}
 
-		// Limit data received to the maximum uploaded file size limit
-		max := uint64(config.Get().Public.Uploads.Max.Size*(1024*1024)) + 1<<10
+		// Limit data received to the maximum uploaded file size limit of any
+		// file category. The limit of the actual file type is checked after
+		// detection.
+		max := uint64(config.Get().Public.Uploads.MaxSize()*(1024*1024)) +
+			1<<10
 		r.Body = http.MaxBytesReader(w, r.Body, int64(max))
 
 		length, err := strconv.ParseUint(r.Header.Get("Content-Length"), 10, 64)
@@ -136,10 +187,11 @@ func NewImageUpload(w http.ResponseWriter, r *http.Request) {
 		}
 		err = r.ParseMultipartForm(0)
 		if err != nil {
-			return common.StatusError{
-				Err:  err,
-				Code: 400,
-			}
+			return bodyError(err)
+		}
+		err = verifyBody(r)
+		if err != nil {
+			return
 		}
 
 		file, head, err := r.FormFile("image")
@@ -164,6 +216,7 @@ func NewImageUpload(w http.ResponseWriter, r *http.Request) {
 			size:             int(head.Size),
 		}):
 		case <-req.ctx.Done():
+			req.audit.abandon()
 			return
 		}
 		if err == io.EOF {
@@ -176,20 +229,69 @@ func NewImageUpload(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Apply security restrictions to uploader
+// Apply security restrictions to uploader. A solved proof-of-work challenge
+// is required, if enabled, and substitutes for a recently solved captcha.
 func validateUploader(w http.ResponseWriter, r *http.Request) (
 	pubKeyID uint64,
 	err error,
 ) {
+	pubKeyID, err = admitUploader(w, r)
+	if err != nil {
+		return
+	}
+	err = verifyPoW(r, pubKeyID)
+	if err != nil {
+		return
+	}
+
+	// Uploads are charged against the spam score on insertion, once the file
+	// type and size are known
+	need, err := db.NeedCaptcha(
+		r.Context(),
+		pubKeyID,
+		config.Get().Public.ProofOfWork.Enabled,
+	)
+	if err != nil {
+		return
+	}
+	if need {
+		err = errCaptchaRequired
+	}
+	return
+}
+
+// Authenticate the uploader and apply bans and rate limits
+func admitUploader(w http.ResponseWriter, r *http.Request) (
+	pubKeyID uint64,
+	err error,
+) {
+	pubKeyID, err = authenticateUploader(r)
+	if err != nil {
+		return
+	}
+	err = checkBan(r, pubKeyID)
+	if err != nil {
+		return
+	}
+	err = limitByKey(w, r, pubKeyID)
+	return
+}
+
+// Verify the request signature of the uploader and return the private ID of
+// its public key. The request body is verified against the signed hash, as it
+// is read.
+func authenticateUploader(r *http.Request) (pubKeyID uint64, err error) {
 	type keyStore struct {
-		id  uint64
-		key *rsa.PublicKey
+		id      uint64
+		key     crypto.PublicKey
+		revoked bool
 	}
 
 	var (
-		nonce     [32]byte
-		signature [512]byte
-		pubID     uuid.UUID
+		nonce, bodyHash [32]byte
+		signature       []byte
+		pubID           uuid.UUID
+		timestamp       int64
 	)
 	err = common.WrapError(400, func() (err error) {
 		pubID, err = uuid.FromString(r.Header.Get("X-Public-Key-ID"))
@@ -215,16 +317,38 @@ func validateUploader(w http.ResponseWriter, r *http.Request) (
 		if err != nil {
 			return
 		}
-		return decode(signature[:], "X-Signature")
+		err = decode(bodyHash[:], "X-Body-SHA256")
+		if err != nil {
+			return
+		}
+		timestamp, err = strconv.ParseInt(r.Header.Get("X-Timestamp"), 10, 64)
+		if err != nil {
+			return
+		}
+
+		signature, err = base64.StdEncoding.DecodeString(
+			r.Header.Get("X-Signature"),
+		)
+		if err != nil {
+			return
+		}
+		if len(signature) == 0 || len(signature) > maxSignatureLength {
+			return fmt.Errorf("invalid X-Signature length: %d", len(signature))
+		}
+		return
 	})
 	if err != nil {
 		return
 	}
+	expires, err := checkSignatureTime(timestamp)
+	if err != nil {
+		return
+	}
 
 	store_, err := pubKeyCache.GetOrGen(
 		pubID,
 		func() (val interface{}, err error) {
-			id, der, err := db.GetPubKey(pubID)
+			stored, err := db.GetPubKey(pubID)
 			switch err {
 			case nil:
 			case pgx.ErrNoRows:
@@ -234,7 +358,7 @@ func validateUploader(w http.ResponseWriter, r *http.Request) (
 				return
 			}
 
-			pubKey, err := x509.ParsePKCS1PublicKey(der)
+			pubKey, err := parsePublicKey(stored.Type, stored.Key)
 			if err != nil {
 				err = common.StatusError{
 					Err:  err,
@@ -244,8 +368,9 @@ func validateUploader(w http.ResponseWriter, r *http.Request) (
 			}
 
 			val = keyStore{
-				id:  id,
-				key: pubKey,
+				id:      stored.ID,
+				key:     pubKey,
+				revoked: stored.Revoked,
 			}
 			return
 		},
@@ -254,31 +379,53 @@ func validateUploader(w http.ResponseWriter, r *http.Request) (
 		return
 	}
 	store := store_.(keyStore)
-	pubKeyID = store.id
-
-	h := sha256.New()
-	_, err = h.Write(pubID[:])
-	if err != nil {
+	if store.revoked {
+		err = errKeyRevoked
 		return
 	}
-	_, err = h.Write(nonce[:])
-	if err != nil {
-		return
-	}
-	digest := h.Sum(nil)
-	err = rsa.VerifyPKCS1v15(store.key, crypto.SHA256, digest, signature[:])
+	pubKeyID = store.id
+
+	err = verifySignature(
+		store.key,
+		signedMessage(pubID, nonce, timestamp, bodyHash),
+		signature,
+	)
 	if err != nil {
 		err = common.StatusError{
 			Err:  err,
 			Code: 403,
 		}
+		return
 	}
 
-	// TODO: increment spam score here
-
+	// Only record nonces of valid signatures, so they can not be exhausted by
+	// third parties
+	err = useNonce(r.Context(), nonce, expires)
+	if err != nil {
+		return
+	}
+	r.Body = newBodyVerifier(r.Body, bodyHash)
 	return
 }
 
+// Return the message signed by uploaders. Covers the public key ID, a random
+// nonce, the unix timestamp of the request and the SHA-256 hash of the request
+// body.
+func signedMessage(
+	pubID uuid.UUID,
+	nonce [32]byte,
+	timestamp int64,
+	bodyHash [32]byte,
+) []byte {
+	msg := make([]byte, 0, 16+32+8+32)
+	msg = append(msg, pubID[:]...)
+	msg = append(msg, nonce[:]...)
+	var ts [8]byte
+	binary.BigEndian.PutUint64(ts[:], uint64(timestamp))
+	msg = append(msg, ts[:]...)
+	return append(msg, bodyHash[:]...)
+}
+
 // Extract and validate common request data from request
 func (req *insertionRequest) extract(r *http.Request, name string) (err error) {
 	req.spoiler = r.FormValue("spoiler") == "true"
@@ -317,17 +464,22 @@ func (req *insertionRequest) extract(r *http.Request, name string) (err error) {
 }
 
 // UploadImageHash attempts to skip image upload, if the file has already
-// been thumbnailed and is stored on the server. The client sends an SHA1 hash
-// of the file it wants to upload. The server looks up, if such a file is
+// been thumbnailed and is stored on the server. The client sends an SHA-256
+// hash of the file it wants to upload. The server looks up, if such a file is
 // thumbnailed. If yes, generates and sends a new image allocation token to
 // the client.
+//
+// SHA1 hashes are also accepted for compatibility with legacy clients, unless
+// disabled in the configuration.
 func UploadImageHash(w http.ResponseWriter, r *http.Request) {
 	handleError(w, r, func() (err error) {
 		var req struct {
 			insertionRequest
-			id common.SHA1Hash
+			get func(tx pgx.Tx) (common.ImageCommon, error)
 		}
 		req.ctx = r.Context()
+		req.audit = new(uploadAudit)
+		defer func() { auditUpload(r, req.insertionRequest, err) }()
 
 		req.pubKey, err = validateUploader(w, r)
 		if err != nil {
@@ -337,12 +489,35 @@ func UploadImageHash(w http.ResponseWriter, r *http.Request) {
 		r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
 		err = r.ParseForm()
 		if err != nil {
-			return common.StatusError{
-				Err:  err,
-				Code: 400,
+			return bodyError(err)
+		}
+		err = verifyBody(r)
+		if err != nil {
+			return
+		}
+		id := []byte(r.FormValue("id"))
+		if len(id) == 40 {
+			if config.Get().DisableSHA1Lookups {
+				return errSHA1LookupsDisabled
+			}
+			var SHA1 common.SHA1Hash
+			err = SHA1.UnmarshalText(id)
+			if err == nil {
+				req.audit.setSHA1(SHA1)
+			}
+			req.get = func(tx pgx.Tx) (common.ImageCommon, error) {
+				return db.GetImageBySHA1(req.ctx, tx, SHA1)
+			}
+		} else {
+			var SHA256 common.SHA256Hash
+			err = SHA256.UnmarshalText(id)
+			if err == nil {
+				req.audit.setSHA256(SHA256)
+			}
+			req.get = func(tx pgx.Tx) (common.ImageCommon, error) {
+				return db.GetImage(req.ctx, tx, SHA256)
 			}
 		}
-		err = req.id.UnmarshalText([]byte(r.FormValue("id")))
 		if err != nil {
 			return common.StatusError{
 				Err:  err,
@@ -354,15 +529,19 @@ func UploadImageHash(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		return tryInsertExisting(req.insertionRequest, req.id)
+		return tryInsertExisting(req.insertionRequest, req.get)
 	})
 }
 
-// Try finding and inserting an already processed image into the post
-func tryInsertExisting(req insertionRequest, id common.SHA1Hash,
-) error {
-	return db.InTransaction(req.ctx, func(tx pgx.Tx) (err error) {
-		img, err := db.GetImage(req.ctx, tx, id)
+// Try finding and inserting an already processed image into the post.
+// get retrieves the image record.
+func tryInsertExisting(
+	req insertionRequest,
+	get func(tx pgx.Tx) (common.ImageCommon, error),
+) (err error) {
+	var img common.ImageCommon
+	err = db.InTransaction(req.ctx, func(tx pgx.Tx) (err error) {
+		img, err = get(tx)
 		switch err {
 		case nil:
 			return insertImage(tx, req, img)
@@ -372,20 +551,30 @@ func tryInsertExisting(req insertionRequest, id common.SHA1Hash,
 			return
 		}
 	})
+	if err != nil {
+		return
+	}
+	chargeUpload(req, img)
+	return
 }
 
-// Try inserting an image into the post
+// Try inserting an image into the post. The spam score of the upload must be
+// charged with chargeUpload after the transaction is committed.
 func insertImage(tx pgx.Tx, req insertionRequest, img common.ImageCommon,
 ) (err error) {
+	req.audit.setSHA1(img.SHA1)
+	req.audit.setSHA256(img.SHA256)
+
 	var thread uint64
 	thread, err = db.InsertImage(
 		req.ctx,
 		tx,
 		req.post,
 		req.pubKey,
-		img.SHA1,
+		img.SHA256,
 		req.name,
 		req.spoiler,
+		config.Get().Public.Uploads.AttachmentLimit(),
 	)
 	switch err {
 	case nil:
@@ -403,11 +592,26 @@ func insertImage(tx pgx.Tx, req insertionRequest, img common.ImageCommon,
 		// )
 	case pgx.ErrNoRows:
 		return errNoCandidatePost
+	case db.ErrTooManyAttachments:
+		return errTooManyAttachments
+	case db.ErrImageNotFound:
+		return errNotProcessed
 	default:
 		return
 	}
 }
 
+// Increment the spam score of the uploader by the score of the inserted img
+func chargeUpload(req insertionRequest, img common.ImageCommon) {
+	db.IncrementSpamScore(req.pubKey, uploadSpamScore(img))
+}
+
+// Return the spam score of inserting img into a post
+func uploadSpamScore(img common.ImageCommon) time.Duration {
+	scores := config.Get().SpamScores
+	return scores.Upload(fileCategory(&img), img.Size)
+}
+
 // handleError sends the client file upload errors and logs them server-side
 func handleError(w http.ResponseWriter, r *http.Request, f func() error) {
 	err := f()
@@ -431,28 +635,60 @@ func handleError(w http.ResponseWriter, r *http.Request, f func() error) {
 // insert it into an open post and send insertion even to listening clients
 func insertNewThumbnail(
 	req thumbnailingRequest,
-	id common.SHA1Hash,
+	id common.SHA256Hash,
+	SHA1 common.SHA1Hash,
 ) (err error) {
 	var img common.ImageCommon
-	img.SHA1 = id
+	img.SHA256 = id
+	img.SHA1 = SHA1
+
+	// Apply the constraints of the detected file category before processing
+	mime, _, err := detectMIME(req.file, allowedMimeTypes)
+	if err != nil {
+		if _, ok := err.(thumbnailer.ErrUnsupportedMIME); ok {
+			err = common.StatusError{
+				Err:  err,
+				Code: 400,
+			}
+		}
+		return
+	}
+	cat := fileCategories[mimeTypes[mime]]
+	limits := uploadLimits(cat)
+	maxSize := limits.SizeBytes()
+	if cat == config.Video {
+		// Video containers can turn out to only hold audio
+		if s := uploadLimits(config.Audio).SizeBytes(); s > maxSize {
+			maxSize = s
+		}
+	}
+	if uint64(req.size) > maxSize {
+		return errTooLarge
+	}
 
-	conf := config.Get()
-	thumb, err := processFile(req.file, &img, thumbnailer.Options{
+	media := mediaConstraints{
+		MediaConstraints: config.Get().Public.Uploads.Media,
+	}
+	if len(media.ForbidVideoAudio) != 0 {
+		media.forbidVideoAudio, err = forbidsVideoAudio(
+			req.ctx,
+			req.post,
+			media.ForbidVideoAudio,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	res, err := processFile(req.file, &img, thumbnailer.Options{
 		MaxSourceDims: thumbnailer.Dims{
-			Width:  uint(conf.MaxWidth),
-			Height: uint(conf.MaxHeight),
-		},
-		ThumbDims: thumbnailer.Dims{
-			Width:  150,
-			Height: 150,
+			Width:  uint(limits.Width),
+			Height: uint(limits.Height),
 		},
+		ThumbDims:         thumbnailDims(),
 		AcceptedMimeTypes: allowedMimeTypes,
-	})
-	defer func() {
-		if thumb != nil {
-			putThumbBuffer(thumb)
-		}
-	}()
+	}, media)
+	defer res.release()
 	if err != nil {
 		switch err.(type) {
 		case thumbnailer.ErrUnsupportedMIME, thumbnailer.ErrInvalidImage:
@@ -464,47 +700,161 @@ func insertNewThumbnail(
 		return
 	}
 
+	// File type and category can be refined during processing, which can
+	// change the applicable constraints
+	if img.Size > uploadLimits(fileCategory(&img)).SizeBytes() {
+		return errTooLarge
+	}
+
 	// Being done in one transaction prevents the image DB record from getting
 	// garbage-collected between the calls
 	err = db.InTransaction(req.ctx, func(tx pgx.Tx) (err error) {
-		var thumbR io.ReadSeeker
-		if thumb != nil {
-			thumbR = bytes.NewReader(thumb)
-		}
-		err = db.AllocateImage(req.ctx, tx, img, req.file, thumbR)
+		err = storeProcessedFile(req.ctx, tx, id, SHA1, &img, req.file, res)
 		if err != nil {
 			return
 		}
 		return insertImage(tx, req.insertionRequest, img)
 	})
+	if err != nil {
+		return
+	}
+	chargeUpload(req.insertionRequest, img)
+	return
+}
+
+// Allocate the processed file and its assets, unless an identical file was
+// already stored. img is replaced with the stored record in the latter case.
+// id and SHA1 are the hashes of the file before processing and are kept as
+// an alias for deduplication, if they differ from the stored file.
+func storeProcessedFile(
+	ctx context.Context,
+	tx pgx.Tx,
+	id common.SHA256Hash,
+	SHA1 common.SHA1Hash,
+	img *common.ImageCommon,
+	file io.ReadSeeker,
+	res processedFile,
+) (err error) {
+	allocate := true
+	if img.SHA256 != id {
+		// The remuxed file might have already been stored by a different
+		// upload
+		var existing common.ImageCommon
+		existing, err = db.GetImage(ctx, tx, img.SHA256)
+		switch err {
+		case nil:
+			*img = existing
+			allocate = false
+		case pgx.ErrNoRows:
+			err = nil
+		default:
+			return
+		}
+	}
+
+	if allocate {
+		var src, thumb io.ReadSeeker = file, nil
+		if res.remuxed != nil {
+			src = res.remuxed
+		}
+		if res.thumb != nil {
+			thumb = bytes.NewReader(res.thumb)
+		}
+		err = db.AllocateImage(ctx, tx, *img, src, thumb)
+		if err != nil {
+			return
+		}
+		err = assets.WriteSubtitles(img.SHA256, res.subtitles)
+		if err != nil {
+			return
+		}
+	}
+
+	if img.SHA256 != id {
+		// Keep the hashes of the original upload for deduplication
+		err = db.InsertImageAlias(ctx, tx, id, SHA1, img.SHA256)
+	}
+	return
+}
+
+// Return, if the thread of the target post has any of the tags, that forbid
+// audio in videos
+func forbidsVideoAudio(ctx context.Context, post uint64, tags []string) (
+	forbid bool,
+	err error,
+) {
+	threadTags, err := db.GetPostTags(ctx, post)
+	switch err {
+	case nil:
+	case pgx.ErrNoRows:
+		err = errNoCandidatePost
+		return
+	default:
+		return
+	}
+	for _, t := range threadTags {
+		for _, f := range tags {
+			if t == f {
+				return true, nil
+			}
+		}
+	}
 	return
 }
 
+// Return the effective upload constraints for a file category
+func uploadLimits(cat config.FileCategory) config.UploadMaximums {
+	return config.Get().Public.Uploads.Limits(cat)
+}
+
+// Return the category of a processed file. Files in video containers without
+// a video stream, like Ogg Vorbis, are audio.
+func fileCategory(img *common.ImageCommon) config.FileCategory {
+	cat := fileCategories[img.FileType]
+	if cat == config.Video && !img.Video {
+		cat = config.Audio
+	}
+	return cat
+}
+
+// Result of processing an uploaded file
+type processedFile struct {
+	// Encoded thumbnail, if any
+	thumb []byte
+
+	// Source file remuxed for progressive playback, if any
+	remuxed *os.File
+
+	// WebVTT subtitle tracks extracted from the file
+	subtitles [][]byte
+}
+
+// Release any resources held by the processed file
+func (p *processedFile) release() {
+	if p.thumb != nil {
+		putThumbBuffer(p.thumb)
+	}
+	if p.remuxed != nil {
+		p.remuxed.Close()
+		os.Remove(p.remuxed.Name())
+	}
+}
+
 // Separate function for easier testability
 func processFile(
 	f multipart.File,
 	img *common.ImageCommon,
 	opts thumbnailer.Options,
+	media mediaConstraints,
 ) (
-	thumb []byte,
+	res processedFile,
 	err error,
 ) {
 	src, thumbImage, err := thumbnailer.Process(f, opts)
-	defer func() {
-		// Add image internal buffer to pool.
-		// Only image type used in thumbnailer by default.
-		img, ok := thumbImage.(*image.RGBA)
-		if ok {
-			putThumbBuffer(img.Pix)
-		}
-	}()
+	defer releaseThumbImage(thumbImage)
 	switch err {
 	case nil:
-		if config.Get().JPEGThumbnails {
-			img.ThumbType = common.JPEG
-		} else {
-			img.ThumbType = common.WEBP
-		}
+		img.ThumbType = thumbnailType()
 	case thumbnailer.ErrCantThumbnail:
 		err = nil
 		img.ThumbType = common.NoFile
@@ -512,6 +862,14 @@ func processFile(
 		return
 	}
 
+	err = refineAudioMime(f, &src)
+	if err != nil {
+		return
+	}
+	err = refineImageMime(f, &src)
+	if err != nil {
+		return
+	}
 	img.FileType = mimeTypes[src.Mime]
 
 	img.Audio = src.HasAudio
@@ -541,29 +899,56 @@ func processFile(
 		img.ThumbHeight = uint16(b.Dy())
 	}
 
-	n, err := hashFile(img.MD5[:], f, md5.New())
+	// Losslessly move the index of MP4 files to the front for progressive
+	// playback. The remuxed file is stored under its own hashes.
+	var stored io.ReadSeeker = f
+	switch img.FileType {
+	case common.MP4, common.M4A:
+		res.remuxed, err = faststartMP4(f)
+		if err != nil {
+			return
+		}
+		if res.remuxed != nil {
+			stored = res.remuxed
+			_, err = hashFile(img.SHA256[:], stored, sha256.New())
+			if err != nil {
+				return
+			}
+			_, err = hashFile(img.SHA1[:], stored, sha1.New())
+			if err != nil {
+				return
+			}
+		}
+	}
+
+	n, err := hashFile(img.MD5[:], stored, md5.New())
 	if err != nil {
 		return
 	}
 	img.Size = uint64(n)
 
+	err = media.check(f, img, src.Length)
+	if err != nil {
+		return
+	}
+
+	tracks, err := extractSubtitles(f, img.FileType)
+	if err != nil {
+		// Subtitles are optional and should not cause a valid file to be
+		// rejected
+		log.Errorf("subtitle extraction: %s", err)
+		err = nil
+	}
+	for _, t := range tracks {
+		img.Subtitles = append(img.Subtitles, t.language)
+		res.subtitles = append(res.subtitles, t.vtt)
+	}
+
 	if thumbImage != nil {
-		w := bytes.NewBuffer(getThumbBuffer())
-		switch img.ThumbType {
-		case common.JPEG:
-			err = jpeg.Encode(w, thumbImage, &jpeg.Options{
-				Quality: 90,
-			})
-		case common.WEBP:
-			err = webp.Encode(w, thumbImage, &webp.Options{
-				Lossless: false,
-				Quality:  90,
-			})
-		}
+		res.thumb, err = encodeThumbnail(thumbImage, img)
 		if err != nil {
 			return
 		}
-		thumb = w.Bytes()
 	}
 
 	return
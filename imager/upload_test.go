@@ -12,6 +12,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"io"
+	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
@@ -19,8 +20,10 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/bakape/shamichan/imager/common"
+	"github.com/bakape/shamichan/imager/config"
 	"github.com/bakape/shamichan/imager/db"
 	"github.com/bakape/shamichan/imager/test"
 	"github.com/bakape/shamichan/imager/test/test_db"
@@ -421,12 +424,25 @@ func TestUpload(t *testing.T) {
 			code:         200,
 			img: common.ImageCommon{
 				Audio:     true,
-				FileType:  common.OGG,
+				FileType:  common.OPUS,
 				ThumbType: common.NoFile,
 				Duration:  0x05,
 				Size:      0xafcc,
 			},
 		},
+		{
+			name:         "WAV",
+			fileName:     "sample.wav",
+			downloadName: "sample",
+			code:         200,
+			img: common.ImageCommon{
+				Audio:     true,
+				FileType:  common.WAV,
+				ThumbType: common.NoFile,
+				Duration:  1,
+				Size:      0x3eac,
+			},
+		},
 		{
 			name:         "PNG",
 			fileName:     "sample.png",
@@ -551,21 +567,46 @@ func setAuthHeaders(t *testing.T, req *http.Request, kp test_db.KeyPair) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	h := sha256.New()
-	_, err = h.Write(kp.PubID[:])
-	if err != nil {
-		t.Fatal(err)
-	}
-	_, err = h.Write(nonce[:])
+	signRequest(t, req, kp, nonce, time.Now().Unix())
+}
+
+// Sign a request with a specific nonce and timestamp. The request body is
+// read and replaced for hashing.
+func signRequest(
+	t *testing.T,
+	req *http.Request,
+	kp test_db.KeyPair,
+	nonce [32]byte,
+	timestamp int64,
+) {
+	t.Helper()
+
+	body, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		t.Fatal(err)
 	}
-	sig, err := rsa.SignPKCS1v15(rand.Reader, kp.Key, crypto.SHA256, h.Sum(nil))
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	bodyHash := sha256.Sum256(body)
+
+	digest := sha256.Sum256(
+		signedMessage(kp.PubID, nonce, timestamp, bodyHash),
+	)
+	sig, err := rsa.SignPKCS1v15(
+		rand.Reader,
+		kp.Key,
+		crypto.SHA256,
+		digest[:],
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
 	req.Header.Set("X-Public-Key-ID", kp.PubID.String())
 	req.Header.Set("X-Nonce", base64.StdEncoding.EncodeToString(nonce[:]))
+	req.Header.Set("X-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set(
+		"X-Body-SHA256",
+		base64.StdEncoding.EncodeToString(bodyHash[:]),
+	)
 	req.Header.Set("X-Signature", base64.StdEncoding.EncodeToString(sig))
 }
 
@@ -609,30 +650,29 @@ func testUpload(t *testing.T, c uploadCase) {
 		test.AssertEquals(t, rec.Code, c.code)
 	}
 
-	sha1Hash, md5Hash := hashImage(t, f)
-	c.img.SHA1 = sha1Hash
-	c.img.MD5 = md5Hash
+	hashImage(t, f, &c.img)
 	assertImage(t, thread, common.Image{
 		ImageCommon: c.img,
 		Name:        c.downloadName,
 	})
 }
 
-func hashImage(t *testing.T, rs io.ReadSeeker) (
-	sha1_ common.SHA1Hash,
-	md5_ common.MD5Hash,
-) {
+// Populate the hashes of img from a file
+func hashImage(t *testing.T, rs io.ReadSeeker, img *common.ImageCommon) {
 	t.Helper()
 
-	_, err := hashFile(sha1_[:], rs, sha1.New())
+	_, err := hashFile(img.SHA256[:], rs, sha256.New())
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = hashFile(md5_[:], rs, md5.New())
+	_, err = hashFile(img.SHA1[:], rs, sha1.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hashFile(img.MD5[:], rs, md5.New())
 	if err != nil {
 		t.Fatal(err)
 	}
-	return
 }
 
 func assertImage(t *testing.T, postID uint64, std common.Image) {
@@ -640,7 +680,7 @@ func assertImage(t *testing.T, postID uint64, std common.Image) {
 
 	var img common.ImageCommon
 	err := db.InTransaction(context.Background(), func(tx pgx.Tx) (err error) {
-		img, err = db.GetImage(context.Background(), tx, std.SHA1)
+		img, err = db.GetImage(context.Background(), tx, std.SHA256)
 		return
 	})
 	if err != nil {
@@ -685,35 +725,94 @@ func TestUploadHash(t *testing.T) {
 		testUpload(t, c)
 	})
 
-	t.Run("hash upload", func(t *testing.T) {
-		thread, kp := test_db.InsertSampleThread(t)
-
-		f := test.OpenSample(t, c.fileName)
-		defer f.Close()
-		sha1Hash, md5Hash := hashImage(t, f)
-
-		body := url.Values{
-			"id":   {sha1Hash.String()},
-			"name": {c.fileName},
-			"post": {strconv.FormatUint(thread, 10)},
-		}.
-			Encode()
-		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
-		setAuthHeaders(t, req, kp)
-		req.Header.Set("Content-Length", strconv.Itoa(len(body)))
-		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-
-		rec := httptest.NewRecorder()
-		UploadImageHash(rec, req)
-		if rec.Code != 200 {
-			t.Fatalf("failed hash upload: %s", rec.Body.String())
-		}
-
-		c.img.SHA1 = sha1Hash
-		c.img.MD5 = md5Hash
-		assertImage(t, thread, common.Image{
-			ImageCommon: c.img,
-			Name:        c.downloadName,
+	f := test.OpenSample(t, c.fileName)
+	defer f.Close()
+	hashImage(t, f, &c.img)
+
+	for _, h := range [...]struct {
+		name, id string
+	}{
+		{"SHA-256", c.img.SHA256.String()},
+		{"legacy SHA1", c.img.SHA1.String()},
+	} {
+		id := h.id
+		t.Run("hash upload "+h.name, func(t *testing.T) {
+			thread, kp := test_db.InsertSampleThread(t)
+
+			body := url.Values{
+				"id":   {id},
+				"name": {c.fileName},
+				"post": {strconv.FormatUint(thread, 10)},
+			}.
+				Encode()
+			req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+			setAuthHeaders(t, req, kp)
+			req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+			req.Header.Set(
+				"Content-Type",
+				"application/x-www-form-urlencoded",
+			)
+
+			rec := httptest.NewRecorder()
+			UploadImageHash(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("failed hash upload: %s", rec.Body.String())
+			}
+
+			assertImage(t, thread, common.Image{
+				ImageCommon: c.img,
+				Name:        c.downloadName,
+			})
 		})
-	})
+	}
+}
+
+func TestFileCategory(t *testing.T) {
+	t.Parallel()
+
+	cases := [...]struct {
+		name string
+		img  common.ImageCommon
+		cat  config.FileCategory
+	}{
+		{
+			name: "image",
+			img:  common.ImageCommon{FileType: common.PNG},
+			cat:  config.Image,
+		},
+		{
+			name: "Ogg video",
+			img: common.ImageCommon{
+				FileType: common.OGG,
+				Video:    true,
+				Audio:    true,
+			},
+			cat: config.Video,
+		},
+		{
+			name: "Ogg Vorbis",
+			img: common.ImageCommon{
+				FileType: common.OGG,
+				Audio:    true,
+			},
+			cat: config.Audio,
+		},
+		{
+			name: "Opus",
+			img: common.ImageCommon{
+				FileType: common.OPUS,
+				Audio:    true,
+			},
+			cat: config.Audio,
+		},
+	}
+
+	for i := range cases {
+		c := cases[i]
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			test.AssertEquals(t, fileCategory(&c.img), c.cat)
+		})
+	}
 }
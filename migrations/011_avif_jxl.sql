@@ -0,0 +1,2 @@
+alter type file_type add value 'AVIF';
+alter type file_type add value 'JXL';
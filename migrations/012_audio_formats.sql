@@ -0,0 +1,3 @@
+alter type file_type add value 'OPUS';
+alter type file_type add value 'M4A';
+alter type file_type add value 'WAV';
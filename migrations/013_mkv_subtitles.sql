@@ -0,0 +1,69 @@
+alter type file_type add value 'MKV';
+
+-- Languages of WebVTT subtitle tracks extracted from the file, in track order
+alter table images add column subtitles varchar(35)[];
+
+-- Encode post row to json
+create or replace function encode(p posts)
+returns jsonb
+language plpgsql stable parallel safe strict
+as $$
+declare
+	data jsonb;
+	img images;
+begin
+	data = jsonb_build_object(
+		'id', p.id,
+		'thread', p.thread,
+		'page', p.page,
+
+		'created_on', to_unix(p.created_on),
+		'open', p.open,
+
+		'sage', p.sage,
+		'name', p.name,
+		'trip', p.trip,
+		'flag', p.flag,
+
+		'body', p.body,
+		'image', null
+	);
+
+	if p.image is not null then
+		select i.* into img
+			from images i
+			where i.sha1 = p.image;
+
+		data = data || jsonb_build_object(
+			'image', jsonb_build_object(
+				'name', p.image_name,
+				'spoilered', p.image_spoilered,
+
+				'sha1', encode(img.sha1, 'hex'),
+				'md5', encode(img.md5, 'hex'),
+
+				'audio', img.audio,
+				'video', img.video,
+
+				'file_type', img.file_type,
+				'thumb_type', img.thumb_type,
+
+				'width', img.width,
+				'height', img.height,
+				'thumb_width', img.thumb_width,
+				'thumb_height', img.thumb_height,
+
+				'size', img.size,
+				'duration', img.duration,
+
+				'title', img.title,
+				'artist', img.artist,
+
+				'subtitles', img.subtitles
+			)
+		);
+	end if;
+
+	return data;
+end;
+$$;
@@ -0,0 +1,8 @@
+-- Alternative hashes of images modified during processing, like MP4 files
+-- remuxed for progressive playback. Allows deduplicating uploads of the
+-- original file.
+create table image_aliases (
+	sha1 bytea primary key check (octet_length(sha1) = 20),
+	image bigint not null references images on delete cascade
+);
+create index image_aliases_image_idx on image_aliases (image);
@@ -0,0 +1,79 @@
+-- SHA-256 hashes are the primary content identifier. SHA1 hashes are kept for
+-- lookups by legacy clients.
+--
+-- Hashes of images stored before this migration are backfilled and their files
+-- renamed by the imager in the background after startup.
+alter table images
+	add column sha256 bytea unique check (octet_length(sha256) = 32);
+create index images_sha1_idx on images (sha1);
+
+-- Aliases recorded before this migration only have SHA1 hashes, as the
+-- original files are not available for rehashing
+alter table image_aliases
+	add column sha256 bytea unique check (octet_length(sha256) = 32);
+
+-- Encode post row to json
+create or replace function encode(p posts)
+returns jsonb
+language plpgsql stable parallel safe strict
+as $$
+declare
+	data jsonb;
+	img images;
+begin
+	data = jsonb_build_object(
+		'id', p.id,
+		'thread', p.thread,
+		'page', p.page,
+
+		'created_on', to_unix(p.created_on),
+		'open', p.open,
+
+		'sage', p.sage,
+		'name', p.name,
+		'trip', p.trip,
+		'flag', p.flag,
+
+		'body', p.body,
+		'image', null
+	);
+
+	if p.image is not null then
+		select i.* into img
+			from images i
+			where i.id = p.image;
+
+		data = data || jsonb_build_object(
+			'image', jsonb_build_object(
+				'name', p.image_name,
+				'spoilered', p.image_spoilered,
+
+				'sha1', encode(img.sha1, 'hex'),
+				'sha256', encode(img.sha256, 'hex'),
+				'md5', encode(img.md5, 'hex'),
+
+				'audio', img.audio,
+				'video', img.video,
+
+				'file_type', img.file_type,
+				'thumb_type', img.thumb_type,
+
+				'width', img.width,
+				'height', img.height,
+				'thumb_width', img.thumb_width,
+				'thumb_height', img.thumb_height,
+
+				'size', img.size,
+				'duration', img.duration,
+
+				'title', img.title,
+				'artist', img.artist,
+
+				'subtitles', img.subtitles
+			)
+		);
+	end if;
+
+	return data;
+end;
+$$;
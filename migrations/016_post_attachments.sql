@@ -0,0 +1,115 @@
+-- Files attached to a post in display order. The first attachment is also
+-- stored in posts.image for compatibility.
+create table post_attachments (
+	post bigint not null references posts on delete cascade,
+	position smallint not null check (position >= 0),
+	image bigint not null references images,
+	name varchar(200) not null default '',
+	spoilered bool not null default false,
+	primary key (post, position)
+);
+create index post_attachments_image_idx on post_attachments (image);
+
+insert into post_attachments (post, position, image, name, spoilered)
+select id, 0, image, image_name, image_spoilered
+from posts
+where image is not null;
+
+-- Encode a post attachment to json
+create or replace function encode(a post_attachments)
+returns jsonb
+language sql stable parallel safe strict
+as $$
+	select jsonb_build_object(
+		'name', a.name,
+		'spoilered', a.spoilered,
+
+		'sha1', encode(i.sha1, 'hex'),
+		'sha256', encode(i.sha256, 'hex'),
+		'md5', encode(i.md5, 'hex'),
+
+		'audio', i.audio,
+		'video', i.video,
+
+		'file_type', i.file_type,
+		'thumb_type', i.thumb_type,
+
+		'width', i.width,
+		'height', i.height,
+		'thumb_width', i.thumb_width,
+		'thumb_height', i.thumb_height,
+
+		'size', i.size,
+		'duration', i.duration,
+
+		'title', i.title,
+		'artist', i.artist,
+
+		'subtitles', i.subtitles
+	)
+	from images i
+	where i.id = a.image;
+$$;
+
+-- Encode post row to json
+create or replace function encode(p posts)
+returns jsonb
+language plpgsql stable parallel safe strict
+as $$
+declare
+	attachments jsonb;
+begin
+	select coalesce(jsonb_agg(encode(a) order by a.position), '[]'::jsonb)
+		into attachments
+		from post_attachments a
+		where a.post = p.id;
+
+	return jsonb_build_object(
+		'id', p.id,
+		'thread', p.thread,
+		'page', p.page,
+
+		'created_on', to_unix(p.created_on),
+		'open', p.open,
+
+		'sage', p.sage,
+		'name', p.name,
+		'trip', p.trip,
+		'flag', p.flag,
+
+		'body', p.body,
+		'image', attachments->0,
+		'attachments', attachments
+	);
+end;
+$$;
+
+-- Bump the thread and notify listeners on every attachment insertion, not only
+-- the first one, which is also stored in posts.image
+create or replace function after_post_attachments_insert()
+returns trigger
+language plpgsql
+as $$
+declare
+	p posts;
+begin
+	select * into p
+		from posts
+		where id = new.post;
+
+	if not p.sage then
+		call bump_thread(p.thread);
+	end if;
+
+	perform pg_notify(
+		'post_attachments.inserted',
+		p.thread || ':' || new.post || ':' || new.position
+	);
+	return null;
+end;
+$$;
+
+create trigger after_post_attachments_insert
+after insert on post_attachments
+for each row
+execute function after_post_attachments_insert();
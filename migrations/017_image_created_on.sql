@@ -0,0 +1,4 @@
+-- Allocation time of image records for incremental exports. Images stored
+-- before this migration get the time of the migration.
+alter table images add column created_on timestamptz_auto_now;
+create index images_created_on_idx on images (created_on);
@@ -0,0 +1,17 @@
+create type scrub_problem as enum (
+	'missing',
+	'corrupt',
+	'size_mismatch'
+);
+
+-- Problems with stored files found by the integrity scrubber. Results of an
+-- image are replaced each time it is scrubbed.
+create table scrub_results (
+	image bigint not null references images on delete cascade,
+	path varchar(200) not null,
+	problem scrub_problem not null,
+	quarantined bool not null default false,
+	detected_on timestamptz_auto_now,
+	primary key (image, path)
+);
+create index scrub_results_detected_on_idx on scrub_results (detected_on);
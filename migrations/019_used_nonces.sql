@@ -0,0 +1,7 @@
+-- Nonces of signed upload requests. Kept until the signature expires to
+-- reject replayed requests on all imager instances.
+create table used_nonces (
+	nonce bytea primary key check (octet_length(nonce) = 32)
+)
+inherits (expiries);
+create index used_nonces_expires_idx on used_nonces (expires);
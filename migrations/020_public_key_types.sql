@@ -0,0 +1,10 @@
+create type public_key_type as enum (
+	'rsa',
+	'ed25519',
+	'ecdsa_p256'
+);
+
+-- Signature algorithm of the key. All keys registered before other algorithms
+-- were supported are RSA.
+alter table public_keys
+	add column key_type public_key_type not null default 'rsa';
@@ -0,0 +1,19 @@
+-- Revoked keys are kept to preserve post ownership, but can no longer be used
+-- to authenticate
+alter table public_keys
+	add column revoked bool not null default false;
+
+create or replace function notify_public_key_revocation()
+returns trigger
+language plpgsql
+as $$
+begin
+	perform pg_notify('public_keys.revoked', old.public_id::text);
+	return null;
+end;
+$$;
+
+create trigger notify_public_key_revocation
+after update of revoked or delete on public_keys
+for each row
+execute function notify_public_key_revocation();
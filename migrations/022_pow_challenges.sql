@@ -0,0 +1,8 @@
+-- Proof-of-work challenges issued to uploaders. Deleted, once used.
+create table pow_challenges (
+	challenge bytea primary key check (octet_length(challenge) = 32),
+	public_key bigint not null references public_keys,
+	difficulty smallint not null check (difficulty between 0 and 255)
+)
+inherits (expiries);
+create index pow_challenges_expires_idx on pow_challenges (expires);
@@ -0,0 +1,14 @@
+-- Upload bans of public keys and IP ranges. Permanent bans expire at
+-- 'infinity'.
+create table bans (
+	id bigserial primary key,
+	public_key bigint references public_keys on delete cascade,
+	ip cidr,
+	reason text not null,
+	created_on timestamptz not null default now(),
+	check (public_key is not null or ip is not null)
+)
+inherits (expiries);
+create index bans_expires_idx on bans (expires);
+create index bans_public_key_idx on bans (public_key);
+create index bans_ip_idx on bans using gist (ip inet_ops);
@@ -0,0 +1,41 @@
+create type moderation_level as enum (
+	'janitors',
+	'moderators',
+	'owners',
+	'admin'
+);
+
+-- Staff members identified by their public keys
+create table staff (
+	public_key bigint primary key references public_keys on delete cascade,
+	level moderation_level not null
+);
+
+create type moderation_action as enum (
+	'ban_post',
+	'unban_post',
+	'delete_post',
+	'delete_image',
+	'spoiler_image',
+	'lock_thread',
+	'delete_board',
+	'meido_vision',
+	'purge_post',
+	'shadow_bin_post',
+	'purge_image'
+);
+
+-- Log of actions performed by staff
+create table moderation_log (
+	id bigserial primary key,
+	type moderation_action not null,
+	post bigint references posts on delete set null,
+
+	-- Key of the staff member, that performed the action
+	public_key bigint references public_keys on delete set null,
+
+	data text not null default '',
+	created_on timestamptz_auto_now
+);
+create index moderation_log_post_idx on moderation_log (post);
+create index moderation_log_public_key_idx on moderation_log (public_key);
@@ -0,0 +1,38 @@
+-- Append-only log of upload attempts of authenticated uploaders. Entries are
+-- pruned after the retention period through the expiries parent table.
+--
+-- Public keys and posts are not foreign keys, so entries outlive them.
+create table upload_audit (
+	id bigserial primary key,
+	public_key bigint not null,
+	ip inet,
+	sha1 bytea check (octet_length(sha1) = 20),
+	sha256 bytea check (octet_length(sha256) = 32),
+	name varchar(200) not null default '',
+	post bigint,
+	outcome text not null check (
+		outcome in ('inserted', 'rejected', 'failed', 'abandoned')
+	),
+	error text,
+	created_on timestamptz_auto_now
+)
+inherits (expiries);
+create index upload_audit_expires_idx on upload_audit (expires);
+create index upload_audit_public_key_idx on upload_audit (public_key);
+create index upload_audit_ip_idx on upload_audit using gist (ip inet_ops);
+create index upload_audit_sha1_idx on upload_audit (sha1);
+create index upload_audit_sha256_idx on upload_audit (sha256);
+
+create or replace function reject_upload_audit_update()
+returns trigger
+language plpgsql
+as $$
+begin
+	raise exception 'upload_audit is append-only';
+end;
+$$;
+
+create trigger reject_upload_audit_update
+before update on upload_audit
+for each row
+execute function reject_upload_audit_update();
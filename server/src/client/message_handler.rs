@@ -636,12 +636,16 @@ impl MessageHandler {
 				signature,
 			} => {
 				match db::get_public_key(&pub_id).await? {
-					Some((priv_id, pub_key)) => {
+					Some((priv_id, pub_key, key_type, revoked)) => {
+						if revoked {
+							str_err!("public key revoked");
+						}
 						self.pub_key = PubKeyDesc { priv_id, pub_id };
 						self.handle_auth_saved(
 							nonce,
 							signature,
 							pub_key.as_ref(),
+							&key_type,
 						)?;
 					}
 					None => {
@@ -665,19 +669,15 @@ impl MessageHandler {
 		nonce: [u8; 32],
 		signature: Signature,
 		pub_key: &[u8],
+		key_type: &str,
 	) -> DynResult {
 		use common::payloads::{HandshakeRes, PubKeyStatus};
 
-		let pk = openssl::pkey::PKey::from_rsa(
-			openssl::rsa::Rsa::public_key_from_der(pub_key)?,
-		)?;
-		let mut v = openssl::sign::Verifier::new(
-			openssl::hash::MessageDigest::sha256(),
-			&pk,
-		)?;
-		v.update(self.pub_key.pub_id.as_bytes())?;
-		v.update(&nonce)?;
-		if !v.verify(&signature.0)? {
+		check_len!(signature.0, payloads::MAX_SIGNATURE_LEN);
+		let mut msg = Vec::with_capacity(16 + 32);
+		msg.extend(self.pub_key.pub_id.as_bytes());
+		msg.extend(&nonce);
+		if !Self::verify_signature(key_type, pub_key, &msg, &signature.0)? {
 			str_err!("invalid signature");
 		}
 
@@ -692,6 +692,75 @@ impl MessageHandler {
 		Ok(())
 	}
 
+	/// Verify the signature of msg by a DER-encoded public key of the passed
+	/// public_key_type.
+	///
+	/// RSA keys use PKCS #1 v1.5 signatures and ECDSA keys signatures either
+	/// in ASN.1 DER or raw r || s form, as produced by WebCrypto. Both sign the
+	/// SHA-256 hash of msg. Ed25519 keys sign msg directly.
+	fn verify_signature(
+		key_type: &str,
+		pub_key: &[u8],
+		msg: &[u8],
+		sig: &[u8],
+	) -> DynResult<bool> {
+		use openssl::{
+			bn::BigNum,
+			ecdsa::EcdsaSig,
+			hash::MessageDigest,
+			nid::Nid,
+			pkey::{Id, PKey},
+			rsa::Rsa,
+			sign::Verifier,
+		};
+
+		Ok(match key_type {
+			"rsa" => {
+				// Some older RSA keys are stored in PKCS #1 form
+				let pk = PKey::from_rsa(
+					Rsa::public_key_from_der(pub_key)
+						.or_else(|_| Rsa::public_key_from_der_pkcs1(pub_key))?,
+				)?;
+				let mut v = Verifier::new(MessageDigest::sha256(), &pk)?;
+				v.update(msg)?;
+				v.verify(sig)?
+			}
+			"ed25519" => {
+				let pk = PKey::public_key_from_der(pub_key)?;
+				if pk.id() != Id::ED25519 {
+					str_err!("public key is not of type {}", key_type);
+				}
+				let mut v = Verifier::new_without_digest(&pk)?;
+				v.verify_oneshot(sig, msg)?
+			}
+			"ecdsa_p256" => {
+				let pk = PKey::public_key_from_der(pub_key)?;
+				if pk.id() != Id::EC
+					|| pk.ec_key()?.group().curve_name()
+						!= Some(Nid::X9_62_PRIME256V1)
+				{
+					str_err!("public key is not of type {}", key_type);
+				}
+
+				let der;
+				let sig = if sig.len() == 64 {
+					der = EcdsaSig::from_private_components(
+						BigNum::from_slice(&sig[..32])?,
+						BigNum::from_slice(&sig[32..])?,
+					)?
+					.to_der()?;
+					&der
+				} else {
+					sig
+				};
+				let mut v = Verifier::new(MessageDigest::sha256(), &pk)?;
+				v.update(msg)?;
+				v.verify(sig)?
+			}
+			_ => str_err!("unsupported public key type: {}", key_type),
+		})
+	}
+
 	/// Handle repeated handshake after request by server
 	fn handle_reshake(
 		&mut self,
@@ -707,7 +776,12 @@ impl MessageHandler {
 				if pub_id != self.pub_key.pub_id {
 					str_err!("different public key public id in reshake");
 				}
-				self.handle_auth_saved(nonce, signature, pub_key)?;
+				self.handle_auth_saved(
+					nonce,
+					signature,
+					pub_key,
+					db::public_key_type(pub_key)?,
+				)?;
 			}
 			_ => str_err!("invalid authorization variant"),
 		}
@@ -840,3 +914,88 @@ impl MessageHandler {
 		Ok(())
 	}
 }
+
+#[cfg(test)]
+mod test {
+	use super::MessageHandler;
+	use openssl::{
+		ec::{EcGroup, EcKey},
+		ecdsa::EcdsaSig,
+		hash::MessageDigest,
+		nid::Nid,
+		pkey::PKey,
+		rsa::Rsa,
+		sign::Signer,
+	};
+
+	const MSG: &[u8] = b"id and nonce";
+
+	#[test]
+	fn verify_rsa() {
+		let rsa = Rsa::generate(2048).unwrap();
+		let pkcs1 = rsa.public_key_to_der_pkcs1().unwrap();
+		let key = PKey::from_rsa(rsa).unwrap();
+		let mut s = Signer::new(MessageDigest::sha256(), &key).unwrap();
+		s.update(MSG).unwrap();
+		let sig = s.sign_to_vec().unwrap();
+
+		for der in [key.public_key_to_der().unwrap(), pkcs1].iter() {
+			assert!(MessageHandler::verify_signature("rsa", der, MSG, &sig)
+				.unwrap());
+			assert!(!MessageHandler::verify_signature("rsa", der, b"x", &sig)
+				.unwrap());
+		}
+	}
+
+	#[test]
+	fn verify_ed25519() {
+		let key = PKey::generate_ed25519().unwrap();
+		let der = key.public_key_to_der().unwrap();
+		let sig = Signer::new_without_digest(&key)
+			.unwrap()
+			.sign_oneshot_to_vec(MSG)
+			.unwrap();
+
+		assert!(MessageHandler::verify_signature("ed25519", &der, MSG, &sig)
+			.unwrap());
+		assert!(
+			!MessageHandler::verify_signature("ed25519", &der, b"x", &sig)
+				.unwrap()
+		);
+		assert!(
+			MessageHandler::verify_signature("rsa", &der, MSG, &sig).is_err()
+		);
+	}
+
+	#[test]
+	fn verify_ecdsa_p256() {
+		let key = PKey::from_ec_key(
+			EcKey::generate(
+				&EcGroup::from_curve_name(Nid::X9_62_PRIME256V1).unwrap(),
+			)
+			.unwrap(),
+		)
+		.unwrap();
+		let der = key.public_key_to_der().unwrap();
+		let mut s = Signer::new(MessageDigest::sha256(), &key).unwrap();
+		s.update(MSG).unwrap();
+		let asn1 = s.sign_to_vec().unwrap();
+
+		// WebCrypto form
+		let parsed = EcdsaSig::from_der(&asn1).unwrap();
+		let mut raw = parsed.r().to_vec_padded(32).unwrap();
+		raw.extend(parsed.s().to_vec_padded(32).unwrap());
+
+		for sig in [&asn1, &raw].iter() {
+			assert!(MessageHandler::verify_signature(
+				"ecdsa_p256",
+				&der,
+				MSG,
+				sig
+			)
+			.unwrap());
+		}
+		assert!(MessageHandler::verify_signature("ed25519", &der, MSG, &raw)
+			.is_err());
+	}
+}
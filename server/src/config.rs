@@ -1,6 +1,10 @@
 use clap::Parser;
+use common::config::FileCategory;
 use serde::{Deserialize, Serialize};
-use std::sync::{Arc, RwLock};
+use std::{
+	collections::HashMap,
+	sync::{Arc, RwLock},
+};
 
 // TODO: read configs from DB or fallback to default, if none
 
@@ -50,6 +54,15 @@ pub struct SpamScores {
 	/// Score for inserting an image into the post
 	pub image: usize,
 
+	/// Additional score per MB of the image inserted into the post
+	#[serde(default)]
+	pub image_per_mb: usize,
+
+	/// Multipliers of image scores for specific file categories. Unset
+	/// categories have a multiplier of 1.
+	#[serde(default)]
+	pub category_multipliers: HashMap<FileCategory, f64>,
+
 	/// Score for creating a post
 	pub post_creation: usize,
 }
@@ -60,11 +73,64 @@ impl Default for SpamScores {
 		Self {
 			character: 85,
 			image: 7500,
+			image_per_mb: 1000,
+			category_multipliers: Default::default(),
 			post_creation: 7500,
 		}
 	}
 }
 
+/// Token bucket budget of uploads per minute. Zero values disable the
+/// respective limit.
+#[derive(Serialize, Deserialize, Debug, Clone, Default)]
+#[serde(default)]
+pub struct RateLimit {
+	/// Requests per minute
+	pub requests: u32,
+
+	/// Uploaded MB per minute
+	pub size: f64,
+}
+
+/// Upload rate limits
+#[derive(Serialize, Deserialize, Debug, Clone)]
+#[serde(default)]
+pub struct RateLimits {
+	/// Budget of each client IP. IPv6 clients are limited per /64 subnet.
+	pub ip: RateLimit,
+
+	/// Budget of each public key
+	pub key: RateLimit,
+}
+
+impl Default for RateLimits {
+	#[inline]
+	fn default() -> Self {
+		Self {
+			ip: RateLimit {
+				requests: 60,
+				size: 200.0,
+			},
+			key: RateLimit {
+				requests: 30,
+				size: 100.0,
+			},
+		}
+	}
+}
+
+/// Per-country and per-ASN upload rules. Require GeoIP databases to be
+/// configured on the imager.
+#[derive(Serialize, Deserialize, Debug, Clone, Default)]
+#[serde(default)]
+pub struct IPPolicy {
+	/// ISO 3166-1 alpha-2 codes of countries denied from uploading
+	pub denied_countries: Vec<String>,
+
+	/// Numbers of autonomous systems denied from uploading
+	pub denied_asns: Vec<u32>,
+}
+
 /// Global server configurations
 #[derive(Serialize, Deserialize, Debug, Clone)]
 pub struct Config {
@@ -81,6 +147,28 @@ pub struct Config {
 
 	/// Booru tags for the captcha pool
 	pub captcha_tags: Vec<String>,
+
+	/// Upload rate limits
+	#[serde(default)]
+	pub rate_limits: RateLimits,
+
+	/// Per-country and per-ASN upload rules
+	#[serde(default)]
+	pub ip_policy: IPPolicy,
+
+	/// Days to keep upload audit log entries for. Entries are kept
+	/// indefinitely, if 0.
+	#[serde(default = "default_upload_audit_retention")]
+	pub upload_audit_retention: u32,
+
+	/// Reject SHA1 hashes in upload hash lookups. Enable, once legacy clients
+	/// are no longer in use.
+	#[serde(default)]
+	pub disable_sha1_lookups: bool,
+}
+
+fn default_upload_audit_retention() -> u32 {
+	90
 }
 
 impl Default for Config {
@@ -95,6 +183,10 @@ impl Default for Config {
 				"cirno".into(),
 				"hakurei_reimu".into(),
 			],
+			rate_limits: Default::default(),
+			ip_policy: Default::default(),
+			upload_audit_retention: default_upload_audit_retention(),
+			disable_sha1_lookups: Default::default(),
 		}
 	}
 }
@@ -3,12 +3,35 @@ use crate::util::DynResult;
 use rand::prelude::*;
 use uuid::Uuid;
 
+/// Return the public_key_type of a DER-encoded SubjectPublicKeyInfo.
+/// Only RSA, Ed25519 and ECDSA P-256 keys are supported.
+pub fn public_key_type(pub_key: &[u8]) -> DynResult<&'static str> {
+	use openssl::{
+		nid::Nid,
+		pkey::{Id, PKey},
+	};
+
+	let pk = PKey::public_key_from_der(pub_key)?;
+	Ok(match pk.id() {
+		Id::RSA => "rsa",
+		Id::ED25519 => "ed25519",
+		Id::EC
+			if pk.ec_key()?.group().curve_name()
+				== Some(Nid::X9_62_PRIME256V1) =>
+		{
+			"ecdsa_p256"
+		}
+		id => Err(format!("unsupported public key type: {:?}", id))?,
+	})
+}
+
 /// Write public key to DB, if not already written.
 /// Return its private and public IDs and, if this was a fresh insert or an
-/// existing key.
+/// existing key. Returns an error for revoked keys.
 pub async fn register_public_key(
 	pub_key: &[u8],
 ) -> DynResult<(u64, Uuid, bool)> {
+	let key_type = public_key_type(pub_key)?;
 	let pub_id: Uuid = {
 		let mut buf: [u8; 16] = Default::default();
 		thread_rng().try_fill_bytes(&mut buf)?;
@@ -19,11 +42,12 @@ pub async fn register_public_key(
 	// the time the select is executed
 
 	let fresh = sqlx::query!(
-		"insert into public_keys (public_id, public_key)
-		values ($1, $2)
+		"insert into public_keys (public_id, public_key, key_type)
+		values ($1, $2, $3::text::public_key_type)
 		on conflict (public_key) do nothing",
 		pub_id,
 		pub_key,
+		key_type,
 	)
 	.execute(&pool())
 	.await?
@@ -31,28 +55,32 @@ pub async fn register_public_key(
 		== 1;
 
 	let r = sqlx::query!(
-		"select id, public_id
+		"select id, public_id, revoked
 		from public_keys
 		where public_key = $1",
 		pub_key,
 	)
 	.fetch_one(&pool())
 	.await?;
+	if r.revoked {
+		return Err("public key revoked".into());
+	}
 
 	Ok((r.id as u64, r.public_id, fresh))
 }
 
-/// Get public key's private ID and key buffer by its public ID
+/// Get public key's private ID, key buffer, public_key_type and, if it has been
+/// revoked, by its public ID
 pub async fn get_public_key(
 	pub_id: &Uuid,
-) -> Result<Option<(u64, Vec<u8>)>, sqlx::Error> {
+) -> Result<Option<(u64, Vec<u8>, String, bool)>, sqlx::Error> {
 	sqlx::query!(
-		"select id, public_key
+		r#"select id, public_key, key_type::text as "key_type!", revoked
 		from public_keys
-		where public_id = $1",
+		where public_id = $1"#,
 		pub_id,
 	)
 	.fetch_optional(&pool())
 	.await
-	.map(|r| r.map(|r| (r.id as u64, r.public_key)))
+	.map(|r| r.map(|r| (r.id as u64, r.public_key, r.key_type, r.revoked)))
 }